@@ -0,0 +1,68 @@
+package lightstep
+
+import (
+	"sync"
+
+	ot "github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+)
+
+// autoFinishSpan finishes its Span at most once, either explicitly or when
+// its context is done.
+type autoFinishSpan struct {
+	ot.Span
+	once     sync.Once
+	finished chan struct{}
+}
+
+// SpanFromContextWithAutoFinish returns the span held by ctx, arranged to be
+// finished when ctx is done unless it is finished explicitly first. It
+// returns nil if ctx holds no span. This is intended for request-scoped
+// spans, to guard against leaking spans on early returns.
+//
+// The returned span must be used in place of the one held by ctx: finishing
+// the latter directly would report it twice.
+func SpanFromContextWithAutoFinish(ctx context.Context) ot.Span {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	s := &autoFinishSpan{Span: span, finished: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Finish()
+		case <-s.finished:
+		}
+	}()
+	return s
+}
+
+// SetOperationName returns s rather than the wrapped Span, as do SetTag and
+// SetBaggageItem, so that a chained Finish still goes through s.
+func (s *autoFinishSpan) SetOperationName(operationName string) ot.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s *autoFinishSpan) SetTag(key string, value interface{}) ot.Span {
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s *autoFinishSpan) SetBaggageItem(restrictedKey, value string) ot.Span {
+	s.Span.SetBaggageItem(restrictedKey, value)
+	return s
+}
+
+func (s *autoFinishSpan) Finish() {
+	s.FinishWithOptions(ot.FinishOptions{})
+}
+
+func (s *autoFinishSpan) FinishWithOptions(opts ot.FinishOptions) {
+	s.once.Do(func() {
+		// Also stops the goroutine watching the context.
+		close(s.finished)
+		s.Span.FinishWithOptions(opts)
+	})
+}
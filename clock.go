@@ -0,0 +1,65 @@
+package lightstep
+
+import (
+	"time"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// clockTracer wraps a basictracer.Tracer so that span start and finish
+// timestamps are read from a caller-supplied clock rather than time.Now().
+// Explicit StartTime and FinishTime options still take precedence.
+type clockTracer struct {
+	basictracer.Tracer
+	now func() time.Time
+}
+
+func newClockTracer(tracer ot.Tracer, now func() time.Time) ot.Tracer {
+	return &clockTracer{tracer.(basictracer.Tracer), now}
+}
+
+func (t *clockTracer) StartSpan(operationName string, opts ...ot.StartSpanOption) ot.Span {
+	// Options apply in order, so a caller-provided StartTime wins.
+	opts = append([]ot.StartSpanOption{ot.StartTime(t.now())}, opts...)
+	return &clockSpan{t.Tracer.StartSpan(operationName, opts...).(basictracer.Span), t}
+}
+
+// clockSpan finishes its span at the time given by its tracer's clock.
+type clockSpan struct {
+	basictracer.Span
+	tracer *clockTracer
+}
+
+func (s *clockSpan) Finish() {
+	s.FinishWithOptions(ot.FinishOptions{})
+}
+
+func (s *clockSpan) FinishWithOptions(opts ot.FinishOptions) {
+	if opts.FinishTime.IsZero() {
+		opts.FinishTime = s.tracer.now()
+	}
+	s.Span.FinishWithOptions(opts)
+}
+
+// The following return the clockSpan itself so that chained calls such as
+// span.SetTag(k, v).Finish() still use the clock.
+
+func (s *clockSpan) SetOperationName(operationName string) ot.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s *clockSpan) SetTag(key string, value interface{}) ot.Span {
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s *clockSpan) SetBaggageItem(key, val string) ot.Span {
+	s.Span.SetBaggageItem(key, val)
+	return s
+}
+
+func (s *clockSpan) Tracer() ot.Tracer {
+	return s.tracer
+}
@@ -0,0 +1,26 @@
+package lightstep
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// DialContextFunc opens a network connection to addr; see
+// Options.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// grpcDialer adapts d to the dialer signature expected by grpc.
+func (d DialContextFunc) grpcDialer() grpc.DialOption {
+	return grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return d(ctx, "tcp", addr)
+	})
+}
@@ -2,6 +2,7 @@ package lightstep
 
 import (
 	"encoding/json"
+	"unicode/utf8"
 
 	cpb "github.com/lightstep/lightstep-tracer-go/collectorpb"
 	"github.com/opentracing/opentracing-go/log"
@@ -86,21 +87,39 @@ func (lfe *logFieldEncoder) EmitLazyLogger(value log.LazyLogger) {
 
 func (lfe *logFieldEncoder) emitSafeKey(key string) {
 	if len(key) > lfe.recorder.maxLogKeyLen {
-		key = key[:(lfe.recorder.maxLogKeyLen-1)] + ellipsis
+		key = lfe.recorder.truncate(key, lfe.recorder.maxLogKeyLen)
 	}
 	lfe.currentKeyValue.Key = key
 }
 func (lfe *logFieldEncoder) emitSafeString(str string) {
 	if len(str) > lfe.recorder.maxLogValueLen {
-		str = str[:(lfe.recorder.maxLogValueLen-1)] + ellipsis
+		str = lfe.recorder.truncate(str, lfe.recorder.maxLogValueLen)
 	}
 	lfe.currentKeyValue.Value = &cpb.KeyValue_StringValue{str}
 }
 func (lfe *logFieldEncoder) emitSafeJSON(json string) {
 	if len(json) > lfe.recorder.maxLogValueLen {
-		str := json[:(lfe.recorder.maxLogValueLen-1)] + ellipsis
+		str := lfe.recorder.truncate(json, lfe.recorder.maxLogValueLen)
 		lfe.currentKeyValue.Value = &cpb.KeyValue_StringValue{str}
 		return
 	}
 	lfe.currentKeyValue.Value = &cpb.KeyValue_JsonValue{json}
 }
+
+// truncate shortens s to at most maxLen bytes, including the truncation
+// marker, which is left out if omitted or if it would not fit. s is cut at
+// a rune boundary, so valid UTF-8 stays valid.
+func (r *Recorder) truncate(s string, maxLen int) string {
+	marker := r.truncationMarker
+	if marker == "" {
+		marker = ellipsis
+	}
+	if r.omitTruncation || len(marker) >= maxLen {
+		marker = ""
+	}
+	cut := maxLen - len(marker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + marker
+}
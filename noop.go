@@ -0,0 +1,31 @@
+package lightstep
+
+import (
+	"github.com/lightstep/lightstep-tracer-go/thrift_rpc"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// NoopRecorder is a basictracer.SpanRecorder that discards every span. It
+// starts no goroutines and holds no connections, so a Tracer using it is
+// inert but otherwise fully functional: spans can be started, tagged,
+// propagated, and passed to FlushLightStepTracer and friends.
+type NoopRecorder struct{}
+
+// NewNoopRecorder returns a NoopRecorder.
+func NewNoopRecorder() *NoopRecorder {
+	return &NoopRecorder{}
+}
+
+// RecordSpan discards raw.
+func (*NoopRecorder) RecordSpan(raw basictracer.RawSpan) {}
+
+// NewNoopTracer returns a basictracer Tracer whose spans are never sampled
+// and are discarded by a NoopRecorder.
+func NewNoopTracer() ot.Tracer {
+	options := basictracer.DefaultOptions()
+	options.ShouldSample = func(traceID uint64) bool { return false }
+	options.TrimUnsampledSpans = true
+	options.Recorder = NewNoopRecorder()
+	return thrift_rpc.NewReferenceTracer(basictracer.NewWithOptions(options))
+}
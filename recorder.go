@@ -1,8 +1,10 @@
 package lightstep
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"os"
 	"path"
 	"reflect"
@@ -20,13 +22,17 @@ import (
 
 	google_protobuf "github.com/golang/protobuf/ptypes/timestamp"
 	cpb "github.com/lightstep/lightstep-tracer-go/collectorpb"
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
 	"github.com/lightstep/lightstep-tracer-go/thrift_rpc"
 	"github.com/opentracing/basictracer-go"
 	ot "github.com/opentracing/opentracing-go"
 )
 
+var errEmptyAccessToken = errors.New("LightStep Recorder options.AccessToken must not be empty")
+
 const (
 	spansDropped     = "spans.dropped"
+	tagsDropped      = "tags.dropped"
 	logEncoderErrors = "log_encoder.errors"
 	collectorPath    = "/_rpc/v1/reports/binary"
 
@@ -98,6 +104,15 @@ type Options struct {
 	// for the collector.
 	Collector Endpoint `yaml:"collector"`
 
+	// CollectorSRV, if set, is the name of a DNS SRV record listing the
+	// collectors to report to, overriding Collector's host and port. Only
+	// supported by the thrift Recorder.
+	CollectorSRV string `yaml:"collector_srv"`
+
+	// ThriftProtocol is the encoding of reports sent by the thrift Recorder,
+	// "binary" (the default) or "compact".
+	ThriftProtocol string `yaml:"thrift_protocol"`
+
 	// Tags are arbitrary key-value pairs that apply to all spans generated by
 	// this Tracer.
 	Tags ot.Tags
@@ -110,6 +125,41 @@ type Options struct {
 	// before sending them to a collector.
 	MaxBufferedSpans int `yaml:"max_buffered_spans"`
 
+	// MaxBufferedBytes, if positive, also bounds the buffer by the
+	// approximate serialized size of its spans. Only supported by the
+	// thrift Recorder.
+	MaxBufferedBytes int `yaml:"max_buffered_bytes"`
+
+	// OverflowPolicy is "drop_newest" (the default) to discard spans
+	// recorded into a full buffer, or "drop_oldest" to evict the oldest
+	// buffered spans instead. Only supported by the thrift Recorder.
+	OverflowPolicy string `yaml:"overflow_policy"`
+
+	// DrainOnDisable makes Disable, including a Disable command from the
+	// collector, first flush the spans already buffered. Only supported by
+	// the thrift Recorder.
+	DrainOnDisable bool `yaml:"drain_on_disable"`
+
+	// CollectorPath, if set, replaces the path of the collector endpoint,
+	// e.g. for a reverse proxy that mounts the collector under a prefix.
+	// It must begin with "/". Only supported by the thrift Recorder.
+	CollectorPath string `yaml:"collector_path"`
+
+	// MaxSpansPerSecond, if positive, caps the rate at which spans are
+	// reported, dropping the excess. Only supported by the thrift Recorder.
+	MaxSpansPerSecond float64 `yaml:"max_spans_per_second"`
+
+	// FlushThresholdRatio is how full the buffer may get, as a fraction of
+	// MaxBufferedSpans (and of MaxBufferedBytes, if set) in (0, 1], before
+	// a report is sent early. If zero, 0.5 is used. Only supported by the
+	// thrift Recorder.
+	FlushThresholdRatio float64 `yaml:"flush_threshold_ratio"`
+
+	// MaxSpansPerReport, if positive, caps the number of spans in each
+	// report request, sending a large buffer as several requests. Only
+	// supported by the thrift Recorder.
+	MaxSpansPerReport int `yaml:"max_spans_per_report"`
+
 	// MaxLogKeyLen is the maximum allowable size (in characters) of an
 	// OpenTracing logging key. Longer keys are truncated.
 	MaxLogKeyLen int `yaml:"max_log_key_len"`
@@ -122,6 +172,15 @@ type Options struct {
 	// MaxLogsPerSpan limits the number of logs in a single span.
 	MaxLogsPerSpan int `yaml:"max_logs_per_span"`
 
+	// TruncationMarker ends log keys and values truncated to MaxLogKeyLen
+	// or MaxLogValueLen, counting towards the limit. If empty, an ellipsis
+	// ("…") is used.
+	TruncationMarker string `yaml:"truncation_marker"`
+
+	// OmitTruncationMarker truncates log keys and values without a
+	// TruncationMarker.
+	OmitTruncationMarker bool `yaml:"omit_truncation_marker"`
+
 	// ReportingPeriod is the maximum duration of time between sending spans
 	// to a collector.  If zero, the default will be used.
 	ReportingPeriod time.Duration `yaml:"reporting_period"`
@@ -137,7 +196,209 @@ type Options struct {
 	// Note: flag is in use--do not change.
 	UseGRPC bool `yaml:"usegrpc"`
 
+	// DisableIfNoToken makes NewTracer and NewTracerE return an inert
+	// Tracer (see NewNoopTracer) rather than an error when AccessToken is
+	// empty, for services that only trace in some environments.
+	DisableIfNoToken bool `yaml:"disable_if_no_token"`
+
 	ReconnectPeriod time.Duration `yaml:"reconnect_period"`
+
+	// AttributeAllowlist, when non-nil, restricts the span tags that are
+	// reported to those whose keys appear in the list. All other tags are
+	// dropped and counted. Join tags and the parent span GUID are always
+	// reported.
+	AttributeAllowlist []string `yaml:"attribute_allowlist"`
+
+	// CoalesceSpans merges consecutive identical spans recorded within a
+	// report window into a single span carrying a coalesced count tag.
+	// Spans are identical when they share an operation name and the values
+	// of every tag listed in CoalesceKeyTags. Only supported by the thrift
+	// Recorder; NewTracerE returns an error if either is set with UseGRPC.
+	CoalesceSpans   bool     `yaml:"coalesce_spans"`
+	CoalesceKeyTags []string `yaml:"coalesce_key_tags"`
+
+	// IDFormatter formats span and trace IDs for the SpanGuid, TraceGuid,
+	// and parent span GUID fields of reported spans. If nil, IDs are
+	// formatted in hexadecimal. Only supported by the thrift Recorder, as
+	// gRPC reports carry IDs as integers; NewTracerE returns an error if it
+	// is set with UseGRPC.
+	IDFormatter func(id uint64) string
+
+	// ReportPayloadQuotaBytes caps the total bytes of log payload JSON
+	// included in a single report. Once the quota is spent, the remaining
+	// payloads of the report are replaced by a placeholder and counted as
+	// dropped. If zero, payloads are not limited. Only supported by the
+	// thrift Recorder.
+	ReportPayloadQuotaBytes int `yaml:"report_payload_quota_bytes"`
+
+	// BasicAuthUsername and BasicAuthPassword, if set, are sent as HTTP
+	// basic auth credentials on every report, for collectors behind a
+	// proxy requiring them. They are independent of the AccessToken. Only
+	// supported by the thrift Recorder; NewTracerE returns an error if
+	// either is set with UseGRPC.
+	BasicAuthUsername string `yaml:"basic_auth_username"`
+	BasicAuthPassword string `yaml:"basic_auth_password"`
+
+	// CustomHeaders are set on every report request, e.g. routing or auth
+	// headers required by a gateway. Only supported by the thrift Recorder.
+	CustomHeaders map[string]string `yaml:"custom_headers"`
+
+	// DialContext, if set, opens the network connections to the collector,
+	// e.g. to bind a source address or dial through a proxy. If nil, the
+	// default dialer is used.
+	DialContext DialContextFunc
+
+	// HTTPClient, if set, sends reports in place of the default client,
+	// e.g. to route through a proxy or use a custom TLS configuration.
+	// Only supported by the thrift Recorder.
+	HTTPClient *http.Client
+
+	// Backend, if set, receives every report in place of the collector,
+	// e.g. a thrift_rpc.RecordingBackend in tests. Only supported by the
+	// thrift Recorder.
+	Backend lightstep_thrift.ReportingService
+
+	// OnDroppedSpans, if set, is called with the number of spans discarded
+	// because the buffer was full since its previous call, on a separate
+	// goroutine. Only supported by the thrift Recorder.
+	OnDroppedSpans func(count int)
+
+	// Clock, if set, is used in place of time.Now() to timestamp the start
+	// and finish of spans, e.g. for deterministic tests or a hybrid logical
+	// clock.
+	Clock func() time.Time
+
+	// GUIDGenerator, if set, generates the Recorder's runtime GUID (unless
+	// Tags sets GUIDKey) and the trace and span IDs of spans the Recorder
+	// creates itself, such as those of RecordEvent. IDs of traced spans are
+	// still generated by basictracer. It must be safe for concurrent use. If
+	// nil, a seeded pseudo-random generator is used.
+	GUIDGenerator func() uint64
+
+	// StreamSpans, intended for debugging, reports each span as soon as it
+	// is recorded rather than waiting for the buffer thresholds and reporting
+	// period. Spans recorded within StreamInterval of the previous report
+	// are sent together in the next one. Only supported by the thrift
+	// Recorder; NewTracerE returns an error if it is set with UseGRPC.
+	StreamSpans bool `yaml:"stream_spans"`
+
+	// StreamInterval is the minimum time between reports when StreamSpans is
+	// set. If zero, a default of 10ms is used. Only supported by the thrift
+	// Recorder.
+	StreamInterval time.Duration `yaml:"stream_interval"`
+
+	// Synchronous reports spans from the goroutine recording them, in
+	// batches of SynchronousBatchSize (1 if zero), instead of from a
+	// background loop; closing the Tracer reports the rest. It suits
+	// short-lived processes with low span rates. Only supported by the
+	// thrift Recorder.
+	Synchronous          bool `yaml:"synchronous"`
+	SynchronousBatchSize int  `yaml:"synchronous_batch_size"`
+
+	// RecordQueueSize, if positive, makes recording a span hand it to a
+	// background goroutine through a queue of that many spans, so that
+	// goroutines finishing spans do not contend for the lock held while
+	// reports are built. Only supported by the thrift Recorder.
+	RecordQueueSize int `yaml:"record_queue_size"`
+
+	// ReconnectAfterFailures is how many reports in a row may fail before
+	// the transport is rebuilt; if zero, a default of 3 is used. Only
+	// supported by the thrift Recorder; the gRPC Recorder reconnects every
+	// ReconnectPeriod instead.
+	ReconnectAfterFailures int `yaml:"reconnect_after_failures"`
+
+	// Context, if set, ties the Tracer's lifetime to it: once it is done,
+	// the Recorder sends a final report and stops reporting, as if the
+	// Tracer had been closed. Only supported by the thrift Recorder.
+	Context context.Context
+
+	// TrackActiveSpans counts spans that have been started but not yet
+	// finished. A steadily growing count indicates spans that are never
+	// finished. Only supported by the thrift Recorder.
+	TrackActiveSpans bool `yaml:"track_active_spans"`
+
+	// OperationNamePrefix is prepended to the operation name of every
+	// reported span, e.g. "checkout." to namespace a service's spans.
+	OperationNamePrefix string `yaml:"operation_name_prefix"`
+
+	// TraceSamplingRate is the fraction of traces to report, in (0, 1). The
+	// decision is made per trace ID, so either all of a trace's spans are
+	// reported or none are. If zero, every trace is reported.
+	TraceSamplingRate float64 `yaml:"trace_sampling_rate"`
+
+	// PerOperationSampleRates overrides TraceSamplingRate for spans whose
+	// operation name matches a glob pattern, e.g. {"health_check*": 0.01}.
+	// Only supported by the thrift Recorder.
+	PerOperationSampleRates map[string]float64 `yaml:"per_operation_sample_rates"`
+
+	// SpanDropTags drops spans carrying any of the listed tags with the
+	// listed value, e.g. {"health_check": "true"}. Only supported by the
+	// thrift Recorder.
+	SpanDropTags map[string]string `yaml:"span_drop_tags"`
+
+	// SuppressEmptyReports skips reports with no spans and no non-zero
+	// internal counters. Only supported by the thrift Recorder.
+	SuppressEmptyReports bool `yaml:"suppress_empty_reports"`
+
+	// OnCommand, if set, is called with every command returned by the
+	// collector in a report response; see thrift_rpc.Options.OnCommand.
+	// Only supported by the thrift Recorder.
+	OnCommand func(cmd *lightstep_thrift.Command)
+
+	// DegradationLadder sheds detail from spans recorded while the buffer
+	// is filling up, and LowValueTags lists the tag keys shed by a
+	// thrift_rpc.DetailTags step. Only supported by the thrift Recorder.
+	DegradationLadder []thrift_rpc.DegradationStep
+	LowValueTags      []string `yaml:"low_value_tags"`
+
+	// GroupSpansByTrace orders the spans in each report so that spans of
+	// the same trace are adjacent. Only supported by the thrift Recorder.
+	GroupSpansByTrace bool `yaml:"group_spans_by_trace"`
+
+	// ReportCPUChanges reports the process's GOMAXPROCS and cgroup CPU
+	// quota as runtime attributes, refreshed on every report. Only
+	// supported by the thrift Recorder.
+	ReportCPUChanges bool `yaml:"report_cpu_changes"`
+
+	// MaxSpanDelay, if set, bounds how long a recorded span may wait to be
+	// reported. Only supported by the thrift Recorder.
+	MaxSpanDelay time.Duration `yaml:"max_span_delay"`
+
+	// CounterMode is "delta" (the default) to report internal counters as
+	// counts since the previous report, or "cumulative" to report running
+	// totals. Only supported by the thrift Recorder.
+	CounterMode string `yaml:"counter_mode"`
+
+	// Compression is "none" (the default) or "gzip" to compress report
+	// requests. Only supported by the thrift Recorder.
+	Compression string `yaml:"compression"`
+
+	// ReportStartupSpan records a single "tracer.started" span when the
+	// tracer is constructed, tagged with its effective configuration. Only
+	// supported by the thrift Recorder.
+	ReportStartupSpan bool `yaml:"report_startup_span"`
+}
+
+// validateGRPC returns an error if opts sets an option that only the thrift
+// Recorder supports and the gRPC Recorder would otherwise ignore.
+func (opts *Options) validateGRPC() error {
+	if opts.CoalesceSpans || len(opts.CoalesceKeyTags) > 0 {
+		return errThriftOnly("CoalesceSpans")
+	}
+	if opts.IDFormatter != nil {
+		return errThriftOnly("IDFormatter")
+	}
+	if opts.BasicAuthUsername != "" || opts.BasicAuthPassword != "" {
+		return errThriftOnly("BasicAuthUsername")
+	}
+	if opts.StreamSpans || opts.StreamInterval != 0 {
+		return errThriftOnly("StreamSpans")
+	}
+	return nil
+}
+
+func errThriftOnly(option string) error {
+	return fmt.Errorf("LightStep Recorder options.%s is only supported by the thrift Recorder", option)
 }
 
 func (opts *Options) setDefaults() {
@@ -166,15 +427,31 @@ func (opts *Options) setDefaults() {
 }
 
 // NewTracer returns a new Tracer that reports spans to a LightStep
-// collector.
+// collector. If the Tracer cannot be constructed, e.g. because
+// opts.AccessToken is empty, NewTracer prints the error and returns a no-op
+// Tracer; use NewTracerE to handle the error explicitly.
 func NewTracer(opts Options) ot.Tracer {
+	tracer, err := NewTracerE(opts)
+	if err != nil {
+		fmt.Println(err)
+		return ot.NoopTracer{}
+	}
+	return tracer
+}
+
+// NewTracerE is like NewTracer, but returns an error if the Tracer cannot be
+// constructed.
+func NewTracerE(opts Options) (ot.Tracer, error) {
+	if opts.AccessToken == "" && opts.DisableIfNoToken {
+		return NewNoopTracer(), nil
+	}
 	options := basictracer.DefaultOptions()
-	options.ShouldSample = func(_ uint64) bool { return true }
+	options.ShouldSample = thrift_rpc.TraceSampler(opts.TraceSamplingRate)
 
 	if opts.UseGRPC {
-		r := NewRecorder(opts)
-		if r == nil {
-			return ot.NoopTracer{}
+		r, err := NewRecorderE(opts)
+		if err != nil {
+			return nil, err
 		}
 		options.Recorder = r
 	} else {
@@ -192,16 +469,72 @@ func NewTracer(opts Options) ot.Tracer {
 			MaxLogsPerSpan:   opts.MaxLogsPerSpan,
 			Verbose:          opts.Verbose,
 			MaxLogMessageLen: opts.MaxLogValueLen,
+
+			AttributeAllowlist: opts.AttributeAllowlist,
+			CoalesceSpans:      opts.CoalesceSpans,
+			CoalesceKeyTags:    opts.CoalesceKeyTags,
+			IDFormatter:        opts.IDFormatter,
+			GUIDGenerator:      opts.GUIDGenerator,
+
+			ReportPayloadQuotaBytes: opts.ReportPayloadQuotaBytes,
+			BasicAuthUsername:       opts.BasicAuthUsername,
+			BasicAuthPassword:       opts.BasicAuthPassword,
+			CustomHeaders:           opts.CustomHeaders,
+			DialContext:             opts.DialContext,
+			HTTPClient:              opts.HTTPClient,
+			Backend:                 opts.Backend,
+			OnDroppedSpans:          opts.OnDroppedSpans,
+			StreamSpans:             opts.StreamSpans,
+			StreamInterval:          opts.StreamInterval,
+			Synchronous:             opts.Synchronous,
+			SynchronousBatchSize:    opts.SynchronousBatchSize,
+			Context:                 opts.Context,
+			RecordQueueSize:         opts.RecordQueueSize,
+			MaxBufferedBytes:        opts.MaxBufferedBytes,
+			ReconnectAfterFailures:  opts.ReconnectAfterFailures,
+			OperationNamePrefix:     opts.OperationNamePrefix,
+			ReportStartupSpan:       opts.ReportStartupSpan,
+			TruncationMarker:        opts.TruncationMarker,
+			OmitTruncationMarker:    opts.OmitTruncationMarker,
+			TraceSamplingRate:       opts.TraceSamplingRate,
+			SpanDropTags:            opts.SpanDropTags,
+			SuppressEmptyReports:    opts.SuppressEmptyReports,
+			OnCommand:               opts.OnCommand,
+			DegradationLadder:       opts.DegradationLadder,
+			LowValueTags:            opts.LowValueTags,
+			GroupSpansByTrace:       opts.GroupSpansByTrace,
+			ReportCPUChanges:        opts.ReportCPUChanges,
+			MaxSpanDelay:            opts.MaxSpanDelay,
+			CollectorSRV:            opts.CollectorSRV,
+			CollectorPath:           opts.CollectorPath,
+			DrainOnDisable:          opts.DrainOnDisable,
+			ThriftProtocol:          thrift_rpc.ThriftProtocol(opts.ThriftProtocol),
+			CounterMode:             thrift_rpc.CounterMode(opts.CounterMode),
+			Compression:             thrift_rpc.Compression(opts.Compression),
+			OverflowPolicy:          thrift_rpc.OverflowPolicy(opts.OverflowPolicy),
+
+			PerOperationSampleRates: opts.PerOperationSampleRates,
+			MaxSpansPerSecond:       opts.MaxSpansPerSecond,
+			FlushThresholdRatio:     opts.FlushThresholdRatio,
+			MaxSpansPerReport:       opts.MaxSpansPerReport,
 		}
-		r := thrift_rpc.NewRecorder(thriftOpts)
-		if r == nil {
-			return ot.NoopTracer{}
+		sr, err := thrift_rpc.NewRecorderE(thriftOpts)
+		if err != nil {
+			return nil, err
 		}
+		r := sr.(*thrift_rpc.Recorder)
 		options.Recorder = r
+		if opts.TrackActiveSpans {
+			options.NewSpanEventListener = r.NewSpanEventListener
+		}
 	}
 	options.DropAllLogs = opts.DropSpanLogs
 	options.MaxLogsPerSpan = opts.MaxLogsPerSpan
-	return basictracer.NewWithOptions(options)
+	tracer := thrift_rpc.NewReferenceTracer(basictracer.NewWithOptions(options))
+	if opts.Clock != nil {
+		tracer = newClockTracer(tracer, opts.Clock)
+	}
+	return tracer, nil
 }
 
 func FlushLightStepTracer(lsTracer ot.Tracer) error {
@@ -216,7 +549,110 @@ func FlushLightStepTracer(lsTracer ot.Tracer) error {
 	case *Recorder:
 		t.Flush()
 	case *thrift_rpc.Recorder:
+		return t.Flush()
+	case *NoopRecorder:
+	default:
+		return fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
+	}
+	return nil
+}
+
+// ForceFlushLightStepTracer flushes lsTracer until every span recorded
+// before the call has been delivered, retrying failed reports until ctx is
+// done; see thrift_rpc.Recorder.ForceFlush. Only supported by the thrift
+// Recorder.
+func ForceFlushLightStepTracer(ctx context.Context, lsTracer ot.Tracer) error {
+	rec, err := GetLightStepRecorder(lsTracer)
+	if err != nil {
+		return err
+	}
+	switch t := rec.(type) {
+	case *thrift_rpc.Recorder:
+		return t.ForceFlush(ctx)
+	case *NoopRecorder:
+		return nil
+	default:
+		return fmt.Errorf("ForceFlush is not supported by %v", reflect.TypeOf(rec))
+	}
+}
+
+// WaitForFlushLightStepTracer blocks until lsTracer's next flush returns
+// and returns its error; see thrift_rpc.Recorder.WaitForFlush. Only
+// supported by the thrift Recorder.
+func WaitForFlushLightStepTracer(ctx context.Context, lsTracer ot.Tracer) error {
+	rec, err := GetLightStepRecorder(lsTracer)
+	if err != nil {
+		return err
+	}
+	switch t := rec.(type) {
+	case *thrift_rpc.Recorder:
+		return t.WaitForFlush(ctx)
+	default:
+		return fmt.Errorf("WaitForFlush is not supported by %v", reflect.TypeOf(rec))
+	}
+}
+
+// GetLightStepRecorder returns the Recorder of a LightStep Tracer: a
+// *Recorder for a gRPC Tracer, a *thrift_rpc.Recorder for a thrift Tracer,
+// or a *NoopRecorder for an inert one. Callers type-switch on the result to
+// Flush, Close, or inspect it, e.g. to read the thrift Recorder's Stats.
+func GetLightStepRecorder(lsTracer ot.Tracer) (basictracer.SpanRecorder, error) {
+	basicTracer, ok := lsTracer.(basictracer.Tracer)
+	if !ok {
+		return nil, fmt.Errorf("Not a LightStep Tracer type: %v", reflect.TypeOf(lsTracer))
+	}
+
+	basicRecorder := basicTracer.Options().Recorder
+
+	switch basicRecorder.(type) {
+	case *Recorder, *thrift_rpc.Recorder, *NoopRecorder:
+		return basicRecorder, nil
+	default:
+		return nil, fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
+	}
+}
+
+// CloseLightStepTracer flushes any spans buffered by a LightStep Tracer and
+// shuts down its Recorder, closing the connection to the collector. Spans
+// finished afterwards are not reported.
+func CloseLightStepTracer(lsTracer ot.Tracer) error {
+	basicTracer, ok := lsTracer.(basictracer.Tracer)
+	if !ok {
+		return fmt.Errorf("Not a LightStep Tracer type: %v", reflect.TypeOf(lsTracer))
+	}
+
+	basicRecorder := basicTracer.Options().Recorder
+
+	switch t := basicRecorder.(type) {
+	case *Recorder:
 		t.Flush()
+		return t.Close()
+	case *thrift_rpc.Recorder:
+		return t.Close()
+	case *NoopRecorder:
+		return nil
+	default:
+		return fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
+	}
+}
+
+// RecordEvent records a discrete event that is not tied to a span, such as a
+// deploy marker, on a LightStep Tracer. The event is reported with the next
+// batch as a zero-duration span.
+func RecordEvent(lsTracer ot.Tracer, name string, tags map[string]interface{}) error {
+	basicTracer, ok := lsTracer.(basictracer.Tracer)
+	if !ok {
+		return fmt.Errorf("Not a LightStep Tracer type: %v", reflect.TypeOf(lsTracer))
+	}
+
+	basicRecorder := basicTracer.Options().Recorder
+
+	switch t := basicRecorder.(type) {
+	case *Recorder:
+		t.RecordEvent(name, tags)
+	case *thrift_rpc.Recorder:
+		t.RecordEvent(name, tags)
+	case *NoopRecorder:
 	default:
 		return fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
 	}
@@ -236,6 +672,8 @@ func GetLightStepAccessToken(lsTracer ot.Tracer) (string, error) {
 		return t.accessToken, nil
 	case *thrift_rpc.Recorder:
 		return t.AccessToken, nil
+	case *NoopRecorder:
+		return "", nil
 	default:
 		return "", fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
 	}
@@ -269,12 +707,20 @@ type Recorder struct {
 	accessToken string
 
 	reporterID         uint64        // the LightStep tracer guid
+	genGUID            func() uint64 // see Options.GUIDGenerator
 	verbose            bool          // whether to print verbose messages
 	maxLogKeyLen       int           // see Options.MaxLogKeyLen
 	maxLogValueLen     int           // see Options.MaxLogValueLen
-	maxReportingPeriod time.Duration // set by Options.MaxReportingPeriod
+	truncationMarker   string        // see Options.TruncationMarker
+	omitTruncation     bool          // see Options.OmitTruncationMarker
+	dropUnsampled      bool          // set when Options.TraceSamplingRate is positive
+	maxReportingPeriod time.Duration // set by Options.ReportingPeriod
 	reconnectPeriod    time.Duration // set by Options.ReconnectPeriod
 	reportingTimeout   time.Duration // set by Options.ReportTimeout
+	operationPrefix    string        // see Options.OperationNamePrefix
+
+	// attributeAllowlist is nil unless Options.AttributeAllowlist was set.
+	attributeAllowlist map[string]struct{}
 
 	// Remote service that will receive reports.
 	hostPort      string
@@ -282,6 +728,7 @@ type Recorder struct {
 	conn          *grpc.ClientConn
 	connTimestamp time.Time
 	creds         grpc.DialOption
+	dialer        grpc.DialOption
 	closech       chan struct{}
 
 	//////////////////////////////////////////////////////////
@@ -295,6 +742,8 @@ type Recorder struct {
 	// Flush state.
 	reportInFlight    bool
 	lastReportAttempt time.Time
+	lastReportError   error     // see LastReportError
+	lastReportDone    time.Time // when the report resulting in lastReportError completed
 
 	// We allow our remote peer to disable this instrumentation at any
 	// time, turning all potentially costly runtime operations into
@@ -305,11 +754,28 @@ type Recorder struct {
 	disabled bool
 }
 
+// NewRecorder returns a gRPC Recorder reporting to the collector described
+// by opts. It prints any error constructing the Recorder and returns nil;
+// use NewRecorderE to handle those errors explicitly.
 func NewRecorder(opts Options) *Recorder {
+	rec, err := NewRecorderE(opts)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return rec
+}
+
+// NewRecorderE is like NewRecorder, but returns an error rather than
+// printing it if opts.AccessToken is empty or the collector cannot be
+// dialed.
+func NewRecorderE(opts Options) (*Recorder, error) {
 	opts.setDefaults()
 	if len(opts.AccessToken) == 0 {
-		fmt.Println("LightStep Recorder options.AccessToken must not be empty")
-		return nil
+		return nil, errEmptyAccessToken
+	}
+	if err := opts.validateGRPC(); err != nil {
+		return nil, err
 	}
 	if opts.Tags == nil {
 		opts.Tags = make(map[string]interface{})
@@ -338,6 +804,10 @@ func NewRecorder(opts Options) *Recorder {
 	attributes[TracerPlatformVersionKey] = runtime.Version()
 	attributes[TracerVersionKey] = TracerVersionValue
 
+	genGUID := opts.GUIDGenerator
+	if genGUID == nil {
+		genGUID = genSeededGUID
+	}
 	now := time.Now()
 	rec := &Recorder{
 		accessToken:        opts.AccessToken,
@@ -348,26 +818,48 @@ func NewRecorder(opts Options) *Recorder {
 		verbose:            opts.Verbose,
 		maxLogKeyLen:       opts.MaxLogKeyLen,
 		maxLogValueLen:     opts.MaxLogValueLen,
+		truncationMarker:   opts.TruncationMarker,
+		omitTruncation:     opts.OmitTruncationMarker,
+		operationPrefix:    opts.OperationNamePrefix,
+		dropUnsampled:      opts.TraceSamplingRate > 0,
 		apiURL:             getAPIURL(opts),
-		reporterID:         genSeededGUID(),
+		reporterID:         genGUID(),
+		genGUID:            genGUID,
 		buffer:             newSpansBuffer(opts.MaxBufferedSpans),
 		flushing:           newSpansBuffer(opts.MaxBufferedSpans),
 		hostPort:           getCollectorHostPort(opts),
 		reconnectPeriod:    time.Duration(float64(opts.ReconnectPeriod) * (1 + 0.2*rand.Float64())),
 	}
 
+	if opts.AttributeAllowlist != nil {
+		rec.attributeAllowlist = make(map[string]struct{}, len(opts.AttributeAllowlist))
+		for _, key := range opts.AttributeAllowlist {
+			rec.attributeAllowlist[key] = struct{}{}
+		}
+	}
+
 	rec.buffer.setCurrent(now)
+	if opts.ReportingPeriod != 0 {
+		rec.maxReportingPeriod = opts.ReportingPeriod
+		if opts.ReportingPeriod < minReportingPeriod {
+			rec.maybeLogError(fmt.Errorf("ReportingPeriod %v is below the minimum of %v; using the minimum",
+				opts.ReportingPeriod, minReportingPeriod))
+			rec.maxReportingPeriod = minReportingPeriod
+		}
+	}
 
 	if opts.Collector.Plaintext {
 		rec.creds = grpc.WithInsecure()
 	} else {
 		rec.creds = grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
 	}
+	if opts.DialContext != nil {
+		rec.dialer = opts.DialContext.grpcDialer()
+	}
 
 	conn, backend, err := rec.connectClient()
 	if err != nil {
-		fmt.Println("grpc.Dial failed permanently:", err)
-		return nil
+		return nil, fmt.Errorf("grpc.Dial failed permanently: %v", err)
 	}
 
 	rec.conn = conn
@@ -377,11 +869,15 @@ func NewRecorder(opts Options) *Recorder {
 
 	go rec.reportLoop(rec.closech)
 
-	return rec
+	return rec, nil
 }
 
 func (r *Recorder) connectClient() (*grpc.ClientConn, cpb.CollectorServiceClient, error) {
-	conn, err := grpc.Dial(r.hostPort, r.creds)
+	dialOpts := []grpc.DialOption{r.creds}
+	if r.dialer != nil {
+		dialOpts = append(dialOpts, r.dialer)
+	}
+	conn, err := grpc.Dial(r.hostPort, dialOpts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -433,10 +929,39 @@ func (r *Recorder) RecordSpan(raw basictracer.RawSpan) {
 	if r.disabled {
 		return
 	}
+	priority, hasPriority := thrift_rpc.SamplingPriority(&raw)
+	switch {
+	case thrift_rpc.IsForceRecorded(&raw):
+	case hasPriority && priority == 0:
+		return
+	case !hasPriority && r.dropUnsampled && !raw.Context.Sampled:
+		return
+	}
 
 	r.buffer.addSpan(raw)
 }
 
+// RecordEvent records a discrete event that is not tied to a span, such as a
+// deploy marker. The event is reported with the next batch as a zero-duration
+// span named `name` carrying `tags`.
+func (r *Recorder) RecordEvent(name string, tags map[string]interface{}) {
+	eventTags := make(ot.Tags, len(tags)+1)
+	for k, v := range tags {
+		eventTags[k] = v
+	}
+	eventTags[thrift_rpc.EventKey] = true
+	r.RecordSpan(basictracer.RawSpan{
+		Context: basictracer.SpanContext{
+			TraceID: r.genGUID(),
+			SpanID:  r.genGUID(),
+			Sampled: true,
+		},
+		Operation: name,
+		Start:     time.Now(),
+		Tags:      eventTags,
+	})
+}
+
 func translateSpanContext(sc basictracer.SpanContext) *cpb.SpanContext {
 	return &cpb.SpanContext{
 		TraceId: sc.TraceID,
@@ -445,13 +970,17 @@ func translateSpanContext(sc basictracer.SpanContext) *cpb.SpanContext {
 	}
 }
 
-func translateParentSpanID(pid uint64) []*cpb.Reference {
+func translateParentSpanID(pid uint64, tags ot.Tags) []*cpb.Reference {
 	if pid == 0 {
 		return nil
 	}
+	relationship := cpb.Reference_CHILD_OF
+	if tags[thrift_rpc.ReferenceTypeKey] == thrift_rpc.FollowsFromReferenceType {
+		relationship = cpb.Reference_FOLLOWS_FROM
+	}
 	return []*cpb.Reference{
 		&cpb.Reference{
-			Relationship: cpb.Reference_CHILD_OF,
+			Relationship: relationship,
 			SpanContext:  &cpb.SpanContext{SpanId: pid},
 		},
 	}
@@ -472,15 +1001,34 @@ func translateDurationFromOldestYoungest(ot time.Time, yt time.Time) uint64 {
 	return translateDuration(yt.Sub(ot))
 }
 
-func (r *Recorder) translateTags(tags ot.Tags) []*cpb.KeyValue {
+func (r *Recorder) translateTags(tags ot.Tags, buffer *reportBuffer) []*cpb.KeyValue {
 	kvs := make([]*cpb.KeyValue, 0, len(tags))
 	for key, tag := range tags {
+		if key == thrift_rpc.ReferenceTypeKey {
+			// Reported as the relationship of the span's reference; see
+			// translateParentSpanID.
+			continue
+		}
+		if !r.isAttributeAllowed(key) {
+			buffer.droppedTagCount++
+			continue
+		}
 		kv := r.convertToKeyValue(key, tag)
 		kvs = append(kvs, kv)
 	}
 	return kvs
 }
 
+// isAttributeAllowed reports whether a span tag with the given key may be
+// reported under the configured AttributeAllowlist.
+func (r *Recorder) isAttributeAllowed(key string) bool {
+	if r.attributeAllowlist == nil {
+		return true
+	}
+	_, ok := r.attributeAllowlist[key]
+	return ok
+}
+
 func (r *Recorder) convertToKeyValue(key string, value interface{}) *cpb.KeyValue {
 	kv := cpb.KeyValue{Key: key}
 	v := reflect.ValueOf(value)
@@ -515,11 +1063,11 @@ func (r *Recorder) translateLogs(lrs []ot.LogRecord, buffer *reportBuffer) []*cp
 func (r *Recorder) translateRawSpan(rs basictracer.RawSpan, buffer *reportBuffer) *cpb.Span {
 	s := &cpb.Span{
 		SpanContext:    translateSpanContext(rs.Context),
-		OperationName:  rs.Operation,
-		References:     translateParentSpanID(rs.ParentSpanID),
+		OperationName:  r.operationPrefix + rs.Operation,
+		References:     translateParentSpanID(rs.ParentSpanID, rs.Tags),
 		StartTimestamp: translateTime(rs.Start),
 		DurationMicros: translateDuration(rs.Duration),
-		Tags:           r.translateTags(rs.Tags),
+		Tags:           r.translateTags(rs.Tags, buffer),
 		Logs:           r.translateLogs(rs.Logs, buffer),
 	}
 	return s
@@ -555,6 +1103,10 @@ func (b *reportBuffer) generateMetricsSample() []*cpb.MetricsSample {
 			Name:  spansDropped,
 			Value: &cpb.MetricsSample_IntValue{b.droppedSpanCount},
 		},
+		&cpb.MetricsSample{
+			Name:  tagsDropped,
+			Value: &cpb.MetricsSample_IntValue{b.droppedTagCount},
+		},
 		&cpb.MetricsSample{
 			Name:  logEncoderErrors,
 			Value: &cpb.MetricsSample_IntValue{b.logEncoderErrorCount},
@@ -618,6 +1170,7 @@ func (r *Recorder) Flush() {
 	defer cancel()
 	resp, err := r.backend.Report(ctx, r.makeReportRequest(&r.flushing))
 
+	reportErr := err
 	if err != nil {
 		r.maybeLogError(err)
 	} else if len(resp.Errors) > 0 {
@@ -626,6 +1179,7 @@ func (r *Recorder) Flush() {
 		for _, err := range resp.Errors {
 			r.maybeLogError(fmt.Errorf("Remote report returned error: %s", err))
 		}
+		reportErr = fmt.Errorf("Remote report returned errors: %s", strings.Join(resp.Errors, "; "))
 	} else {
 		r.maybeLogInfof("Report: resp=%v, err=%v", resp, err)
 	}
@@ -633,6 +1187,8 @@ func (r *Recorder) Flush() {
 	var droppedSent int64
 	r.lock.Lock()
 	r.reportInFlight = false
+	r.lastReportError = reportErr
+	r.lastReportDone = time.Now()
 	if err != nil {
 		// Restore the records that did not get sent correctly
 		r.buffer.mergeFrom(&r.flushing)
@@ -656,6 +1212,14 @@ func (r *Recorder) Flush() {
 	}
 }
 
+// LastReportError returns when the most recent report completed, and its
+// error, or nil if it succeeded. The time is zero before the first report.
+func (r *Recorder) LastReportError() (time.Time, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastReportDone, r.lastReportError
+}
+
 func (r *Recorder) Disable() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -670,6 +1234,22 @@ func (r *Recorder) Disable() {
 	r.disabled = true
 }
 
+// Enable resumes recording and reporting after Disable. It has no effect
+// on a closed Recorder.
+func (r *Recorder) Enable() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.disabled || r.closech == nil {
+		return
+	}
+
+	r.maybeLogInfof("re-enabling Runtime instance: %p", r)
+
+	r.buffer.setCurrent(time.Now())
+	r.disabled = false
+}
+
 // Every minReportingPeriod the reporting loop wakes up and checks to see if
 // either (a) the Runtime's max reporting period is about to expire (see
 // maxReportingPeriod()), (b) the number of buffered log records is
@@ -709,8 +1289,10 @@ func (r *Recorder) reportLoop(closech chan struct{}) {
 			shouldFlush := r.shouldFlushLocked(now)
 			r.lock.Unlock()
 
+			// Stay alive while disabled, so that reporting resumes if
+			// the Recorder is re-enabled.
 			if disabled {
-				return
+				continue
 			}
 			if shouldFlush {
 				r.Flush()
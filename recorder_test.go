@@ -3,8 +3,11 @@ package lightstep
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +17,8 @@ import (
 	"github.com/opentracing/basictracer-go"
 	ot "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -34,8 +39,8 @@ func makeExpectedLogs() []*cpb.Log {
 				&cpb.KeyValue{Key: "string", Value: &cpb.KeyValue_StringValue{fmt.Sprintf("foo%d", i)}},
 				&cpb.KeyValue{Key: "object", Value: &cpb.KeyValue_JsonValue{string(pl)}},
 				&cpb.KeyValue{
-					Key:   "too_long-----------…",
-					Value: &cpb.KeyValue_StringValue{"---------------------------------------…"},
+					Key:   "too_long---------…",
+					Value: &cpb.KeyValue_StringValue{"-------------------------------------…"},
 				},
 			},
 		}
@@ -67,6 +72,46 @@ func TestTranslateLogs(t *testing.T) {
 	}
 }
 
+func TestTranslateLogsTruncationMarker(t *testing.T) {
+	fakeRecorder := Recorder{
+		maxLogKeyLen:     10,
+		maxLogValueLen:   10,
+		truncationMarker: "[cut]",
+	}
+	otLogs := []ot.LogRecord{{
+		Timestamp: time.Unix(arbitraryTimestampSecs, 0),
+		Fields:    []log.Field{log.String("a rather long key", "a rather long value")},
+	}}
+	kv := fakeRecorder.translateLogs(otLogs, nil)[0].Keyvalues[0]
+	if kv.Key != "a rat[cut]" {
+		t.Errorf("unexpected truncated key %q", kv.Key)
+	}
+	if value := kv.GetStringValue(); value != "a rat[cut]" {
+		t.Errorf("unexpected truncated value %q", value)
+	}
+
+	fakeRecorder.omitTruncation = true
+	kv = fakeRecorder.translateLogs(otLogs, nil)[0].Keyvalues[0]
+	if kv.Key != "a rather l" || kv.GetStringValue() != "a rather l" {
+		t.Errorf("expected truncation without a marker, got %q: %q", kv.Key, kv.GetStringValue())
+	}
+}
+
+func TestTranslateLogsTruncatesOnRuneBoundary(t *testing.T) {
+	fakeRecorder := Recorder{maxLogKeyLen: 10, maxLogValueLen: 8}
+	otLogs := []ot.LogRecord{{
+		Timestamp: time.Unix(arbitraryTimestampSecs, 0),
+		Fields:    []log.Field{log.String("キーの名前", "ab😀😀")},
+	}}
+	kv := fakeRecorder.translateLogs(otLogs, nil)[0].Keyvalues[0]
+	if kv.Key != "キー…" {
+		t.Errorf("unexpected truncated key %q", kv.Key)
+	}
+	if value := kv.GetStringValue(); value != "ab…" {
+		t.Errorf("unexpected truncated value %q", value)
+	}
+}
+
 func TestConvertToKeyValue(t *testing.T) {
 	r := Recorder{}
 	k := "testing"
@@ -100,6 +145,60 @@ func TestConvertToKeyValue(t *testing.T) {
 	r.convertToKeyValue(k, p)
 }
 
+func TestTranslateTagsPreservesTypes(t *testing.T) {
+	r := Recorder{}
+	kvs := r.translateTags(ot.Tags{
+		"http.status_code": 200,
+		"status_string":    "200",
+		"error":            true,
+		"error_string":     "true",
+	}, &reportBuffer{})
+	values := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		values[kv.Key] = kv.Value
+	}
+	expected := map[string]interface{}{
+		"http.status_code": &cpb.KeyValue_IntValue{200},
+		"status_string":    &cpb.KeyValue_StringValue{"200"},
+		"error":            &cpb.KeyValue_BoolValue{true},
+		"error_string":     &cpb.KeyValue_StringValue{"true"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected typed values %v, got %v", expected, values)
+	}
+}
+
+func TestAttributeAllowlist(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:        "0987654321",
+		UseGRPC:            true,
+		AttributeAllowlist: []string{"kept"},
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	defer recorder.Close()
+	tracer.StartSpan("op", ot.Tags{"kept": 1, "dropped": 2}).Finish()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	req := recorder.makeReportRequest(&recorder.buffer)
+	if tags := req.Spans[0].Tags; len(tags) != 1 || tags[0].Key != "kept" {
+		t.Errorf("expected only the allowed tag to be reported, got %v", tags)
+	}
+	for _, m := range req.InternalMetrics.Counts {
+		if m.Name == tagsDropped && m.GetIntValue() != 1 {
+			t.Errorf("expected 1 dropped tag to be counted, got %d", m.GetIntValue())
+		}
+	}
+}
+
+func TestOperationNamePrefix(t *testing.T) {
+	r := Recorder{operationPrefix: "checkout."}
+	span := r.translateRawSpan(basictracer.RawSpan{Operation: "charge"}, &reportBuffer{})
+	if span.OperationName != "checkout.charge" {
+		t.Errorf("expected the prefixed operation name, got %q", span.OperationName)
+	}
+}
+
 func TestMaxBufferSize(t *testing.T) {
 	recorder := NewTracer(Options{
 		AccessToken: "0987654321",
@@ -164,3 +263,495 @@ func TestDoubleClose(t *testing.T) {
 	rec.Close()
 	rec.Close()
 }
+
+func TestClock(t *testing.T) {
+	start := time.Unix(arbitraryTimestampSecs, 0)
+	now := start
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+		Clock: func() time.Time {
+			t := now
+			now = now.Add(time.Second)
+			return t
+		},
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+
+	parent := tracer.StartSpan("parent")
+	child := parent.Tracer().StartSpan("child", ot.ChildOf(parent.Context()))
+	child.SetTag("k", "v").Finish()
+	parent.Finish()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	spans := recorder.buffer.rawSpans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if c := spans[0]; !c.Start.Equal(start.Add(time.Second)) || c.Duration != time.Second {
+		t.Errorf("unexpected child timing: start %v, duration %v", c.Start, c.Duration)
+	}
+	if p := spans[1]; !p.Start.Equal(start) || p.Duration != 3*time.Second {
+		t.Errorf("unexpected parent timing: start %v, duration %v", p.Start, p.Duration)
+	}
+}
+
+func TestFollowsFromReferences(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	defer recorder.Close()
+
+	parent := tracer.StartSpan("parent")
+	tracer.StartSpan("child", ot.ChildOf(parent.Context())).Finish()
+	tracer.StartSpan("async", ot.FollowsFrom(parent.Context())).Finish()
+	parent.Finish()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	spans := recorder.convertRawSpans(&recorder.buffer)
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	expected := map[string]cpb.Reference_Relationship{
+		"child": cpb.Reference_CHILD_OF,
+		"async": cpb.Reference_FOLLOWS_FROM,
+	}
+	for _, span := range spans {
+		if span.OperationName == "parent" {
+			continue
+		}
+		if len(span.References) != 1 || span.References[0].Relationship != expected[span.OperationName] {
+			t.Errorf("%s: expected one %v reference, got %v", span.OperationName, expected[span.OperationName], span.References)
+		}
+		for _, kv := range span.Tags {
+			if kv.Key == thrift_rpc.ReferenceTypeKey {
+				t.Errorf("%s: expected the reference type to be reported only as a relationship, got %v", span.OperationName, kv)
+			}
+		}
+	}
+}
+
+func TestEnable(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+
+	recorder.Disable()
+	tracer.StartSpan("dropped").Finish()
+	recorder.Enable()
+	tracer.StartSpan("kept").Finish()
+
+	recorder.lock.Lock()
+	spans := recorder.buffer.rawSpans
+	if len(spans) != 1 || spans[0].Operation != "kept" {
+		t.Errorf("expected only the span recorded after Enable, got %v", spans)
+	}
+	recorder.lock.Unlock()
+
+	recorder.Close()
+	recorder.Disable()
+	recorder.Enable()
+	recorder.lock.Lock()
+	disabled := recorder.disabled
+	recorder.lock.Unlock()
+	if !disabled {
+		t.Error("expected Enable to have no effect after Close")
+	}
+}
+
+// fakeCollector is a gRPC collector that records every ReportRequest.
+type fakeCollector struct {
+	lock     sync.Mutex
+	requests []*cpb.ReportRequest
+}
+
+func (c *fakeCollector) Report(ctx context.Context, req *cpb.ReportRequest) (*cpb.ReportResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, req)
+	return &cpb.ReportResponse{}, nil
+}
+
+func TestGRPCReport(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &fakeCollector{}
+	server := grpc.NewServer()
+	cpb.RegisterCollectorServiceServer(server, collector)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+		Collector: Endpoint{
+			Host:      "127.0.0.1",
+			Port:      lis.Addr().(*net.TCPAddr).Port,
+			Plaintext: true,
+		},
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	defer recorder.Close()
+	tracer.StartSpan("op").Finish()
+	recorder.Flush()
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if len(collector.requests) != 1 {
+		t.Fatalf("expected one report, got %d", len(collector.requests))
+	}
+	spans := collector.requests[0].Spans
+	if len(spans) != 1 || spans[0].OperationName != "op" {
+		t.Errorf("expected the span to be reported over gRPC, got %v", spans)
+	}
+	if token := collector.requests[0].Auth.GetAccessToken(); token != "0987654321" {
+		t.Errorf("expected the access token in the report, got %q", token)
+	}
+	if at, err := recorder.LastReportError(); err != nil || at.IsZero() {
+		t.Errorf("expected a successful report, got %v at %v", err, at)
+	}
+}
+
+func TestGUIDGenerator(t *testing.T) {
+	var next uint64
+	tracer := NewTracer(Options{
+		AccessToken:   "0987654321",
+		UseGRPC:       true,
+		GUIDGenerator: func() uint64 { next++; return next },
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	defer recorder.Close()
+	if recorder.reporterID != 1 {
+		t.Errorf("expected the generated reporter ID 1, got %d", recorder.reporterID)
+	}
+	recorder.RecordEvent("deploy", nil)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if sc := recorder.buffer.rawSpans[0].Context; sc.TraceID != 2 || sc.SpanID != 3 {
+		t.Errorf("expected generated event IDs 2 and 3, got %d and %d", sc.TraceID, sc.SpanID)
+	}
+}
+
+func TestSetLogURL(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+
+	const logURL = "https://logs.example.com/search?q=trace%3Dabc"
+	span := tracer.StartSpan("op")
+	if err := SetLogURL(span, logURL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, bad := range []string{"", "not a url", "/relative/path", "ftp://logs.example.com"} {
+		if err := SetLogURL(span, bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	span.Finish()
+
+	recorder.lock.Lock()
+	raw := recorder.buffer.rawSpans[0]
+	recorder.lock.Unlock()
+	var found bool
+	for _, kv := range recorder.translateRawSpan(raw, &recorder.buffer).Tags {
+		if kv.Key == LogURLKey {
+			found = true
+			if kv.GetStringValue() != logURL {
+				t.Errorf("unexpected log URL %q", kv.GetStringValue())
+			}
+		}
+	}
+	if !found {
+		t.Errorf("log URL tag was not reported")
+	}
+}
+
+func TestSpanFromContextWithAutoFinish(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		UseGRPC:     true,
+	})
+	recorder := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	bufferedSpans := func() int {
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+		return len(recorder.buffer.rawSpans)
+	}
+
+	if SpanFromContextWithAutoFinish(context.Background()) != nil {
+		t.Errorf("expected no span from an empty context")
+	}
+
+	// Finished explicitly, then the context is cancelled.
+	ctx, cancel := context.WithCancel(ot.ContextWithSpan(context.Background(), tracer.StartSpan("manual")))
+	span := SpanFromContextWithAutoFinish(ctx)
+	span.Finish()
+	cancel()
+	span.Finish()
+	time.Sleep(10 * time.Millisecond)
+	if n := bufferedSpans(); n != 1 {
+		t.Errorf("expected the span to be reported once, got %d", n)
+	}
+
+	// Finished by cancelling the context.
+	ctx, cancel = context.WithCancel(ot.ContextWithSpan(context.Background(), tracer.StartSpan("cancelled")))
+	span = SpanFromContextWithAutoFinish(ctx)
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for bufferedSpans() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	span.Finish()
+	time.Sleep(10 * time.Millisecond)
+	if n := bufferedSpans(); n != 2 {
+		t.Errorf("expected the cancelled span to be reported once, got %d spans", n)
+	}
+
+	// Finished through a chained call, then the context is cancelled.
+	ctx, cancel = context.WithCancel(ot.ContextWithSpan(context.Background(), tracer.StartSpan("chained")))
+	span = SpanFromContextWithAutoFinish(ctx)
+	span.SetTag("key", "value").SetBaggageItem("item", "value").SetOperationName("renamed").Finish()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if n := bufferedSpans(); n != 3 {
+		t.Errorf("expected the chained span to be reported once, got %d spans", n)
+	}
+}
+
+func TestReportingPeriod(t *testing.T) {
+	rec := NewRecorder(Options{
+		AccessToken:     "0987654321",
+		ReportingPeriod: 750 * time.Millisecond,
+		UseGRPC:         true,
+	})
+	defer rec.Close()
+
+	now := time.Now()
+	rec.lock.Lock()
+	rec.lastReportAttempt = now
+	early := rec.shouldFlushLocked(now.Add(150 * time.Millisecond))
+	due := rec.shouldFlushLocked(now.Add(300 * time.Millisecond))
+	rec.lock.Unlock()
+	if early {
+		t.Error("expected no flush before the reporting period is due")
+	}
+	if !due {
+		t.Error("expected a flush once the reporting period is due")
+	}
+
+	clamped := NewRecorder(Options{
+		AccessToken:     "0987654321",
+		ReportingPeriod: 100 * time.Millisecond,
+		UseGRPC:         true,
+	})
+	defer clamped.Close()
+	if clamped.maxReportingPeriod != minReportingPeriod {
+		t.Errorf("expected the period to be clamped to %v, got %v", minReportingPeriod, clamped.maxReportingPeriod)
+	}
+}
+
+func TestCloseLightStepTracer(t *testing.T) {
+	for _, useGRPC := range []bool{true, false} {
+		tracer := NewTracer(Options{
+			AccessToken: "0987654321",
+			// Nothing listens here, so the final report fails fast.
+			Collector: Endpoint{Host: "localhost", Port: 1, Plaintext: true},
+			UseGRPC:   useGRPC,
+		})
+		err := CloseLightStepTracer(tracer)
+		if useGRPC && err != nil {
+			t.Errorf("CloseLightStepTracer failed: %v", err)
+		}
+		if !useGRPC && err == nil {
+			t.Error("expected the failed final thrift report to be returned")
+		}
+	}
+	if err := CloseLightStepTracer(ot.NoopTracer{}); err == nil {
+		t.Error("expected an error closing a non-LightStep tracer")
+	}
+}
+
+func TestNewTracerE(t *testing.T) {
+	for _, useGRPC := range []bool{true, false} {
+		if _, err := NewTracerE(Options{UseGRPC: useGRPC}); err == nil {
+			t.Errorf("UseGRPC=%v: expected an error for an empty access token", useGRPC)
+		}
+		if _, ok := NewTracer(Options{UseGRPC: useGRPC}).(ot.NoopTracer); !ok {
+			t.Errorf("UseGRPC=%v: expected a no-op tracer for an empty access token", useGRPC)
+		}
+	}
+	if _, err := NewRecorderE(Options{}); err != errEmptyAccessToken {
+		t.Errorf("expected errEmptyAccessToken, got %v", err)
+	}
+
+	tracer, err := NewTracerE(Options{AccessToken: "0987654321", UseGRPC: true})
+	if err != nil {
+		t.Fatalf("NewTracerE failed: %v", err)
+	}
+	tracer.(basictracer.Tracer).Options().Recorder.(*Recorder).Close()
+}
+
+func TestThriftOnlyOptions(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"CoalesceSpans":   {CoalesceSpans: true},
+		"CoalesceKeyTags": {CoalesceKeyTags: []string{"key"}},
+		"IDFormatter":     {IDFormatter: func(id uint64) string { return "" }},
+		"BasicAuth":       {BasicAuthUsername: "user", BasicAuthPassword: "secret"},
+		"StreamSpans":     {StreamSpans: true},
+		"StreamInterval":  {StreamInterval: time.Millisecond},
+	} {
+		opts.AccessToken = "0987654321"
+		opts.UseGRPC = true
+		if _, err := NewTracerE(opts); err == nil {
+			t.Errorf("%s: expected an error with UseGRPC", name)
+		}
+	}
+}
+
+func TestDisableIfNoToken(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	tracer, err := NewTracerE(Options{DisableIfNoToken: true, UseGRPC: true})
+	if err != nil {
+		t.Fatalf("expected no error without an access token, got %v", err)
+	}
+	if _, ok := tracer.(basictracer.Tracer).Options().Recorder.(*NoopRecorder); !ok {
+		t.Fatalf("expected a NoopRecorder, got %T", tracer.(basictracer.Tracer).Options().Recorder)
+	}
+
+	parent := tracer.StartSpan("parent")
+	carrier := ot.TextMapCarrier{}
+	if err := tracer.Inject(parent.Context(), ot.TextMap, carrier); err != nil {
+		t.Errorf("inject failed: %v", err)
+	}
+	if _, err := tracer.Extract(ot.TextMap, carrier); err != nil {
+		t.Errorf("extract failed: %v", err)
+	}
+	parent.SetTag("k", "v").Finish()
+
+	if err := FlushLightStepTracer(tracer); err != nil {
+		t.Errorf("flush: unexpected error %v", err)
+	}
+	if err := RecordEvent(tracer, "deploy", nil); err != nil {
+		t.Errorf("record event: unexpected error %v", err)
+	}
+	if err := CloseLightStepTracer(tracer); err != nil {
+		t.Errorf("close: unexpected error %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected no goroutines to be started, went from %d to %d", goroutines, n)
+	}
+
+	// The token is still required without the flag, and used with it.
+	if _, err := NewTracerE(Options{}); err == nil {
+		t.Error("expected an error for an empty access token")
+	}
+	tracer = NewTracer(Options{AccessToken: "0987654321", UseGRPC: true, DisableIfNoToken: true})
+	tracer.(basictracer.Tracer).Options().Recorder.(*Recorder).Close()
+}
+
+func TestGetLightStepRecorder(t *testing.T) {
+	grpcTracer := NewTracer(Options{AccessToken: "0987654321", UseGRPC: true, Clock: time.Now})
+	rec, err := GetLightStepRecorder(grpcTracer)
+	if _, ok := rec.(*Recorder); !ok || err != nil {
+		t.Errorf("expected the gRPC Recorder, got %T, %v", rec, err)
+	}
+	CloseLightStepTracer(grpcTracer)
+
+	thriftTracer := NewTracer(Options{AccessToken: "0987654321"})
+	rec, err = GetLightStepRecorder(thriftTracer)
+	thriftRec, ok := rec.(*thrift_rpc.Recorder)
+	if !ok || err != nil {
+		t.Fatalf("expected the thrift Recorder, got %T, %v", rec, err)
+	}
+	thriftTracer.StartSpan("op").Finish()
+	if stats := thriftRec.Stats(); stats.RecordedSpans != 1 {
+		t.Errorf("expected the span in the Recorder's stats, got %+v", stats)
+	}
+	thriftRec.Close()
+
+	if _, err := GetLightStepRecorder(ot.NoopTracer{}); err == nil {
+		t.Error("expected an error for a non-LightStep Tracer")
+	}
+}
+
+func TestBackendOption(t *testing.T) {
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{AccessToken: "0987654321", Backend: backend})
+	tracer.StartSpan("op").Finish()
+	if err := FlushLightStepTracer(tracer); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	CloseLightStepTracer(tracer)
+	if spans := backend.Spans(); len(spans) != 1 || spans[0].GetSpanName() != "op" {
+		t.Errorf("expected the span to be reported to the backend, got %v", spans)
+	}
+}
+
+func TestDegradationLadderOption(t *testing.T) {
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{
+		AccessToken:       "0987654321",
+		Backend:           backend,
+		MaxBufferedSpans:  10,
+		DegradationLadder: []thrift_rpc.DegradationStep{{Fill: 0.1, Shed: thrift_rpc.DetailTags}},
+		LowValueTags:      []string{"debug"},
+	})
+	defer CloseLightStepTracer(tracer)
+	tracer.StartSpan("first").Finish()
+	tracer.StartSpan("degraded", ot.Tags{"debug": true}).Finish()
+	if err := FlushLightStepTracer(tracer); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	spans := backend.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected both spans to be reported, got %v", spans)
+	}
+	for _, span := range spans {
+		for _, kv := range span.Attributes {
+			if kv.Key == "debug" {
+				t.Errorf("expected the low-value tag to be shed from %s", span.GetSpanName())
+			}
+		}
+	}
+}
+
+func TestForceFlushLightStepTracer(t *testing.T) {
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{AccessToken: "0987654321", Backend: backend})
+	defer CloseLightStepTracer(tracer)
+	tracer.StartSpan("op").Finish()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ForceFlushLightStepTracer(ctx, tracer); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	if spans := backend.Spans(); len(spans) != 1 || spans[0].GetSpanName() != "op" {
+		t.Errorf("expected the span to be delivered, got %v", spans)
+	}
+}
+
+func TestWaitForFlushLightStepTracer(t *testing.T) {
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{AccessToken: "0987654321", Backend: backend})
+	defer CloseLightStepTracer(tracer)
+	tracer.StartSpan("op").Finish()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForFlushLightStepTracer(ctx, tracer); err != nil {
+		t.Fatalf("unexpected report error: %v", err)
+	}
+	if spans := backend.Spans(); len(spans) != 1 || spans[0].GetSpanName() != "op" {
+		t.Errorf("expected the report loop to deliver the span, got %v", spans)
+	}
+}
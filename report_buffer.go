@@ -9,6 +9,7 @@ import (
 type reportBuffer struct {
 	rawSpans             []basictracer.RawSpan
 	droppedSpanCount     int64
+	droppedTagCount      int64
 	logEncoderErrorCount int64
 	reportStart          time.Time
 	reportEnd            time.Time
@@ -39,6 +40,7 @@ func (b *reportBuffer) clear() {
 	b.reportStart = time.Time{}
 	b.reportEnd = time.Time{}
 	b.droppedSpanCount = 0
+	b.droppedTagCount = 0
 	b.logEncoderErrorCount = 0
 }
 
@@ -55,6 +57,7 @@ func (b *reportBuffer) addSpan(span basictracer.RawSpan) {
 // combined data.
 func (into *reportBuffer) mergeFrom(from *reportBuffer) {
 	into.droppedSpanCount += from.droppedSpanCount
+	into.droppedTagCount += from.droppedTagCount
 	into.logEncoderErrorCount += from.logEncoderErrorCount
 	if from.reportStart.Before(into.reportStart) {
 		into.reportStart = from.reportStart
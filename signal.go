@@ -0,0 +1,58 @@
+package lightstep
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// FlushOnSignal flushes lsTracer when the process receives one of signals,
+// SIGINT and SIGTERM if none are given, so that spans buffered at exit are
+// not lost. The flush is abandoned after timeout.
+//
+// The signal is not swallowed: once flushed, FlushOnSignal stops handling
+// it and raises it again, so it has the effect it would have had without
+// FlushOnSignal, be that the default of terminating the process or the
+// application's own signal.Notify handlers. Those handlers see the signal
+// both before and after the flush.
+//
+// Calling the returned function stops handling the signals, restoring
+// their previous disposition.
+func FlushOnSignal(lsTracer ot.Tracer, timeout time.Duration, signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	sigch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigch, signals...)
+	go func() {
+		select {
+		case sig := <-sigch:
+			flushed := make(chan struct{})
+			go func() {
+				FlushLightStepTracer(lsTracer)
+				close(flushed)
+			}()
+			select {
+			case <-flushed:
+			case <-time.After(timeout):
+			}
+			signal.Stop(sigch)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigch)
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+// +build !windows
+
+package lightstep
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lightstep/lightstep-tracer-go/thrift_rpc"
+)
+
+func TestFlushOnSignal(t *testing.T) {
+	// Stand in for the application's own handler, which also keeps the
+	// re-raised signal from terminating the test.
+	appch := make(chan os.Signal, 2)
+	signal.Notify(appch, syscall.SIGUSR1)
+	defer signal.Stop(appch)
+
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{AccessToken: "0987654321", Backend: backend})
+	defer CloseLightStepTracer(tracer)
+	stop := FlushOnSignal(tracer, time.Second, syscall.SIGUSR1)
+	defer stop()
+
+	tracer.StartSpan("op").Finish()
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-appch:
+		case <-time.After(time.Second):
+			t.Fatalf("expected the application's handler to see the signal twice, got %d", i)
+		}
+	}
+	if spans := backend.Spans(); len(spans) != 1 || spans[0].GetSpanName() != "op" {
+		t.Errorf("expected the span to be flushed before the signal was re-raised, got %v", spans)
+	}
+}
+
+func TestFlushOnSignalStop(t *testing.T) {
+	appch := make(chan os.Signal, 2)
+	signal.Notify(appch, syscall.SIGUSR1)
+	defer signal.Stop(appch)
+
+	backend := thrift_rpc.NewRecordingBackend()
+	tracer := NewTracer(Options{AccessToken: "0987654321", Backend: backend})
+	defer CloseLightStepTracer(tracer)
+	stop := FlushOnSignal(tracer, time.Second, syscall.SIGUSR1)
+	stop()
+	stop()
+
+	tracer.StartSpan("op").Finish()
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	<-appch
+	select {
+	case <-appch:
+		t.Error("expected no re-raised signal once stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := len(backend.Requests()); n != 0 {
+		t.Errorf("expected no flush once stopped, got %d reports", n)
+	}
+}
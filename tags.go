@@ -0,0 +1,63 @@
+package lightstep
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/lightstep/lightstep-tracer-go/thrift_rpc"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// ForceRecordKey is the tag and baggage key marking a trace to be recorded
+// regardless of Options.TraceSamplingRate. See ForceRecord.
+const ForceRecordKey = thrift_rpc.ForceRecordKey
+
+// LogURLKey is the tag key for a link to an external log query (e.g. a
+// Splunk or ELK search) covering a span.
+const LogURLKey = "log.url"
+
+// SetLogURL sets span's LogURLKey tag to logURL, a link to the external
+// logs for that span, which is reported like any other string tag. It
+// returns an error, leaving the span untouched, if logURL is not an
+// absolute http or https URL.
+func SetLogURL(span ot.Span, logURL string) error {
+	u, err := url.Parse(logURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("log URL must be an absolute http or https URL: %q", logURL)
+	}
+	span.SetTag(LogURLKey, u.String())
+	return nil
+}
+
+// SetSpanLinks links span to the spans identified by linked, e.g. to connect
+// a batch-processing span to each of the requests that contributed to the
+// batch. It replaces any links set previously. Only supported by the thrift
+// Recorder.
+func SetSpanLinks(span ot.Span, linked ...ot.SpanContext) {
+	thrift_rpc.SetSpanLinks(span, linked...)
+}
+
+// ForceRecord forces the trace containing span to be recorded whatever the
+// sampling decision. The override is carried in baggage, so it applies to
+// spans subsequently started from span's context, including in other
+// processes.
+func ForceRecord(span ot.Span) {
+	thrift_rpc.ForceRecord(span)
+}
+
+// ComponentAttributePrefix marks span tags that override the Tracer's
+// component attributes (Options.Tags) for that span, so that one process
+// can report spans as coming from several components. See
+// thrift_rpc.ComponentAttributePrefix. Only supported by the thrift
+// Recorder.
+const ComponentAttributePrefix = thrift_rpc.ComponentAttributePrefix
+
+// WithComponentAttributes wraps lsTracer so that the spans it starts report
+// attrs as their component attributes, sharing lsTracer's Recorder. Only
+// supported by the thrift Recorder.
+func WithComponentAttributes(lsTracer ot.Tracer, attrs map[string]string) ot.Tracer {
+	return thrift_rpc.WithComponentAttributes(lsTracer, attrs)
+}
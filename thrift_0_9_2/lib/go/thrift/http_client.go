@@ -142,6 +142,21 @@ func NewTHttpPostClient(urlstr string, timeout time.Duration) (TTransport, error
 	}, nil
 }
 
+// NewTHttpPostClientWithClient is like NewTHttpPostClient, but issues
+// requests using the given http.Client.
+func NewTHttpPostClientWithClient(urlstr string, client *http.Client) (TTransport, error) {
+	parsedURL, err := url.Parse(urlstr)
+	if err != nil {
+		return nil, err
+	}
+	return &THttpClient{
+		url:           parsedURL,
+		requestBuffer: getBuffer(),
+		header:        http.Header{},
+		httpClient:    client,
+	}, nil
+}
+
 // Set the HTTP Header for this specific Thrift Transport
 // It is important that you first assert the TTransport as a THttpClient type
 // like so:
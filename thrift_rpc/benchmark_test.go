@@ -0,0 +1,186 @@
+package thrift_rpc
+
+import (
+	"testing"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+func benchmarkFlushLargePayloads(b *testing.B, payloadQuotaBytes int) {
+	const payloadLen = 64 * 1024
+	rec, _ := newTestRecorder(Options{
+		MaxBufferedSpans:        100,
+		MaxLogMessageLen:        payloadLen,
+		ReportPayloadQuotaBytes: payloadQuotaBytes,
+	})
+	spans := makeLargePayloadSpans(100, payloadLen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		for _, raw := range spans {
+			rec.RecordSpan(raw)
+		}
+		b.StartTimer()
+		rec.Flush()
+	}
+}
+
+func BenchmarkFlushLargePayloadsUnbounded(b *testing.B) {
+	benchmarkFlushLargePayloads(b, 0)
+}
+
+func BenchmarkFlushLargePayloadsQuota(b *testing.B) {
+	benchmarkFlushLargePayloads(b, 256*1024)
+}
+
+func benchmarkFlushCompression(b *testing.B, compression Compression) {
+	const payloadLen = 4 * 1024
+	collector := newTestCollector()
+	defer collector.Close()
+	rec := NewRecorder(Options{
+		AccessToken:      "0987654321",
+		MaxBufferedSpans: 100,
+		MaxLogMessageLen: payloadLen,
+		Collector:        collector.endpoint(),
+		Compression:      compression,
+	})
+	defer rec.Close()
+	spans := makeLargePayloadSpans(100, payloadLen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		collector.backend.lock.Lock()
+		collector.backend.requests = nil
+		collector.backend.lock.Unlock()
+		for _, raw := range spans {
+			rec.RecordSpan(raw)
+		}
+		b.StartTimer()
+		rec.Flush()
+	}
+}
+
+func BenchmarkFlushUncompressed(b *testing.B) {
+	benchmarkFlushCompression(b, CompressionNone)
+}
+
+func BenchmarkFlushGzip(b *testing.B) {
+	benchmarkFlushCompression(b, CompressionGzip)
+}
+
+// benchmarkReportSize reports, as bytes/report, the size on the wire of a
+// report of attribute-heavy spans in each protocol.
+func benchmarkReportSize(b *testing.B, protocol ThriftProtocol, factory thrift.TProtocolFactory) {
+	spans := makeAttributeHeavySpans(100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for n := 0; n < b.N; n++ {
+		size = reportSize(b, protocol, factory, spans)
+	}
+	b.ReportMetric(float64(size), "bytes/report")
+}
+
+func BenchmarkReportSizeBinary(b *testing.B) {
+	benchmarkReportSize(b, ThriftProtocolBinary, thrift.NewTBinaryProtocolFactoryDefault())
+}
+
+func BenchmarkReportSizeCompact(b *testing.B) {
+	benchmarkReportSize(b, ThriftProtocolCompact, thrift.NewTCompactProtocolFactory())
+}
+
+// discardReportingService accepts and drops every report.
+type discardReportingService struct{}
+
+func (discardReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	return &lightstep_thrift.ReportResponse{}, nil
+}
+
+// BenchmarkFlushSpanRecords measures span conversion in isolation.
+func BenchmarkFlushSpanRecords(b *testing.B) {
+	rec, _ := newTestRecorder(Options{MaxBufferedSpans: 100})
+	rec.lock.Lock()
+	rec.backend = discardReportingService{}
+	rec.lock.Unlock()
+	spans := make([]basictracer.RawSpan, 100)
+	for i := range spans {
+		spans[i] = makeRawSpan("op", ot.Tags{"component": "bench", "index": i, "join:request": "r"})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		for _, raw := range spans {
+			rec.RecordSpan(raw)
+		}
+		b.StartTimer()
+		rec.Flush()
+	}
+}
+
+// BenchmarkRecordSpan measures recording a span into the buffer, which is
+// emptied as a report would, from a single goroutine.
+func BenchmarkRecordSpan(b *testing.B) {
+	rec, _ := newTestRecorder(Options{MaxBufferedSpans: 1000})
+	defer rec.Close()
+	raw := makeRawSpan("op", ot.Tags{"component": "bench"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		rec.RecordSpan(raw)
+		if n%1000 == 999 {
+			rec.lock.Lock()
+			rec.buffer.reset()
+			rec.lock.Unlock()
+		}
+	}
+}
+
+// benchmarkRecordSpanParallel records spans from many goroutines at once,
+// flushing in the background as the report loop would.
+func benchmarkRecordSpanParallel(b *testing.B, queueSize int) {
+	rec, _ := newTestRecorder(Options{MaxBufferedSpans: 10000, RecordQueueSize: queueSize})
+	rec.lock.Lock()
+	rec.backend = discardReportingService{}
+	rec.lock.Unlock()
+	defer rec.Close()
+	raw := makeRawSpan("op", ot.Tags{"component": "bench"})
+
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				rec.Flush()
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec.RecordSpan(raw)
+		}
+	})
+	b.StopTimer()
+	close(done)
+	<-flushed
+}
+
+func BenchmarkRecordSpanParallelMutex(b *testing.B) {
+	benchmarkRecordSpanParallel(b, 0)
+}
+
+func BenchmarkRecordSpanParallelQueue(b *testing.B) {
+	benchmarkRecordSpanParallel(b, 1024)
+}
@@ -0,0 +1,82 @@
+package thrift_rpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+	"github.com/opentracing/basictracer-go"
+)
+
+// BuildReport returns the ReportRequest the next Flush would send, built
+// from the spans buffered now, without sending it or resetting the buffer,
+// e.g. to check locally how tags, join IDs, and logs are serialized. The
+// request belongs to the caller.
+//
+// Unlike Flush, BuildReport leaves the Recorder as it was: the counters
+// reported in its metrics are not reset, and its spans are not counted
+// against Options.MaxSpansPerSecond, so Flush may yet throttle some of
+// them. Nor is it split according to Options.MaxSpansPerReport, or by
+// component (see ComponentAttributePrefix): all of its spans carry the
+// Recorder's own component attributes.
+func (r *Recorder) BuildReport() *lightstep_thrift.ReportRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.drainQueueLocked()
+
+	// Conversion counts dropped tags and payloads and truncated logs, and
+	// spends the payload quota; all are put back once the request is built.
+	payloadBytes := r.reportPayloadBytes
+	truncatedLogs, truncatedPayloads, truncatedBytes := r.logsTruncated, r.payloadsTruncated, r.bytesTruncated
+	pending := r.counters.swap()
+	defer func() {
+		r.reportPayloadBytes = payloadBytes
+		r.logsTruncated, r.payloadsTruncated, r.bytesTruncated = truncatedLogs, truncatedPayloads, truncatedBytes
+		r.counters.add(pending)
+	}()
+	r.reportPayloadBytes = 0
+
+	rawSpans := append([]basictracer.RawSpan(nil), r.buffer.current()...)
+	if r.groupByTrace {
+		groupByTrace(rawSpans)
+	}
+	records := r.buffer.currentRecords()
+	recs := make([]*lightstep_thrift.SpanRecord, 0, len(rawSpans)+len(records))
+	oldest, youngest := r.reportOldest, r.clock.Now()
+	for _, raw := range rawSpans {
+		rec, err := r.convertSpanSafely(raw)
+		if err != nil {
+			atomic.AddInt64(&r.counters.unconvertibleSpans, 1)
+			continue
+		}
+		recs = append(recs, rec)
+		if raw.Start.Before(oldest) {
+			oldest = raw.Start
+		}
+	}
+	for _, record := range records {
+		if start := time.Unix(0, record.GetOldestMicros()*1000); start.Before(oldest) {
+			oldest = start
+		}
+	}
+	recs = append(recs, records...)
+	if r.windowOverride != nil {
+		oldest, youngest = r.windowOverride.oldest, r.windowOverride.youngest
+	}
+
+	reported := pending.plus(r.counters.swap())
+	if r.counterMode == CounterModeCumulative {
+		reported = r.counterTotals.plus(reported)
+	}
+	req := &lightstep_thrift.ReportRequest{
+		OldestMicros:    thrift.Int64Ptr(oldest.UnixNano() / 1000),
+		YoungestMicros:  thrift.Int64Ptr(youngest.UnixNano() / 1000),
+		Runtime:         r.thriftRuntime(),
+		SpanRecords:     recs,
+		InternalMetrics: &lightstep_thrift.Metrics{Counts: reported.metricsSamples()},
+	}
+	// The request shares its forwarded records with the buffer, so the
+	// caller gets a copy.
+	return copyReportRequest(req)
+}
@@ -0,0 +1,66 @@
+package thrift_rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// summarizeSpans describes each record by the fields a report must carry,
+// with attributes sorted so that tag map order does not matter.
+func summarizeSpans(records []*lightstep_thrift.SpanRecord) []string {
+	summaries := make([]string, len(records))
+	for i, rec := range records {
+		attrs := make([]string, len(rec.Attributes))
+		for j, kv := range rec.Attributes {
+			attrs[j] = kv.Key + "=" + kv.Value
+		}
+		sort.Strings(attrs)
+		summaries[i] = fmt.Sprintf("%s %s %s %d-%d %v", rec.GetSpanGuid(), rec.GetTraceGuid(), rec.GetSpanName(),
+			rec.GetOldestMicros(), rec.GetYoungestMicros(), attrs)
+	}
+	return summaries
+}
+
+func TestBuildReport(t *testing.T) {
+	rec, backend := newTestRecorder(Options{SpanDropTags: map[string]string{"synthetic": "true"}})
+	rec.RecordSpan(makeRawSpan("op", ot.Tags{"key": "value"}))
+	rec.RecordSpan(makeRawSpan("filtered", ot.Tags{"synthetic": "true"}))
+
+	req := rec.BuildReport()
+	if len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != "op" {
+		t.Fatalf("expected the buffered span in the report, got %v", req.SpanRecords)
+	}
+	if value, ok := findAttribute(req.SpanRecords[0].Attributes, "key"); !ok || value != "value" {
+		t.Errorf("expected the span's tag in the report, got %v", req.SpanRecords[0].Attributes)
+	}
+	if n := findMetric(req, "spans.filtered"); n != 1 {
+		t.Errorf("expected 1 filtered span in the report, got %d", n)
+	}
+	if n := backend.requestCount(); n != 0 {
+		t.Errorf("expected nothing to be sent, got %d reports", n)
+	}
+
+	// The request is the caller's: changing it leaves the Recorder's copy,
+	// and the next report, as they were.
+	req.SpanRecords[0].SpanName = nil
+	again := rec.BuildReport()
+	if !reflect.DeepEqual(summarizeSpans(again.SpanRecords), summarizeSpans(rec.BuildReport().SpanRecords)) || again.SpanRecords[0].GetSpanName() != "op" {
+		t.Errorf("expected BuildReport to be repeatable, got %v", again.SpanRecords)
+	}
+
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	sent := backend.lastRequest()
+	if !reflect.DeepEqual(summarizeSpans(sent.SpanRecords), summarizeSpans(again.SpanRecords)) {
+		t.Errorf("expected Flush to send the built spans %v, got %v", again.SpanRecords, sent.SpanRecords)
+	}
+	if n := findMetric(sent, "spans.filtered"); n != 1 {
+		t.Errorf("expected BuildReport to leave the counters for Flush, got %d filtered spans", n)
+	}
+}
@@ -0,0 +1,40 @@
+package thrift_rpc
+
+import "time"
+
+// clock is the source of time for the Recorder's reporting decisions, so
+// that tests can drive the report loop without sleeping.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker is the subset of *time.Ticker used by the report loop.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
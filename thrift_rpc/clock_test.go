@@ -0,0 +1,500 @@
+package thrift_rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when advanced. Its tickers fire,
+// at most once per advance, when their period has elapsed, and its timers
+// once their deadline has passed.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+func (c *fakeClock) timerCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+func (c *fakeClock) tickerCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.tickers)
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || c.now.Before(t.next) {
+			continue
+		}
+		for !c.now.Before(t.next) {
+			t.next = t.next.Add(t.period)
+		}
+		// Like time.Ticker, drop ticks the reader is not keeping up with.
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if c.now.Before(timer.at) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	t.stopped = true
+}
+
+func TestShouldFlushTimeout(t *testing.T) {
+	clk := newFakeClock()
+	rec, _ := newTestRecorder(Options{ReportingPeriod: time.Second, clock: clk})
+
+	// Checks run every minReportingPeriod, so the last check before the
+	// period elapses flushes.
+	clk.advance(time.Second - minReportingPeriod)
+	if rec.shouldFlush() {
+		t.Errorf("expected no flush %v after the last report", time.Second-minReportingPeriod)
+	}
+	clk.advance(time.Nanosecond)
+	if !rec.shouldFlush() {
+		t.Error("expected a flush once the next check would exceed the reporting period")
+	}
+
+	rec.Flush()
+	if rec.shouldFlush() {
+		t.Error("expected the flush to restart the reporting period")
+	}
+}
+
+func TestShouldFlushBufferHalfFull(t *testing.T) {
+	clk := newFakeClock()
+	rec, _ := newTestRecorder(Options{MaxBufferedSpans: 10, clock: clk})
+
+	for i := 0; i < 5; i++ {
+		rec.RecordSpan(makeRawSpan("op", nil))
+	}
+	if rec.shouldFlush() {
+		t.Error("expected no flush with the buffer half full")
+	}
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if !rec.shouldFlush() {
+		t.Error("expected a flush with the buffer more than half full")
+	}
+}
+
+func TestFlushThresholdRatio(t *testing.T) {
+	for _, test := range []struct {
+		ratio     float64
+		threshold int // the most spans buffered without an early flush
+	}{
+		{0, 5},
+		{0.5, 5},
+		{0.8, 8},
+		{1, 9},
+	} {
+		rec, _ := newTestRecorder(Options{MaxBufferedSpans: 10, FlushThresholdRatio: test.ratio, clock: newFakeClock()})
+		for i := 0; i < test.threshold; i++ {
+			rec.RecordSpan(makeRawSpan("op", nil))
+		}
+		if rec.shouldFlush() {
+			t.Errorf("ratio %v: expected no flush with %d spans buffered", test.ratio, test.threshold)
+		}
+		rec.RecordSpan(makeRawSpan("op", nil))
+		if !rec.shouldFlush() {
+			t.Errorf("ratio %v: expected a flush with %d spans buffered", test.ratio, test.threshold+1)
+		}
+	}
+
+	for _, ratio := range []float64{-0.5, 1.5} {
+		if _, err := NewRecorderE(Options{AccessToken: "0987654321", FlushThresholdRatio: ratio}); err == nil {
+			t.Errorf("expected an error for FlushThresholdRatio %v", ratio)
+		}
+	}
+}
+
+func TestReportLoopUsesClock(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{ReportingPeriod: time.Second, clock: clk})
+	defer rec.Close()
+	if !waitFor(time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("expected the report loop to start a ticker")
+	}
+
+	clk.advance(minReportingPeriod)
+	time.Sleep(10 * time.Millisecond)
+	if n := backend.requestCount(); n != 0 {
+		t.Fatalf("expected no report before the reporting period, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		clk.advance(minReportingPeriod)
+	}
+	if !waitFor(time.Second, func() bool { return backend.requestCount() == 1 }) {
+		t.Errorf("expected one report once the reporting period elapsed, got %d", backend.requestCount())
+	}
+}
+
+func TestWaitForFlush(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{ReportingPeriod: time.Second, clock: clk})
+	defer rec.Close()
+	if !waitFor(time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("expected the report loop to start a ticker")
+	}
+
+	// wait advances clk until the report loop has sent a report.
+	wait := func() error {
+		waited := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			waited <- rec.WaitForFlush(ctx)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		for {
+			select {
+			case err := <-waited:
+				return err
+			case <-time.After(10 * time.Millisecond):
+				clk.advance(minReportingPeriod)
+			}
+		}
+	}
+
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if err := wait(); err != nil {
+		t.Fatalf("unexpected report error: %v", err)
+	}
+	if n := backend.requestCount(); n != 1 {
+		t.Fatalf("expected WaitForFlush to return once the report was sent, got %d reports", n)
+	}
+	if recs := backend.lastRequest().SpanRecords; len(recs) != 1 || recs[0].GetSpanName() != "op" {
+		t.Errorf("expected the report to carry the span, got %v", recs)
+	}
+
+	backend.lock.Lock()
+	backend.err = fmt.Errorf("unavailable")
+	backend.lock.Unlock()
+	if err := wait(); err == nil {
+		t.Error("expected WaitForFlush to return the report error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rec.WaitForFlush(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled without a report, got %v", err)
+	}
+	rec.Disable()
+	if err := rec.WaitForFlush(context.Background()); err != ErrRecorderDisabled {
+		t.Errorf("expected ErrRecorderDisabled, got %v", err)
+	}
+}
+
+func TestWaitForFlushWithoutReport(t *testing.T) {
+	rec, backend := newTestRecorder(Options{SuppressEmptyReports: true})
+	defer rec.Close()
+
+	// waitDuring returns what WaitForFlush returns once flush has run.
+	waitDuring := func(flush func()) error {
+		waited := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			waited <- rec.WaitForFlush(ctx)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		flush()
+		return <-waited
+	}
+
+	if err := waitDuring(func() { rec.Flush() }); err != nil {
+		t.Errorf("expected a suppressed empty report to return nil, got %v", err)
+	}
+	if n := backend.requestCount(); n != 0 {
+		t.Errorf("expected the empty report to be suppressed, got %d reports", n)
+	}
+	if err := waitDuring(rec.Disable); err != ErrRecorderDisabled {
+		t.Errorf("expected Disable to return ErrRecorderDisabled, got %v", err)
+	}
+}
+
+func TestStartupSpanReportedPromptly(t *testing.T) {
+	clk := newFakeClock()
+	backend := &mockReportingService{err: fmt.Errorf("invalid access token")}
+	rec := NewRecorder(Options{
+		AccessToken:       "0987654321",
+		Backend:           backend,
+		ReportStartupSpan: true,
+		ReportingPeriod:   time.Minute,
+		clock:             clk,
+	})
+	defer rec.Close()
+	if !waitFor(time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("expected the report loop to start a ticker")
+	}
+
+	// The first check reports the startup span, well before ReportingPeriod.
+	clk.advance(minReportingPeriod)
+	if !waitFor(time.Second, func() bool { _, err := rec.LastReportError(); return err != nil }) {
+		t.Fatal("expected the failed first report to surface through LastReportError")
+	}
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != StartupSpanOperation {
+		t.Errorf("expected the first report to carry the startup span, got %v", req.SpanRecords)
+	}
+}
+
+func TestStreamSpansBackoff(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{StreamSpans: true, StreamInterval: time.Millisecond, clock: clk})
+	defer rec.Close()
+	rec.lock.Lock()
+	rec.backoffUntil = clk.Now().Add(time.Second)
+	rec.lock.Unlock()
+
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if !waitFor(time.Second, func() bool { return clk.timerCount() == 1 }) {
+		t.Fatal("expected the report loop to wait out the backoff")
+	}
+	if n := backend.requestCount(); n != 0 {
+		t.Fatalf("expected no report during the backoff, got %d", n)
+	}
+	clk.advance(time.Second)
+	if !waitFor(time.Second, func() bool { return backend.requestCount() == 1 }) {
+		t.Fatal("expected the span to be streamed once the backoff expired")
+	}
+}
+
+func TestSynchronousBackoff(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{Synchronous: true, clock: clk})
+	defer rec.Close()
+	rec.lock.Lock()
+	rec.backoffUntil = clk.Now().Add(time.Second)
+	rec.lock.Unlock()
+
+	rec.RecordSpan(makeRawSpan("held", nil))
+	if n := backend.requestCount(); n != 0 {
+		t.Fatalf("expected no report during the backoff, got %d", n)
+	}
+	clk.advance(time.Second)
+	rec.RecordSpan(makeRawSpan("after", nil))
+	if n := backend.requestCount(); n != 1 {
+		t.Fatalf("expected a report once the backoff expired, got %d", n)
+	}
+	if spans := backend.lastRequest().SpanRecords; len(spans) != 2 {
+		t.Errorf("expected the held span to be reported with the next one, got %v", spans)
+	}
+}
+
+func TestForceFlushBackoff(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{clock: clk})
+	defer rec.Close()
+	rec.lock.Lock()
+	rec.backend = &flakyReportingService{mockReportingService: backend, rec: rec}
+	rec.backoffUntil = clk.Now().Add(5 * time.Second)
+	rec.lock.Unlock()
+
+	rec.RecordSpan(makeRawSpan("before", nil))
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- rec.ForceFlush(ctx)
+	}()
+	if !waitFor(time.Second, func() bool { return clk.timerCount() == 1 }) {
+		t.Fatal("expected ForceFlush to wait before retrying")
+	}
+	clk.advance(minReportingPeriod)
+	time.Sleep(10 * time.Millisecond)
+	if n := backend.requestCount(); n != 0 {
+		t.Fatalf("expected no retry during the backoff, got %d reports", n)
+	}
+	clk.advance(5 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("expected ForceFlush to succeed once the backoff expired, got %v", err)
+	}
+}
+
+func TestEnable(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{ReportingPeriod: time.Second, clock: clk})
+	defer rec.Close()
+	if !waitFor(time.Second, func() bool { return clk.tickerCount() == 1 }) {
+		t.Fatal("expected the report loop to start a ticker")
+	}
+
+	rec.Disable()
+	rec.RecordSpan(makeRawSpan("dropped", nil))
+	if err := rec.Flush(); err != ErrRecorderDisabled {
+		t.Errorf("expected ErrRecorderDisabled, got %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		clk.advance(minReportingPeriod)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := backend.requestCount(); n != 0 {
+		t.Fatalf("expected no reports while disabled, got %d", n)
+	}
+
+	rec.Enable()
+	rec.RecordSpan(makeRawSpan("kept", nil))
+	for i := 0; i < 4; i++ {
+		clk.advance(minReportingPeriod)
+	}
+	if !waitFor(time.Second, func() bool { return backend.requestCount() == 1 }) {
+		t.Fatalf("expected the report loop to resume once enabled, got %d reports", backend.requestCount())
+	}
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != "kept" {
+		t.Errorf("expected only the span recorded after Enable, got %v", req.SpanRecords)
+	}
+
+	rec.Close()
+	rec.Enable()
+	if err := rec.Flush(); err != ErrRecorderDisabled {
+		t.Errorf("expected Enable to have no effect after Close, got %v", err)
+	}
+}
+
+func TestSetReportingPeriod(t *testing.T) {
+	clk := newFakeClock()
+	rec, _ := newTestRecorder(Options{ReportingPeriod: 10 * time.Second, clock: clk})
+
+	clk.advance(2 * time.Second)
+	if rec.shouldFlush() {
+		t.Fatal("expected no flush 2s into a 10s reporting period")
+	}
+	if err := rec.SetReportingPeriod(2 * time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !rec.shouldFlush() {
+		t.Error("expected a flush once the reporting period is shortened to 2s")
+	}
+
+	if err := rec.SetReportingPeriod(minReportingPeriod - time.Millisecond); err == nil {
+		t.Error("expected an error for a reporting period below the minimum")
+	}
+	rec.Flush()
+	clk.advance(time.Second)
+	if rec.shouldFlush() {
+		t.Error("expected the rejected reporting period to leave the 2s period in place")
+	}
+}
+
+func TestSetMaxBufferedSpans(t *testing.T) {
+	for _, test := range []struct {
+		policy OverflowPolicy
+		kept   []string
+	}{
+		{OverflowDropNewest, []string{"0", "1"}},
+		{OverflowDropOldest, []string{"2", "3"}},
+	} {
+		rec, _ := newTestRecorder(Options{MaxBufferedSpans: 10, OverflowPolicy: test.policy, clock: newFakeClock()})
+		for i := 0; i < 4; i++ {
+			rec.RecordSpan(makeRawSpan(strconv.Itoa(i), nil))
+		}
+		if rec.shouldFlush() {
+			t.Errorf("%s: expected no flush with 4 of 10 spans buffered", test.policy)
+		}
+		if err := rec.SetMaxBufferedSpans(6); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.policy, err)
+		}
+		if !rec.shouldFlush() {
+			t.Errorf("%s: expected a flush with 4 of 6 spans buffered", test.policy)
+		}
+
+		// Shrinking below the number buffered drops the excess.
+		if err := rec.SetMaxBufferedSpans(2); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.policy, err)
+		}
+		rec.lock.Lock()
+		var kept []string
+		for _, span := range rec.buffer.current() {
+			kept = append(kept, span.Operation)
+		}
+		rec.lock.Unlock()
+		if !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%s: expected %v to be kept, got %v", test.policy, test.kept, kept)
+		}
+		if stats := rec.Stats(); stats.DroppedSpans != 2 || stats.BufferCapacity != 2 {
+			t.Errorf("%s: expected 2 spans dropped and a capacity of 2, got %+v", test.policy, stats)
+		}
+		rec.RecordSpan(makeRawSpan("4", nil))
+		if n := rec.Stats().DroppedSpans; n != 3 {
+			t.Errorf("%s: expected the resized buffer to be full, got %d dropped", test.policy, n)
+		}
+
+		if err := rec.SetMaxBufferedSpans(0); err == nil {
+			t.Errorf("%s: expected an error for a buffer of 0 spans", test.policy)
+		}
+	}
+}
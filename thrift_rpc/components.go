@@ -0,0 +1,162 @@
+package thrift_rpc
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// ComponentAttributePrefix marks span tags that override the Recorder's
+// component attributes (Options.Tags) for that span, so that one process
+// can report spans as coming from several components. For example, a span
+// tagged "component:lightstep.component_name" = "billing" is reported as
+// belonging to the billing component, whatever Options.Tags names.
+//
+// Spans are reported in one request per distinct set of overrides, each
+// carrying the Recorder's attributes with the overrides applied. Where a
+// WithComponentAttributes tracer and the span itself set the same
+// attribute, the span's tag wins, as tags set later always do. The
+// attributes describing the tracer itself, such as TracerVersionKey,
+// cannot be overridden. The tags are not reported as span attributes.
+const ComponentAttributePrefix = "component:"
+
+// WithComponentAttributes wraps tracer, which must be a basictracer.Tracer
+// such as one returned by NewTracer, so that the spans it starts report
+// attrs as their component attributes; see ComponentAttributePrefix. The
+// wrapped tracer shares tracer's Recorder, and so its buffer.
+func WithComponentAttributes(tracer ot.Tracer, attrs map[string]string) ot.Tracer {
+	tags := make(ot.Tags, len(attrs))
+	for k, v := range attrs {
+		tags[ComponentAttributePrefix+k] = v
+	}
+	return &componentTracer{tracer.(basictracer.Tracer), tags}
+}
+
+type componentTracer struct {
+	basictracer.Tracer
+	tags ot.Tags
+}
+
+func (t *componentTracer) StartSpan(operationName string, opts ...ot.StartSpanOption) ot.Span {
+	// Options apply in order, so the caller's own tags win.
+	opts = append([]ot.StartSpanOption{t.tags}, opts...)
+	return t.Tracer.StartSpan(operationName, opts...)
+}
+
+// componentKey identifies raw's set of component attribute overrides. It
+// is empty if raw has none.
+func componentKey(raw *basictracer.RawSpan) string {
+	var pairs []string
+	for key, value := range raw.Tags {
+		if strings.HasPrefix(key, ComponentAttributePrefix) {
+			pairs = append(pairs, key+"\x00"+formatTagValue(value))
+		}
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
+
+// groupByComponent stably reorders spans so that those with the same
+// component attribute overrides are adjacent, those without any first.
+func groupByComponent(spans []basictracer.RawSpan) {
+	var keys []string
+	for i := range spans {
+		if key := componentKey(&spans[i]); key != "" {
+			if keys == nil {
+				keys = make([]string, len(spans))
+			}
+			keys[i] = key
+		}
+	}
+	if keys == nil {
+		return
+	}
+	order := map[string]int{"": 0}
+	for _, key := range keys {
+		if _, ok := order[key]; !ok {
+			order[key] = len(order)
+		}
+	}
+	indices := make([]int, len(spans))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return order[keys[indices[i]]] < order[keys[indices[j]]]
+	})
+	sorted := make([]basictracer.RawSpan, len(spans))
+	for i, index := range indices {
+		sorted[i] = spans[index]
+	}
+	copy(spans, sorted)
+}
+
+// componentReport is the part of a report for one component's spans.
+type componentReport struct {
+	runtime *lightstep_thrift.Runtime
+	records []*lightstep_thrift.SpanRecord
+}
+
+// splitByComponent splits recs, converted from spans, as grouped by
+// groupByComponent, and followed by any forwarded records, into a part
+// per run of spans with the same component attribute overrides. There is
+// always at least one part, so that an empty buffer is still reported.
+// caller must hold r.lock
+func (r *Recorder) splitByComponent(spans []basictracer.RawSpan, recs []*lightstep_thrift.SpanRecord) []componentReport {
+	keyOf := func(i int) string {
+		if i < len(spans) {
+			return componentKey(&spans[i])
+		}
+		return "" // forwarded records
+	}
+	var parts []componentReport
+	start, key := 0, keyOf(0)
+	for i := 1; i <= len(recs); i++ {
+		var next string
+		if i < len(recs) {
+			if next = keyOf(i); next == key {
+				continue
+			}
+		}
+		var overrides ot.Tags
+		if key != "" {
+			overrides = spans[start].Tags
+		}
+		parts = append(parts, componentReport{r.componentRuntime(overrides), recs[start:i]})
+		start, key = i, next
+	}
+	if len(parts) == 0 {
+		parts = append(parts, componentReport{r.thriftRuntime(), recs})
+	}
+	return parts
+}
+
+// componentRuntime is like thriftRuntime, but applies the component
+// attribute overrides among tags.
+// caller must hold r.lock
+func (r *Recorder) componentRuntime(tags ot.Tags) *lightstep_thrift.Runtime {
+	if len(tags) == 0 {
+		return r.thriftRuntime()
+	}
+	attributes := make(map[string]string, len(r.attributes))
+	for k, v := range r.attributes {
+		attributes[k] = v
+	}
+	for key, value := range tags {
+		if !strings.HasPrefix(key, ComponentAttributePrefix) {
+			continue
+		}
+		switch key = key[len(ComponentAttributePrefix):]; key {
+		case TracerPlatformKey, TracerPlatformVersionKey, TracerVersionKey, ReportSchemaVersionKey:
+			continue
+		}
+		attributes[key] = formatTagValue(value)
+	}
+	return r.runtimeWith(attributes)
+}
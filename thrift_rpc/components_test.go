@@ -0,0 +1,77 @@
+package thrift_rpc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+func TestComponentAttributes(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken: "0987654321",
+		Tags:        ot.Tags{ComponentNameKey: "frontend", "region": "us"},
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	backend := &mockReportingService{}
+	rec.lock.Lock()
+	rec.backend = backend
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+	billing := WithComponentAttributes(tracer, map[string]string{ComponentNameKey: "billing", TracerVersionKey: "0"})
+
+	tracer.StartSpan("render").Finish()
+	billing.StartSpan("charge").Finish()
+	tracer.StartSpan("render-again").Finish()
+	// The span's own tag wins over its tracer's.
+	billing.StartSpan("refund", ot.Tag{Key: ComponentAttributePrefix + ComponentNameKey, Value: "refunds"}).Finish()
+	billing.StartSpan("charge-again").Finish()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+
+	backend.lock.Lock()
+	requests := backend.requests
+	backend.lock.Unlock()
+	expected := []struct {
+		component  string
+		operations []string
+	}{
+		{"frontend", []string{"render", "render-again"}},
+		{"billing", []string{"charge", "charge-again"}},
+		{"refunds", []string{"refund"}},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected a report per component, got %d", len(requests))
+	}
+	for i, want := range expected {
+		req := requests[i]
+		if name, _ := findAttribute(req.Runtime.Attrs, ComponentNameKey); name != want.component {
+			t.Errorf("report %d: expected component %q, got %q", i, want.component, name)
+		}
+		if region, _ := findAttribute(req.Runtime.Attrs, "region"); region != "us" {
+			t.Errorf("report %d: expected the Recorder's other attributes, got region %q", i, region)
+		}
+		if version, _ := findAttribute(req.Runtime.Attrs, TracerVersionKey); version != TracerVersionValue {
+			t.Errorf("report %d: expected %s not to be overridden, got %q", i, TracerVersionKey, version)
+		}
+		if (req.InternalMetrics != nil) != (i == 0) {
+			t.Errorf("report %d: expected only the first report to carry metrics", i)
+		}
+		var operations []string
+		for _, span := range req.SpanRecords {
+			operations = append(operations, span.GetSpanName())
+			for _, kv := range span.Attributes {
+				if strings.HasPrefix(kv.Key, ComponentAttributePrefix) {
+					t.Errorf("expected %s not to be reported as a span attribute", kv.Key)
+				}
+			}
+		}
+		if !reflect.DeepEqual(operations, want.operations) {
+			t.Errorf("report %d: expected %v, got %v", i, want.operations, operations)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package thrift_rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Compression selects how report request bodies are compressed.
+type Compression string
+
+const (
+	// CompressionNone sends reports uncompressed. It is the default.
+	CompressionNone Compression = "none"
+
+	// CompressionGzip gzips each report, trading CPU for smaller requests.
+	CompressionGzip Compression = "gzip"
+)
+
+func (c Compression) validate() error {
+	switch c {
+	case "", CompressionNone, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", string(c))
+}
+
+// wrap returns base wrapped to apply c to each request.
+func (c Compression) wrap(base http.RoundTripper) http.RoundTripper {
+	if c == CompressionGzip {
+		return &gzipTransport{base}
+	}
+	return base
+}
+
+// gzipTransport is an http.RoundTripper that gzips request bodies.
+type gzipTransport struct {
+	base http.RoundTripper
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the caller's request.
+	compressed := new(http.Request)
+	*compressed = *req
+	compressed.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		compressed.Header[k] = v
+	}
+	compressed.Header.Set("Content-Encoding", "gzip")
+	data := buf.Bytes()
+	compressed.Body = ioutil.NopCloser(bytes.NewReader(data))
+	// The caller's GetBody would resend the uncompressed body on a retry.
+	compressed.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	compressed.ContentLength = int64(len(data))
+	return t.base.RoundTrip(compressed)
+}
+
+func (t *gzipTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
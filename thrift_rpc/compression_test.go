@@ -0,0 +1,78 @@
+package thrift_rpc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	spans := makeLargePayloadSpans(10, 1000)
+	sizes := make(map[Compression]int)
+	for _, compression := range []Compression{"", CompressionNone, CompressionGzip} {
+		collector := newTestCollector()
+		rec := NewRecorder(Options{
+			AccessToken:      "0987654321",
+			MaxLogMessageLen: 2000,
+			Collector:        collector.endpoint(),
+			Compression:      compression,
+		})
+		for _, raw := range spans {
+			rec.RecordSpan(raw)
+		}
+		if err := rec.Flush(); err != nil {
+			t.Errorf("%q: unexpected error %v", compression, err)
+		}
+
+		req := collector.backend.lastRequest()
+		if req == nil || len(req.SpanRecords) != len(spans) {
+			t.Errorf("%q: the collector could not decode the report: %v", compression, req)
+		}
+		collector.lock.Lock()
+		encoding := collector.headers[0].Get("Content-Encoding")
+		sizes[compression] = collector.sizes[0]
+		collector.lock.Unlock()
+		if gzipped := encoding == "gzip"; gzipped != (compression == CompressionGzip) {
+			t.Errorf("%q: unexpected Content-Encoding %q", compression, encoding)
+		}
+		rec.Close()
+		collector.Close()
+	}
+	if sizes[CompressionGzip] >= sizes[CompressionNone]/2 {
+		t.Errorf("expected gzip to shrink a %d byte report, got %d bytes", sizes[CompressionNone], sizes[CompressionGzip])
+	}
+
+	if _, err := NewRecorderE(Options{AccessToken: "0987654321", Compression: "zstd"}); err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+}
+
+// bodyRecordingTransport records the body, and the body returned by
+// GetBody, of the request it receives.
+type bodyRecordingTransport struct {
+	body, getBody []byte
+}
+
+func (b *bodyRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.body, _ = ioutil.ReadAll(req.Body)
+	if req.GetBody != nil {
+		body, _ := req.GetBody()
+		b.getBody, _ = ioutil.ReadAll(body)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+}
+
+func TestGzipTransportGetBody(t *testing.T) {
+	base := &bodyRecordingTransport{}
+	req, err := http.NewRequest("POST", "http://collector.invalid/", bytes.NewReader([]byte("report")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&gzipTransport{base}).RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(base.getBody, base.body) || bytes.Equal(base.body, []byte("report")) {
+		t.Errorf("expected GetBody to return the compressed body %q, got %q", base.body, base.getBody)
+	}
+}
@@ -0,0 +1,140 @@
+package thrift_rpc
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+)
+
+// CounterMode selects how internal counters such as "spans.dropped" are
+// reported.
+type CounterMode string
+
+const (
+	// CounterModeDelta, the default, reports the counts accumulated since
+	// the previous successful report.
+	CounterModeDelta CounterMode = "delta"
+
+	// CounterModeCumulative reports running totals since the Recorder was
+	// created.
+	CounterModeCumulative CounterMode = "cumulative"
+)
+
+func (m CounterMode) validate() error {
+	switch m {
+	case "", CounterModeDelta, CounterModeCumulative:
+		return nil
+	}
+	return fmt.Errorf("unknown counter mode %q", string(m))
+}
+
+// A set of counter values for a given time window
+type counterSet struct {
+	droppedSpans       int64
+	droppedTags        int64
+	droppedPayloads    int64
+	filteredSpans      int64
+	unconvertibleSpans int64
+	degradedSpans      int64
+	throttledSpans     int64
+	truncatedLogs      int64
+	truncatedPayloads  int64
+	truncatedBytes     int64
+}
+
+// swap atomically resets every counter to zero, returning the prior values.
+func (c *counterSet) swap() counterSet {
+	return counterSet{
+		droppedSpans:       atomic.SwapInt64(&c.droppedSpans, 0),
+		droppedTags:        atomic.SwapInt64(&c.droppedTags, 0),
+		droppedPayloads:    atomic.SwapInt64(&c.droppedPayloads, 0),
+		filteredSpans:      atomic.SwapInt64(&c.filteredSpans, 0),
+		unconvertibleSpans: atomic.SwapInt64(&c.unconvertibleSpans, 0),
+		degradedSpans:      atomic.SwapInt64(&c.degradedSpans, 0),
+		throttledSpans:     atomic.SwapInt64(&c.throttledSpans, 0),
+		truncatedLogs:      atomic.SwapInt64(&c.truncatedLogs, 0),
+		truncatedPayloads:  atomic.SwapInt64(&c.truncatedPayloads, 0),
+		truncatedBytes:     atomic.SwapInt64(&c.truncatedBytes, 0),
+	}
+}
+
+// add atomically adds other to c, e.g. to restore counts that failed to be
+// reported.
+func (c *counterSet) add(other counterSet) {
+	atomic.AddInt64(&c.droppedSpans, other.droppedSpans)
+	atomic.AddInt64(&c.droppedTags, other.droppedTags)
+	atomic.AddInt64(&c.droppedPayloads, other.droppedPayloads)
+	atomic.AddInt64(&c.filteredSpans, other.filteredSpans)
+	atomic.AddInt64(&c.unconvertibleSpans, other.unconvertibleSpans)
+	atomic.AddInt64(&c.degradedSpans, other.degradedSpans)
+	atomic.AddInt64(&c.throttledSpans, other.throttledSpans)
+	atomic.AddInt64(&c.truncatedLogs, other.truncatedLogs)
+	atomic.AddInt64(&c.truncatedPayloads, other.truncatedPayloads)
+	atomic.AddInt64(&c.truncatedBytes, other.truncatedBytes)
+}
+
+// plus returns the sum of c and other. It is not atomic.
+func (c counterSet) plus(other counterSet) counterSet {
+	return counterSet{
+		droppedSpans:       c.droppedSpans + other.droppedSpans,
+		droppedTags:        c.droppedTags + other.droppedTags,
+		droppedPayloads:    c.droppedPayloads + other.droppedPayloads,
+		filteredSpans:      c.filteredSpans + other.filteredSpans,
+		unconvertibleSpans: c.unconvertibleSpans + other.unconvertibleSpans,
+		degradedSpans:      c.degradedSpans + other.degradedSpans,
+		throttledSpans:     c.throttledSpans + other.throttledSpans,
+		truncatedLogs:      c.truncatedLogs + other.truncatedLogs,
+		truncatedPayloads:  c.truncatedPayloads + other.truncatedPayloads,
+		truncatedBytes:     c.truncatedBytes + other.truncatedBytes,
+	}
+}
+
+func (c counterSet) isZero() bool {
+	return c == counterSet{}
+}
+
+func (c counterSet) metricsSamples() []*lightstep_thrift.MetricsSample {
+	return []*lightstep_thrift.MetricsSample{
+		&lightstep_thrift.MetricsSample{
+			Name:       "spans.dropped",
+			Int64Value: &c.droppedSpans,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "tags.dropped",
+			Int64Value: &c.droppedTags,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "payloads.dropped",
+			Int64Value: &c.droppedPayloads,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "spans.filtered",
+			Int64Value: &c.filteredSpans,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "spans.unconvertible",
+			Int64Value: &c.unconvertibleSpans,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "spans.degraded",
+			Int64Value: &c.degradedSpans,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "spans.throttled",
+			Int64Value: &c.throttledSpans,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "logs.truncated",
+			Int64Value: &c.truncatedLogs,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "payloads.truncated",
+			Int64Value: &c.truncatedPayloads,
+		},
+		&lightstep_thrift.MetricsSample{
+			Name:       "bytes.truncated",
+			Int64Value: &c.truncatedBytes,
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package thrift_rpc
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	GOMAXPROCSKey = "lightstep.gomaxprocs"
+	CPUQuotaKey   = "lightstep.cpu_quota" // in CPUs; absent if unlimited
+)
+
+// defaultCgroupRoot is where the cgroup filesystem is usually mounted.
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// cpuQuota returns the CPU quota, in CPUs, of the process's cgroup in the
+// hierarchy mounted at cgroupRoot, trying the cgroup v2 cpu.max file and
+// then the v1 CFS files. It returns false if there is no quota or it cannot
+// be determined.
+func cpuQuota(cgroupRoot string) (float64, bool) {
+	if data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			return parseQuota(fields[0], fields[1])
+		}
+		return 0, false
+	}
+	quota, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return parseQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// parseQuota parses a CFS quota and period in microseconds. A quota of
+// "max" (v2) or "-1" (v1) means unlimited.
+func parseQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// updateCPUAttributes refreshes the runtime attributes describing the CPU
+// available to the process, so that reports reflect GOMAXPROCS or cgroup
+// quota changes, e.g. when a container is throttled or resized.
+// caller must hold r.lock
+func (r *Recorder) updateCPUAttributes() {
+	r.setRuntimeAttribute(GOMAXPROCSKey, strconv.Itoa(runtime.GOMAXPROCS(0)))
+	if quota, ok := cpuQuota(r.cgroupRoot); ok {
+		r.setRuntimeAttribute(CPUQuotaKey, strconv.FormatFloat(quota, 'f', -1, 64))
+	} else {
+		delete(r.attributes, CPUQuotaKey)
+	}
+}
+
+// caller must hold r.lock
+func (r *Recorder) setRuntimeAttribute(key, value string) {
+	if old, ok := r.attributes[key]; ok && old != value {
+		r.maybeLogInfof("runtime attribute %s changed from %s to %s", key, old, value)
+	}
+	r.attributes[key] = value
+}
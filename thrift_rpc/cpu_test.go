@@ -0,0 +1,63 @@
+package thrift_rpc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestCPUQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, ok := cpuQuota(dir); ok {
+		t.Errorf("expected no quota without cgroup files")
+	}
+
+	// cgroup v1
+	os.Mkdir(filepath.Join(dir, "cpu"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cpu", "cpu.cfs_quota_us"), []byte("150000\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cpu", "cpu.cfs_period_us"), []byte("100000\n"), 0644)
+	if quota, ok := cpuQuota(dir); !ok || quota != 1.5 {
+		t.Errorf("expected a v1 quota of 1.5 CPUs, got %v", quota)
+	}
+
+	// cgroup v2 takes precedence.
+	cpuMax := filepath.Join(dir, "cpu.max")
+	ioutil.WriteFile(cpuMax, []byte("200000 100000\n"), 0644)
+	if quota, ok := cpuQuota(dir); !ok || quota != 2 {
+		t.Errorf("expected a v2 quota of 2 CPUs, got %v", quota)
+	}
+	ioutil.WriteFile(cpuMax, []byte("max 100000\n"), 0644)
+	if _, ok := cpuQuota(dir); ok {
+		t.Errorf("expected no quota when unlimited")
+	}
+}
+
+func TestReportCPUChanges(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(procs)
+
+	rec, backend := newTestRecorder(Options{ReportCPUChanges: true})
+	rec.lock.Lock()
+	rec.cgroupRoot = os.DevNull
+	rec.lock.Unlock()
+	rec.Flush()
+	value, _ := findAttribute(backend.lastRequest().Runtime.Attrs, GOMAXPROCSKey)
+	if value != strconv.Itoa(procs) {
+		t.Errorf("expected GOMAXPROCS %d, got %q", procs, value)
+	}
+
+	runtime.GOMAXPROCS(procs + 1)
+	rec.Flush()
+	value, _ = findAttribute(backend.lastRequest().Runtime.Attrs, GOMAXPROCSKey)
+	if value != strconv.Itoa(procs+1) {
+		t.Errorf("expected the updated GOMAXPROCS %d, got %q", procs+1, value)
+	}
+}
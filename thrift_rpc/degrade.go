@@ -0,0 +1,81 @@
+package thrift_rpc
+
+import (
+	"sync/atomic"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// Detail is a set of span details that may be shed under load; see
+// DegradationStep.
+type Detail int
+
+const (
+	// DetailLogs sheds every log of the span.
+	DetailLogs Detail = 1 << iota
+
+	// DetailPayloads sheds the payload of each log, keeping its event and
+	// other fields.
+	DetailPayloads
+
+	// DetailTags sheds the tags listed in Options.LowValueTags.
+	DetailTags
+)
+
+// DegradationStep is one rung of Options.DegradationLadder.
+type DegradationStep struct {
+	// Fill is the fraction of MaxBufferedSpans in use, in (0, 1], at or
+	// above which the step applies.
+	Fill float64
+
+	// Shed is the detail removed from spans recorded while the step
+	// applies.
+	Shed Detail
+}
+
+// degrade sheds the detail selected by the degradation ladder for the
+// current buffer fill level from raw.
+// caller must hold r.lock
+func (r *Recorder) degrade(raw *basictracer.RawSpan) {
+	if len(r.degradationLadder) == 0 || r.buffer.cap() == 0 {
+		return
+	}
+	fill := float64(r.buffer.len()) / float64(r.buffer.cap())
+	var shed Detail
+	for _, step := range r.degradationLadder {
+		if fill >= step.Fill {
+			shed |= step.Shed
+		}
+	}
+	if shed == 0 {
+		return
+	}
+
+	// The logs and tags may be shared with the caller; replace rather than
+	// modify them.
+	if shed&DetailLogs != 0 {
+		raw.Logs = nil
+	} else if shed&DetailPayloads != 0 && len(raw.Logs) > 0 {
+		logs := make([]ot.LogRecord, len(raw.Logs))
+		for i, l := range raw.Logs {
+			logs[i] = ot.LogRecord{Timestamp: l.Timestamp}
+			for _, f := range l.Fields {
+				if f.Key() != deprecatedFieldKeyPayload {
+					logs[i].Fields = append(logs[i].Fields, f)
+				}
+			}
+		}
+		raw.Logs = logs
+	}
+	if shed&DetailTags != 0 && len(raw.Tags) > 0 {
+		tags := make(ot.Tags, len(raw.Tags))
+		for key, value := range raw.Tags {
+			if !r.lowValueTags[key] {
+				tags[key] = value
+			}
+		}
+		raw.Tags = tags
+	}
+	atomic.AddInt64(&r.counters.degradedSpans, 1)
+}
@@ -0,0 +1,122 @@
+package thrift_rpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+)
+
+// lookupSRV resolves DNS SRV records. It is a variable so that tests can
+// substitute a fake resolver.
+var lookupSRV = net.LookupSRV
+
+// resolveCollectorSRV looks up Options.CollectorSRV and returns the collector
+// URLs of its targets, most preferred first.
+func (r *Recorder) resolveCollectorSRV() ([]string, error) {
+	_, addrs, err := lookupSRV("", "", r.collectorSRV)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %q", r.collectorSRV)
+	}
+	urls := make([]string, len(addrs))
+	for i, addr := range addrs {
+		urls[i] = getURL(Endpoint{
+			Host:      strings.TrimSuffix(addr.Target, "."),
+			Port:      int(addr.Port),
+			Plaintext: r.collectorPlaintext,
+		}, defaultCollectorHost, r.collectorPath)
+	}
+	return urls, nil
+}
+
+// newBackend returns a ReportingService reporting to collectorURL.
+func (r *Recorder) newBackend(collectorURL string) (lightstep_thrift.ReportingService, error) {
+	transport, err := thrift.NewTHttpPostClientWithClient(collectorURL, r.httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("LightStep Recorder could not create transport: %v", err)
+	}
+	httpTransport := transport.(*thrift.THttpClient)
+	httpTransport.SetHeader("User-Agent", userAgent)
+	for k, v := range r.customHeaders {
+		httpTransport.SetHeader(k, v)
+	}
+	if r.authHeader != "" {
+		httpTransport.SetHeader("Authorization", r.authHeader)
+	}
+	return lightstep_thrift.NewReportingServiceClientFactory(
+		transport, r.protocol.protocolFactory()), nil
+}
+
+// refreshCollector re-resolves Options.CollectorSRV and switches reports to
+// the most preferred target. After a failed report, any target other than
+// the current one is preferred. Caller must hold r.flushLock.
+func (r *Recorder) refreshCollector(failed bool) {
+	urls, err := r.resolveCollectorSRV()
+
+	r.lock.Lock()
+	r.srvResolvedAt = r.clock.Now()
+	current := r.collectorURL
+	r.lock.Unlock()
+
+	if err != nil {
+		r.maybeLogError(fmt.Errorf("could not resolve collector: %v", err))
+		return
+	}
+	next := urls[0]
+	if failed {
+		for _, url := range urls {
+			if url != current {
+				next = url
+				break
+			}
+		}
+	}
+	if next == current {
+		return
+	}
+
+	backend, err := r.newBackend(next)
+	if err != nil {
+		r.maybeLogError(err)
+		return
+	}
+	r.maybeLogInfof("switching collector from %s to %s", current, next)
+	r.lock.Lock()
+	r.backend = backend
+	r.collectorURL = next
+	r.reportFailures = 0
+	r.lock.Unlock()
+}
+
+// reconnect replaces failed, the backend whose reports kept failing, with
+// a new one to the same collector, and closes the idle connections reports
+// were sent over, so that the next report dials afresh. Caller must hold
+// r.flushLock.
+func (r *Recorder) reconnect(failed lightstep_thrift.ReportingService) {
+	r.lock.Lock()
+	url := r.collectorURL
+	replaced := r.backend != failed // e.g. by refreshCollector
+	failures := r.reportFailures
+	r.lock.Unlock()
+	if replaced {
+		return
+	}
+
+	backend, err := r.newBackend(url)
+	if err != nil {
+		r.maybeLogError(err)
+		return
+	}
+	r.maybeLogInfof("reconnecting to %s after %d failed reports", url, failures)
+	r.lock.Lock()
+	r.backend = backend
+	r.reportFailures = 0
+	r.lock.Unlock()
+	closeTransport(failed)
+	r.httpClient.CloseIdleConnections()
+}
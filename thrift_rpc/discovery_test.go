@@ -0,0 +1,184 @@
+package thrift_rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSRVResolver serves SRV lookups from a fixed, replaceable record set.
+type fakeSRVResolver struct {
+	lock    sync.Mutex
+	addrs   []*net.SRV
+	lookups int
+}
+
+func (f *fakeSRVResolver) lookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lookups++
+	return name, f.addrs, nil
+}
+
+func (f *fakeSRVResolver) lookupCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lookups
+}
+
+func srvTarget(e Endpoint) *net.SRV {
+	return &net.SRV{Target: e.Host + ".", Port: uint16(e.Port)}
+}
+
+func TestCollectorSRV(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	// A listener that is closed immediately gives an address with nothing
+	// listening on it.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().(*net.TCPAddr)
+	dead.Close()
+
+	resolver := &fakeSRVResolver{addrs: []*net.SRV{
+		{Target: "127.0.0.1.", Port: uint16(deadAddr.Port)},
+		srvTarget(collector.endpoint()),
+	}}
+	lookupSRV = resolver.lookupSRV
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	rec := NewRecorder(Options{
+		AccessToken:      "0987654321",
+		MaxLogMessageLen: 1024,
+		CollectorSRV:     "_lightstep._tcp.collectors.example.com",
+		Collector:        Endpoint{Plaintext: true},
+	})
+	rec.lock.Lock()
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	// The first report goes to the unreachable, most preferred target and
+	// fails, causing the record to be re-resolved.
+	rec.RecordSpan(makeRawSpan("first", nil))
+	rec.Flush()
+	if collector.backend.requestCount() != 0 {
+		t.Fatalf("expected the first report to go to the dead target")
+	}
+	if lookups := resolver.lookupCount(); lookups != 2 {
+		t.Errorf("expected the record to be re-resolved after a failure, got %d lookups", lookups)
+	}
+
+	// The retried span reaches the other target.
+	rec.Flush()
+	req := collector.backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != "first" {
+		t.Fatalf("expected the retried span at the resolved collector, got %v", req)
+	}
+}
+
+func TestCollectorSRVRefresh(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+	resolver := &fakeSRVResolver{addrs: []*net.SRV{srvTarget(collector.endpoint())}}
+	lookupSRV = resolver.lookupSRV
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	clk := newFakeClock()
+	rec := NewRecorder(Options{
+		AccessToken:  "0987654321",
+		CollectorSRV: "_lightstep._tcp.collectors.example.com",
+		Collector:    Endpoint{Plaintext: true},
+		clock:        clk,
+	})
+	defer rec.Close()
+	rec.Flush()
+	if lookups := resolver.lookupCount(); lookups != 1 {
+		t.Errorf("expected no refresh before the interval, got %d lookups", lookups)
+	}
+	clk.advance(srvRefreshInterval)
+	rec.Flush()
+	if lookups := resolver.lookupCount(); lookups != 2 {
+		t.Errorf("expected a refresh once the interval elapsed, got %d lookups", lookups)
+	}
+}
+
+func TestCollectorSRVNoRecords(t *testing.T) {
+	lookupSRV = (&fakeSRVResolver{}).lookupSRV
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	_, err := NewRecorderE(Options{
+		AccessToken:  "0987654321",
+		CollectorSRV: "_lightstep._tcp.collectors.example.com",
+	})
+	if err == nil {
+		t.Errorf("expected an error when the SRV record has no targets")
+	}
+}
+
+func TestReconnectAfterFailures(t *testing.T) {
+	first := newTestCollector()
+	replacement := newTestCollector()
+	defer replacement.Close()
+
+	// Dials go wherever addr says, as if the collector's name had been
+	// pointed at the replacement after a failover.
+	var lock sync.Mutex
+	addr := first.Listener.Addr().String()
+	var dialer net.Dialer
+	rec := NewRecorder(Options{
+		AccessToken:            "0987654321",
+		Collector:              first.endpoint(),
+		ReconnectAfterFailures: 2,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			lock.Lock()
+			target := addr
+			lock.Unlock()
+			return dialer.DialContext(ctx, network, target)
+		},
+	})
+	defer rec.Close()
+	rec.RecordSpan(makeRawSpan("first", nil))
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected report error: %v", err)
+	}
+	rec.lock.Lock()
+	original := rec.backend
+	rec.lock.Unlock()
+
+	first.Close()
+	rec.RecordSpan(makeRawSpan("retried", nil))
+	if err := rec.Flush(); err == nil {
+		t.Fatal("expected the report to the dead collector to fail")
+	}
+	rec.lock.Lock()
+	kept := rec.backend == original
+	rec.lock.Unlock()
+	if !kept {
+		t.Error("expected the backend to be kept after one failure")
+	}
+	if err := rec.Flush(); err == nil {
+		t.Fatal("expected the report to the dead collector to fail")
+	}
+	rec.lock.Lock()
+	replaced := rec.backend != original
+	rec.lock.Unlock()
+	if !replaced {
+		t.Fatal("expected the backend to be rebuilt after two failures in a row")
+	}
+
+	lock.Lock()
+	addr = replacement.Listener.Addr().String()
+	lock.Unlock()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected report error after reconnecting: %v", err)
+	}
+	req := replacement.backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != "retried" {
+		t.Errorf("expected the retried span at the replacement collector, got %v", req)
+	}
+}
@@ -0,0 +1,79 @@
+package thrift_rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/opentracing/basictracer-go"
+)
+
+// dumpedSpan is the JSON rendering of a buffered span used by DumpBuffer.
+type dumpedSpan struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Operation    string                 `json:"operation"`
+	Start        time.Time              `json:"start"`
+	Duration     string                 `json:"duration"`
+	Tags         map[string]interface{} `json:"tags,omitempty"`
+	Baggage      map[string]string      `json:"baggage,omitempty"`
+	Logs         []dumpedLog            `json:"logs,omitempty"`
+}
+
+type dumpedLog struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// DumpBuffer renders the spans buffered for the next report as indented
+// JSON, without flushing them. It is intended for debugging spans that do
+// not appear to be reported.
+func (r *Recorder) DumpBuffer() ([]byte, error) {
+	r.lock.Lock()
+	rawSpans := r.buffer.current()
+	r.lock.Unlock()
+
+	spans := make([]dumpedSpan, len(rawSpans))
+	for i, raw := range rawSpans {
+		spans[i] = dumpSpan(raw)
+	}
+	return json.MarshalIndent(spans, "", "  ")
+}
+
+func dumpSpan(raw basictracer.RawSpan) dumpedSpan {
+	span := dumpedSpan{
+		TraceID:   formatIDHex(raw.Context.TraceID),
+		SpanID:    formatIDHex(raw.Context.SpanID),
+		Operation: raw.Operation,
+		Start:     raw.Start,
+		Duration:  raw.Duration.String(),
+		Baggage:   raw.Context.Baggage,
+	}
+	if raw.ParentSpanID != 0 {
+		span.ParentSpanID = formatIDHex(raw.ParentSpanID)
+	}
+	if len(raw.Tags) > 0 {
+		span.Tags = make(map[string]interface{}, len(raw.Tags))
+		for k, v := range raw.Tags {
+			span.Tags[k] = dumpValue(v)
+		}
+	}
+	for _, log := range raw.Logs {
+		fields := make(map[string]interface{}, len(log.Fields))
+		for _, f := range log.Fields {
+			fields[f.Key()] = dumpValue(f.Value())
+		}
+		span.Logs = append(span.Logs, dumpedLog{Timestamp: log.Timestamp, Fields: fields})
+	}
+	return span
+}
+
+// dumpValue returns v if it can be JSON encoded and its fmt.Sprint
+// representation otherwise.
+func dumpValue(v interface{}) interface{} {
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
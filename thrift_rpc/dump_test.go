@@ -0,0 +1,54 @@
+package thrift_rpc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+func TestDumpBuffer(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+
+	first := makeRawSpan("first", ot.Tags{"db.instance": "users", "callback": func() {}})
+	first.Logs = []ot.LogRecord{{
+		Timestamp: time.Now(),
+		Fields:    []log.Field{log.String("event", "cache miss"), log.Int("attempt", 2)},
+	}}
+	rec.RecordSpan(first)
+	rec.RecordSpan(makeRawSpan("second", nil))
+
+	data, err := rec.DumpBuffer()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backend.requestCount() != 0 {
+		t.Errorf("DumpBuffer should not report spans")
+	}
+	if rec.buffer.len() != 2 {
+		t.Errorf("DumpBuffer should leave the buffer intact")
+	}
+
+	var spans []dumpedSpan
+	if err := json.Unmarshal(data, &spans); err != nil {
+		t.Fatalf("could not decode dump %s: %v", data, err)
+	}
+	if len(spans) != 2 || spans[0].Operation != "first" || spans[1].Operation != "second" {
+		t.Fatalf("unexpected spans in dump %s", data)
+	}
+	if spans[0].SpanID != formatIDHex(first.Context.SpanID) {
+		t.Errorf("unexpected span id %q", spans[0].SpanID)
+	}
+	if spans[0].Tags["db.instance"] != "users" {
+		t.Errorf("unexpected tags %v", spans[0].Tags)
+	}
+	if _, ok := spans[0].Tags["callback"].(string); !ok {
+		t.Errorf("expected the func tag to be rendered as a string, got %v", spans[0].Tags["callback"])
+	}
+	if len(spans[0].Logs) != 1 || spans[0].Logs[0].Fields["event"] != "cache miss" ||
+		spans[0].Logs[0].Fields["attempt"] != float64(2) {
+		t.Errorf("unexpected logs %v", spans[0].Logs)
+	}
+}
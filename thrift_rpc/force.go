@@ -0,0 +1,30 @@
+package thrift_rpc
+
+import (
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// ForceRecordKey is the tag and baggage key marking a trace to be recorded
+// regardless of Options.TraceSamplingRate. See ForceRecord.
+const ForceRecordKey = "lightstep.force_record"
+
+// ForceRecord forces the trace containing span to be recorded whatever the
+// sampling decision, e.g. to capture a specific failing request on demand.
+// The override is carried in baggage, so it applies to spans subsequently
+// started from span's context, including in other processes.
+func ForceRecord(span ot.Span) {
+	ext.SamplingPriority.Set(span, 1)
+	span.SetTag(ForceRecordKey, true)
+	span.SetBaggageItem(ForceRecordKey, "true")
+}
+
+// IsForceRecorded reports whether raw belongs to a trace marked by
+// ForceRecord.
+func IsForceRecorded(raw *basictracer.RawSpan) bool {
+	if forced, ok := raw.Tags[ForceRecordKey].(bool); ok && forced {
+		return true
+	}
+	return raw.Context.Baggage[ForceRecordKey] == "true"
+}
@@ -0,0 +1,42 @@
+package thrift_rpc
+
+import (
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// SpanLinksKey is the tag key under which SetSpanLinks records a span's
+// links. Each link is reported as a separate SpanLinksKey attribute whose
+// value is "<trace guid>:<span guid>".
+const SpanLinksKey = "lightstep.span_link"
+
+// SpanLink identifies a span, usually in another trace, that is related to
+// the tagged span without being its parent; e.g. each of the requests that
+// contributed to a batch.
+type SpanLink struct {
+	TraceID uint64
+	SpanID  uint64
+}
+
+// SetSpanLinks links span to the spans identified by linked, replacing any
+// links set previously. Contexts not created by a LightStep tracer are
+// ignored.
+func SetSpanLinks(span ot.Span, linked ...ot.SpanContext) {
+	links := make([]SpanLink, 0, len(linked))
+	for _, ctx := range linked {
+		if sc, ok := ctx.(basictracer.SpanContext); ok {
+			links = append(links, SpanLink{TraceID: sc.TraceID, SpanID: sc.SpanID})
+		}
+	}
+	span.SetTag(SpanLinksKey, links)
+}
+
+// appendSpanLinks appends an attribute for each link to attributes.
+func (r *Recorder) appendSpanLinks(attributes []*lightstep_thrift.KeyValue, links []SpanLink) []*lightstep_thrift.KeyValue {
+	for _, link := range links {
+		attributes = append(attributes, &lightstep_thrift.KeyValue{SpanLinksKey,
+			r.formatID(link.TraceID) + ":" + r.formatID(link.SpanID)})
+	}
+	return attributes
+}
@@ -3,6 +3,10 @@ package thrift_rpc
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
 	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
@@ -13,12 +17,41 @@ const (
 	deprecatedFieldKeyEvent   = "event"
 	deprecatedFieldKeyPayload = "payload"
 	ellipsis                  = "…"
+
+	payloadQuotaExceeded = "<payload dropped: report payload quota exceeded>"
+
+	fieldKeyLevel    = "level"
+	fieldKeySeverity = "severity"
+	fieldKeyError    = "error"
+
+	// Log levels understood by the collector.
+	logLevelDebug = "D"
+	logLevelInfo  = "I"
+	logLevelWarn  = "W"
+	logLevelError = "E"
+	logLevelFatal = "F"
 )
 
+// logLevels maps common spellings of log severities to collector levels.
+var logLevels = map[string]string{
+	"debug":    logLevelDebug,
+	"trace":    logLevelDebug,
+	"info":     logLevelInfo,
+	"notice":   logLevelInfo,
+	"warn":     logLevelWarn,
+	"warning":  logLevelWarn,
+	"error":    logLevelError,
+	"err":      logLevelError,
+	"fatal":    logLevelFatal,
+	"critical": logLevelFatal,
+	"panic":    logLevelFatal,
+}
+
 // thrift_rpc.logFieldEncoder is an implementation of the log.Encoder interface
-// that handles only the deprecated OpenTracing
-// Span.LogEvent/LogEventWithPayload calls. (Since the thrift client is being
-// phased out anyway)
+// for the thrift LogRecord. The deprecated OpenTracing event and payload
+// fields (from Span.LogEvent/LogEventWithPayload) populate StableName and
+// PayloadJson, severity conventions populate Level, and every other field is
+// added to Fields as a string, truncated to MaxLogMessageLen.
 type logFieldEncoder struct {
 	logRecord *lightstep_thrift.LogRecord
 	recorder  *Recorder
@@ -27,34 +60,157 @@ type logFieldEncoder struct {
 func (lfe *logFieldEncoder) EmitString(key, value string) {
 	if key == deprecatedFieldKeyEvent {
 		if len(value) > lfe.recorder.maxLogMessageLen {
-			value = value[:(lfe.recorder.maxLogMessageLen-1)] + ellipsis
+			value = lfe.recorder.truncateLog(value, false)
 		}
 		lfe.logRecord.StableName = thrift.StringPtr(value)
+		// OpenTracing's convention for error logs is event="error".
+		if value == fieldKeyError {
+			lfe.impliedLevel(logLevelError)
+		}
+		return
 	}
+	// log.Error(err) calls EmitString under the "error" key with
+	// err.Error(), or "<nil>" for a nil error; either implies the error
+	// level. Any other string logged under that key does too.
+	if key == fieldKeyError {
+		lfe.impliedLevel(logLevelError)
+	}
+	if key == fieldKeyLevel || key == fieldKeySeverity {
+		if level, ok := logLevels[strings.ToLower(value)]; ok {
+			lfe.setLevel(level)
+		}
+	}
+	lfe.addField(key, value)
 }
 func (lfe *logFieldEncoder) EmitObject(key string, value interface{}) {
 	if key == deprecatedFieldKeyPayload {
-		var thriftPayload string
-		jsonString, err := json.Marshal(value)
-		if err != nil {
-			thriftPayload = fmt.Sprintf("Error encoding payload object: %v", err)
-		} else {
-			thriftPayload = string(jsonString)
-		}
-		if len(thriftPayload) > lfe.recorder.maxLogMessageLen {
-			thriftPayload = thriftPayload[:(lfe.recorder.maxLogMessageLen-1)] + ellipsis
-		}
-		lfe.logRecord.PayloadJson = thrift.StringPtr(thriftPayload)
+		lfe.logRecord.PayloadJson = thrift.StringPtr(lfe.encodePayload(value))
+		return
+	}
+	if key == fieldKeyError && value != nil {
+		lfe.impliedLevel(logLevelError)
+	}
+	lfe.addField(key, lfe.encodePayload(value))
+}
+func (lfe *logFieldEncoder) EmitBool(key string, value bool) {
+	if key == fieldKeyError && value {
+		lfe.impliedLevel(logLevelError)
+	}
+	lfe.addField(key, strconv.FormatBool(value))
+}
+func (lfe *logFieldEncoder) EmitInt(key string, value int) {
+	lfe.addField(key, strconv.Itoa(value))
+}
+func (lfe *logFieldEncoder) EmitInt32(key string, value int32) {
+	lfe.addField(key, strconv.FormatInt(int64(value), 10))
+}
+func (lfe *logFieldEncoder) EmitInt64(key string, value int64) {
+	lfe.addField(key, strconv.FormatInt(value, 10))
+}
+func (lfe *logFieldEncoder) EmitUint32(key string, value uint32) {
+	lfe.addField(key, strconv.FormatUint(uint64(value), 10))
+}
+func (lfe *logFieldEncoder) EmitUint64(key string, value uint64) {
+	lfe.addField(key, strconv.FormatUint(value, 10))
+}
+func (lfe *logFieldEncoder) EmitFloat32(key string, value float32) {
+	lfe.addField(key, formatTagValue(value))
+}
+func (lfe *logFieldEncoder) EmitFloat64(key string, value float64) {
+	lfe.addField(key, formatTagValue(value))
+}
+func (lfe *logFieldEncoder) EmitLazyLogger(value log.LazyLogger) {
+	value(lfe)
+}
+
+// addField adds a structured field to the log record.
+func (lfe *logFieldEncoder) addField(key, value string) {
+	if len(value) > lfe.recorder.maxLogMessageLen {
+		value = lfe.recorder.truncateLog(value, false)
+	}
+	lfe.logRecord.Fields = append(lfe.logRecord.Fields, &lightstep_thrift.KeyValue{key, value})
+}
+
+// encodePayload JSON encodes an object logged as a payload or field,
+// truncated to MaxLogMessageLen and counted against the report's payload
+// quota. Once the quota is spent, value is not encoded and a placeholder is
+// returned instead.
+func (lfe *logFieldEncoder) encodePayload(value interface{}) string {
+	r := lfe.recorder
+	if r.payloadQuotaBytes > 0 && r.reportPayloadBytes >= r.payloadQuotaBytes {
+		// Don't even encode the payload once the quota is spent.
+		atomic.AddInt64(&r.counters.droppedPayloads, 1)
+		return payloadQuotaExceeded
+	}
+	var thriftPayload string
+	jsonString, err := json.Marshal(value)
+	if err != nil {
+		thriftPayload = fmt.Sprintf("Error encoding payload object: %v", err)
+	} else {
+		thriftPayload = string(jsonString)
+	}
+	if len(thriftPayload) > r.maxLogMessageLen {
+		thriftPayload = r.truncateLog(thriftPayload, true)
+	}
+	r.reportPayloadBytes += len(thriftPayload)
+	return thriftPayload
+}
+
+// setLevel records an explicitly logged level, overriding any implied one.
+func (lfe *logFieldEncoder) setLevel(level string) {
+	lfe.logRecord.Level = thrift.StringPtr(level)
+	isError := level == logLevelError || level == logLevelFatal
+	lfe.logRecord.ErrorFlag = thrift.BoolPtr(isError)
+}
+
+// impliedLevel records a level inferred from other fields, unless a level
+// has already been set.
+func (lfe *logFieldEncoder) impliedLevel(level string) {
+	if lfe.logRecord.Level == nil {
+		lfe.setLevel(level)
 	}
 }
 
-// All other log.Encoder methods do nothing in the thrift_rpc implementation.
-func (lfe *logFieldEncoder) EmitBool(key string, value bool)       {}
-func (lfe *logFieldEncoder) EmitInt(key string, value int)         {}
-func (lfe *logFieldEncoder) EmitInt32(key string, value int32)     {}
-func (lfe *logFieldEncoder) EmitInt64(key string, value int64)     {}
-func (lfe *logFieldEncoder) EmitUint32(key string, value uint32)   {}
-func (lfe *logFieldEncoder) EmitUint64(key string, value uint64)   {}
-func (lfe *logFieldEncoder) EmitFloat32(key string, value float32) {}
-func (lfe *logFieldEncoder) EmitFloat64(key string, value float64) {}
-func (lfe *logFieldEncoder) EmitLazyLogger(value log.LazyLogger)   {}
+// truncate shortens s to at most maxLen bytes, including the truncation
+// marker, which is left out if omitted or if it would not fit. s is cut at
+// a rune boundary, so valid UTF-8 stays valid.
+func (r *Recorder) truncate(s string, maxLen int) string {
+	cut, marker := r.truncation(s, maxLen)
+	return s[:cut] + marker
+}
+
+// truncation returns the length of the prefix of s that truncate keeps, and
+// the marker it appends.
+func (r *Recorder) truncation(s string, maxLen int) (cut int, marker string) {
+	marker = r.truncationMarker
+	if marker == "" {
+		marker = ellipsis
+	}
+	if r.omitTruncation || len(marker) >= maxLen {
+		marker = ""
+	}
+	cut = maxLen - len(marker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return cut, marker
+}
+
+// truncateLog truncates s, a log message or field, or a payload if payload
+// is set, to MaxLogMessageLen, counting it and the bytes cut from it both
+// in the reported counters and in Stats.
+// caller must hold r.lock
+func (r *Recorder) truncateLog(s string, payload bool) string {
+	cut, marker := r.truncation(s, r.maxLogMessageLen)
+	if payload {
+		atomic.AddInt64(&r.counters.truncatedPayloads, 1)
+		r.payloadsTruncated++
+	} else {
+		atomic.AddInt64(&r.counters.truncatedLogs, 1)
+		r.logsTruncated++
+	}
+	dropped := int64(len(s) - cut)
+	atomic.AddInt64(&r.counters.truncatedBytes, dropped)
+	r.bytesTruncated += dropped
+	return s[:cut] + marker
+}
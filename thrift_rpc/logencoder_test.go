@@ -0,0 +1,308 @@
+package thrift_rpc
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+func encodeLogFields(rec *Recorder, fields ...log.Field) *lightstep_thrift.LogRecord {
+	logRecord := &lightstep_thrift.LogRecord{}
+	lfe := logFieldEncoder{logRecord, rec}
+	for _, f := range fields {
+		f.Marshal(&lfe)
+	}
+	return logRecord
+}
+
+func TestLogLevels(t *testing.T) {
+	rec := &Recorder{maxLogMessageLen: 100}
+	tests := []struct {
+		fields  []log.Field
+		level   string
+		isError bool
+	}{
+		{[]log.Field{log.String("level", "debug")}, logLevelDebug, false},
+		{[]log.Field{log.String("level", "INFO")}, logLevelInfo, false},
+		{[]log.Field{log.String("severity", "warning")}, logLevelWarn, false},
+		{[]log.Field{log.String("level", "error")}, logLevelError, true},
+		{[]log.Field{log.String("level", "fatal")}, logLevelFatal, true},
+		{[]log.Field{log.String("event", "error")}, logLevelError, true},
+		{[]log.Field{log.Error(errors.New("boom"))}, logLevelError, true},
+		{[]log.Field{log.Bool("error", true)}, logLevelError, true},
+		// An explicit level wins over an implied one.
+		{[]log.Field{log.String("event", "error"), log.String("level", "warn")}, logLevelWarn, false},
+		{[]log.Field{log.String("level", "warn"), log.Bool("error", true)}, logLevelWarn, false},
+	}
+	for i, test := range tests {
+		logRecord := encodeLogFields(rec, test.fields...)
+		if logRecord.GetLevel() != test.level {
+			t.Errorf("case %d: expected level %q, got %q", i, test.level, logRecord.GetLevel())
+		}
+		if logRecord.GetErrorFlag() != test.isError {
+			t.Errorf("case %d: expected error flag %v", i, test.isError)
+		}
+	}
+
+	for _, fields := range [][]log.Field{
+		{log.String("event", "hello")},
+		{log.String("level", "bogus")},
+		{log.Bool("error", false)},
+	} {
+		if logRecord := encodeLogFields(rec, fields...); logRecord.Level != nil {
+			t.Errorf("expected no level for %v, got %q", fields, logRecord.GetLevel())
+		}
+	}
+}
+
+func TestLogLevelsReported(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxLogMessageLen: 100})
+	raw := makeRawSpan("op", nil)
+	raw.Logs = []ot.LogRecord{
+		{Timestamp: time.Now(), Fields: []log.Field{log.String("event", "starting"), log.String("level", "info")}},
+		{Timestamp: time.Now(), Fields: []log.Field{log.Error(errors.New("boom"))}},
+	}
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	logs := backend.lastRequest().SpanRecords[0].LogRecords
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 logs, got %d", len(logs))
+	}
+	if logs[0].GetLevel() != logLevelInfo || logs[1].GetLevel() != logLevelError {
+		t.Errorf("unexpected levels %q, %q", logs[0].GetLevel(), logs[1].GetLevel())
+	}
+}
+
+func TestTruncationMarker(t *testing.T) {
+	rec := &Recorder{maxLogMessageLen: 10, truncationMarker: "[cut]"}
+	logRecord := encodeLogFields(rec,
+		log.String("event", "a rather long event name"),
+		log.Object("payload", "a rather long payload"))
+	if name := logRecord.GetStableName(); name != "a rat[cut]" {
+		t.Errorf("unexpected truncated event %q", name)
+	}
+	if payload := logRecord.GetPayloadJson(); payload != `"a ra[cut]` {
+		t.Errorf("unexpected truncated payload %q", payload)
+	}
+
+	// The ellipsis is the default.
+	rec.truncationMarker = ""
+	logRecord = encodeLogFields(rec, log.String("event", "a rather long event name"))
+	if name := logRecord.GetStableName(); name != "a rathe…" {
+		t.Errorf("unexpected truncated event %q", name)
+	}
+
+	rec.omitTruncation = true
+	logRecord = encodeLogFields(rec, log.String("event", "a rather long event name"))
+	if name := logRecord.GetStableName(); name != "a rather l" {
+		t.Errorf("unexpected truncated event %q", name)
+	}
+}
+
+func TestTruncateLimit(t *testing.T) {
+	for _, test := range []struct {
+		marker   string
+		maxLen   int
+		expected string
+	}{
+		{"", 4, "a…"},
+		{"", 3, "abc"}, // the ellipsis alone would fill the limit
+		{"[cut]", 6, "a[cut]"},
+		{"[cut]", 5, "abcde"},
+		{".", 1, "a"},
+	} {
+		rec := &Recorder{truncationMarker: test.marker}
+		got := rec.truncate("abcdefghij", test.maxLen)
+		if got != test.expected {
+			t.Errorf("marker %q, limit %d: expected %q, got %q", test.marker, test.maxLen, test.expected, got)
+		}
+		if len(got) > test.maxLen {
+			t.Errorf("marker %q: %q exceeds the limit of %d bytes", test.marker, got, test.maxLen)
+		}
+	}
+}
+
+func TestTruncateRuneBoundary(t *testing.T) {
+	// "日本語" is three 3-byte runes and "😀😀" two 4-byte runes, so every
+	// limit below cuts into a rune.
+	for _, test := range []struct {
+		s        string
+		maxLen   int
+		expected string
+	}{
+		{"日本語テキスト", 7, "日…"},
+		{"日本語テキスト", 8, "日…"},
+		{"日本語テキスト", 9, "日本…"},
+		{"ab😀😀", 8, "ab…"},
+		{"ab😀😀", 9, "ab😀…"},
+		{"😀😀", 5, "…"},
+	} {
+		rec := &Recorder{}
+		got := rec.truncate(test.s, test.maxLen)
+		if got != test.expected {
+			t.Errorf("%q to %d bytes: expected %q, got %q", test.s, test.maxLen, test.expected, got)
+		}
+		if !utf8.ValidString(got) || len(got) > test.maxLen {
+			t.Errorf("%q to %d bytes: got %q, which is invalid or too long", test.s, test.maxLen, got)
+		}
+	}
+
+	rec := &Recorder{omitTruncation: true}
+	if got := rec.truncate("日本語", 5); got != "日" {
+		t.Errorf("expected %q without a marker, got %q", "日", got)
+	}
+}
+
+func TestTruncatedLogEventIsValidUTF8(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxLogMessageLen: 10})
+	raw := makeRawSpan("op", nil)
+	raw.Logs = []ot.LogRecord{{Timestamp: time.Now(), Fields: []log.Field{
+		log.String("event", "ログメッセージ"),
+		log.String("message", "👋 hello 👋 world"),
+	}}}
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	logRecord := backend.lastRequest().SpanRecords[0].LogRecords[0]
+	if name := logRecord.GetStableName(); name != "ログ…" {
+		t.Errorf("unexpected truncated event %q", name)
+	}
+	for _, kv := range logRecord.Fields {
+		if !utf8.ValidString(kv.Value) || len(kv.Value) > 10 {
+			t.Errorf("field %s: %q is invalid or too long", kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestPerRecorderTruncation(t *testing.T) {
+	// Limits come from each Recorder's Options, not process-wide state, so
+	// two Recorders in one process truncate independently.
+	const event = "an event name longer than both limits"
+	short, shortBackend := newTestRecorder(Options{MaxLogMessageLen: 10})
+	long, longBackend := newTestRecorder(Options{MaxLogMessageLen: 20})
+	for _, rec := range []*Recorder{short, long} {
+		raw := makeRawSpan("op", nil)
+		raw.Logs = []ot.LogRecord{{Timestamp: time.Now(), Fields: []log.Field{log.String("event", event)}}}
+		rec.RecordSpan(raw)
+		rec.Flush()
+	}
+
+	for _, test := range []struct {
+		backend *mockReportingService
+		max     int
+	}{{shortBackend, 10}, {longBackend, 20}} {
+		name := test.backend.lastRequest().SpanRecords[0].LogRecords[0].GetStableName()
+		if len(name) != test.max {
+			t.Errorf("expected %q truncated to %d bytes, got %q", event, test.max, name)
+		}
+	}
+}
+
+func TestStructuredLogFields(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxLogMessageLen: 20})
+	raw := makeRawSpan("op", nil)
+	raw.Logs = []ot.LogRecord{{Timestamp: time.Now(), Fields: []log.Field{
+		log.String("event", "x"),
+		log.Int("n", 3),
+		log.Int64("big", -1<<40),
+		log.Uint32("u", 7),
+		log.Float64("ratio", 0.0000025),
+		log.Bool("cached", false),
+		log.Object("request", map[string]int{"id": 1}),
+		log.String("message", "a message longer than the limit"),
+		log.Lazy(func(fv log.Encoder) { fv.EmitString("lazy", "yes") }),
+	}}}
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	logRecord := backend.lastRequest().SpanRecords[0].LogRecords[0]
+	if name := logRecord.GetStableName(); name != "x" {
+		t.Errorf("expected the event as the stable name, got %q", name)
+	}
+	fields := make(map[string]string, len(logRecord.Fields))
+	for _, kv := range logRecord.Fields {
+		fields[kv.Key] = kv.Value
+	}
+	expected := map[string]string{
+		"n":       "3",
+		"big":     "-1099511627776",
+		"u":       "7",
+		"ratio":   "0.0000025",
+		"cached":  "false",
+		"request": `{"id":1}`,
+		"message": "a message longer …",
+		"lazy":    "yes",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected fields %v, got %v", expected, fields)
+	}
+}
+
+func TestStructuredLogFieldsPayloadQuota(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxLogMessageLen: 100, ReportPayloadQuotaBytes: 5})
+	raw := makeRawSpan("op", nil)
+	raw.Logs = []ot.LogRecord{{Timestamp: time.Now(), Fields: []log.Field{
+		log.Object("first", []int{1, 2, 3}),
+		log.Object("second", []int{4, 5, 6}),
+	}}}
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	fields := req.SpanRecords[0].LogRecords[0].Fields
+	if len(fields) != 2 || fields[0].Value != "[1,2,3]" || fields[1].Value != payloadQuotaExceeded {
+		t.Errorf("expected the second object to exceed the payload quota, got %v", fields)
+	}
+	if got := findMetric(req, "payloads.dropped"); got != 1 {
+		t.Errorf("expected 1 dropped payload, got %d", got)
+	}
+}
+
+func TestTruncationCounters(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxLogMessageLen: 10, OmitTruncationMarker: true})
+	raw := makeRawSpan("op", nil)
+	raw.Logs = []ot.LogRecord{{Timestamp: time.Now(), Fields: []log.Field{
+		log.String("event", strings.Repeat("e", 30)),
+		log.String("message", strings.Repeat("m", 25)),
+		log.String("short", "fits"),
+		log.Object("payload", strings.Repeat("p", 20)), // 22 bytes of JSON
+	}}}
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	for _, test := range []struct {
+		metric string
+		count  int64
+	}{
+		{"logs.truncated", 2},
+		{"payloads.truncated", 1},
+		{"bytes.truncated", 20 + 15 + 12},
+	} {
+		if n := findMetric(req, test.metric); n != test.count {
+			t.Errorf("expected %s to be %d, got %d", test.metric, test.count, n)
+		}
+	}
+	stats := rec.Stats()
+	if stats.TruncatedLogs != 2 || stats.TruncatedPayloads != 1 || stats.TruncatedBytes != 47 {
+		t.Errorf("expected 2 logs, 1 payload and 47 bytes truncated, got %+v", stats)
+	}
+
+	// The reported counts are reset by each report, but Stats accumulate.
+	rec.RecordSpan(raw)
+	rec.Flush()
+	if n := findMetric(backend.lastRequest(), "logs.truncated"); n != 2 {
+		t.Errorf("expected 2 logs truncated in the second report, got %d", n)
+	}
+	if n := rec.Stats().TruncatedLogs; n != 4 {
+		t.Errorf("expected 4 logs truncated in all, got %d", n)
+	}
+}
@@ -0,0 +1,76 @@
+package thrift_rpc
+
+import (
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// SamplingPriority returns the value of raw's ext.SamplingPriority tag, and
+// whether it has one. A priority of zero drops the span from reporting;
+// a positive priority records it whatever the sampling decision, and keeps
+// it even when the buffer is full.
+func SamplingPriority(raw *basictracer.RawSpan) (priority int64, ok bool) {
+	switch v := raw.Tags[string(ext.SamplingPriority)].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// prioritySpan keeps the ext.SamplingPriority tag in its span's tags.
+// basictracer applies a uint16 priority, the type ext.SamplingPriority.Set
+// uses, to the span's Sampled flag and discards the tag, leaving the
+// Recorder unable to tell an explicit priority from the sampling decision.
+type prioritySpan struct {
+	basictracer.Span
+}
+
+func (s *prioritySpan) SetTag(key string, value interface{}) ot.Span {
+	v, ok := value.(uint16)
+	if key != string(ext.SamplingPriority) || !ok {
+		s.Span.SetTag(key, value)
+		return s
+	}
+	// An unsampled span discards tags under TrimUnsampledSpans, so the tag
+	// is stored while the span is still sampled.
+	if v == 0 {
+		s.Span.SetTag(key, int(v))
+		s.Span.SetTag(key, v)
+	} else {
+		s.Span.SetTag(key, v)
+		s.Span.SetTag(key, int(v))
+	}
+	return s
+}
+
+// The following return the prioritySpan itself so that chained calls such
+// as span.SetOperationName(n).SetTag(k, v) still keep the priority.
+
+func (s *prioritySpan) SetOperationName(operationName string) ot.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s *prioritySpan) SetBaggageItem(key, val string) ot.Span {
+	s.Span.SetBaggageItem(key, val)
+	return s
+}
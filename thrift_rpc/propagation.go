@@ -0,0 +1,99 @@
+package thrift_rpc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// The keys under which Inject and Extract propagate span contexts through
+// opentracing.TextMap and opentracing.HTTPHeaders carriers. They are the
+// headers understood by LightStep's tracers for other languages: IDs are
+// hex encoded, and each baggage item is carried under BaggageHeaderPrefix
+// followed by its key. Keys are matched case-insensitively when extracting.
+const (
+	TraceIDHeader       = "ot-tracer-traceid"
+	SpanIDHeader        = "ot-tracer-spanid"
+	SampledHeader       = "ot-tracer-sampled"
+	BaggageHeaderPrefix = "ot-baggage-"
+)
+
+func (t *referenceTracer) Inject(sc ot.SpanContext, format interface{}, carrier interface{}) error {
+	switch format {
+	case ot.TextMap, ot.HTTPHeaders:
+		return injectTextMap(sc, carrier)
+	}
+	return t.Tracer.Inject(sc, format, carrier)
+}
+
+func (t *referenceTracer) Extract(format interface{}, carrier interface{}) (ot.SpanContext, error) {
+	switch format {
+	case ot.TextMap, ot.HTTPHeaders:
+		return extractTextMap(carrier)
+	}
+	return t.Tracer.Extract(format, carrier)
+}
+
+func injectTextMap(spanContext ot.SpanContext, opaqueCarrier interface{}) error {
+	sc, ok := spanContext.(basictracer.SpanContext)
+	if !ok {
+		return ot.ErrInvalidSpanContext
+	}
+	carrier, ok := opaqueCarrier.(ot.TextMapWriter)
+	if !ok {
+		return ot.ErrInvalidCarrier
+	}
+	carrier.Set(TraceIDHeader, strconv.FormatUint(sc.TraceID, 16))
+	carrier.Set(SpanIDHeader, strconv.FormatUint(sc.SpanID, 16))
+	carrier.Set(SampledHeader, strconv.FormatBool(sc.Sampled))
+	for k, v := range sc.Baggage {
+		carrier.Set(BaggageHeaderPrefix+k, v)
+	}
+	return nil
+}
+
+// extractTextMap is the inverse of injectTextMap. Unlike basictracer's
+// own propagator it does not require SampledHeader, which some of
+// LightStep's tracers omit; a context without it is sampled.
+func extractTextMap(opaqueCarrier interface{}) (ot.SpanContext, error) {
+	carrier, ok := opaqueCarrier.(ot.TextMapReader)
+	if !ok {
+		return nil, ot.ErrInvalidCarrier
+	}
+	sc := basictracer.SpanContext{Sampled: true, Baggage: map[string]string{}}
+	var foundTraceID, foundSpanID, foundSampled bool
+	err := carrier.ForeachKey(func(k, v string) error {
+		var err error
+		switch k = strings.ToLower(k); k {
+		case TraceIDHeader:
+			sc.TraceID, err = strconv.ParseUint(v, 16, 64)
+			foundTraceID = true
+		case SpanIDHeader:
+			sc.SpanID, err = strconv.ParseUint(v, 16, 64)
+			foundSpanID = true
+		case SampledHeader:
+			sc.Sampled, err = strconv.ParseBool(v)
+			foundSampled = true
+		default:
+			if strings.HasPrefix(k, BaggageHeaderPrefix) {
+				sc.Baggage[strings.TrimPrefix(k, BaggageHeaderPrefix)] = v
+			}
+		}
+		if err != nil {
+			return ot.ErrSpanContextCorrupted
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundTraceID || !foundSpanID {
+		if !foundTraceID && !foundSpanID && !foundSampled {
+			return nil, ot.ErrSpanContextNotFound
+		}
+		return nil, ot.ErrSpanContextCorrupted
+	}
+	return sc, nil
+}
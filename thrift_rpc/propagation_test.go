@@ -0,0 +1,72 @@
+package thrift_rpc
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+func TestHTTPHeadersPropagation(t *testing.T) {
+	tracer := NewTracer(Options{AccessToken: "0987654321"})
+	defer tracer.(basictracer.Tracer).Options().Recorder.(*Recorder).Close()
+
+	span := tracer.StartSpan("op")
+	span.SetBaggageItem("user", "alice")
+	headers := http.Header{}
+	if err := tracer.Inject(span.Context(), ot.HTTPHeaders, ot.HTTPHeadersCarrier(headers)); err != nil {
+		t.Fatalf("unexpected inject error: %v", err)
+	}
+	sc := span.Context().(basictracer.SpanContext)
+	for key, want := range map[string]string{
+		TraceIDHeader:                formatIDHex(sc.TraceID),
+		SpanIDHeader:                 formatIDHex(sc.SpanID),
+		SampledHeader:                "true",
+		BaggageHeaderPrefix + "user": "alice",
+	} {
+		if got := headers.Get(key); got != want {
+			t.Errorf("expected header %s: %q, got %q", key, want, got)
+		}
+	}
+
+	extracted, err := tracer.Extract(ot.HTTPHeaders, ot.HTTPHeadersCarrier(headers))
+	if err != nil {
+		t.Fatalf("unexpected extract error: %v", err)
+	}
+	got := extracted.(basictracer.SpanContext)
+	if got.TraceID != sc.TraceID || got.SpanID != sc.SpanID || !got.Sampled || got.Baggage["user"] != "alice" {
+		t.Errorf("expected %+v to round-trip, got %+v", sc, got)
+	}
+}
+
+func TestExtractTextMap(t *testing.T) {
+	tracer := NewTracer(Options{AccessToken: "0987654321"})
+	defer tracer.(basictracer.Tracer).Options().Recorder.(*Recorder).Close()
+
+	// As sent by a tracer that leaves out the sampled flag.
+	sc, err := tracer.Extract(ot.TextMap, ot.TextMapCarrier{
+		"OT-Tracer-TraceID": "abc",
+		"ot-tracer-spanid":  "123",
+	})
+	if err != nil {
+		t.Fatalf("unexpected extract error: %v", err)
+	}
+	if got := sc.(basictracer.SpanContext); got.TraceID != 0xabc || got.SpanID != 0x123 || !got.Sampled {
+		t.Errorf("unexpected context %+v", got)
+	}
+
+	for _, test := range []struct {
+		carrier ot.TextMapCarrier
+		err     error
+	}{
+		{ot.TextMapCarrier{"other": "header"}, ot.ErrSpanContextNotFound},
+		{ot.TextMapCarrier{TraceIDHeader: "abc"}, ot.ErrSpanContextCorrupted},
+		{ot.TextMapCarrier{TraceIDHeader: "abc", SpanIDHeader: "xyz"}, ot.ErrSpanContextCorrupted},
+		{ot.TextMapCarrier{TraceIDHeader: "abc", SpanIDHeader: "123", SampledHeader: "maybe"}, ot.ErrSpanContextCorrupted},
+	} {
+		if _, err := tracer.Extract(ot.TextMap, test.carrier); err != test.err {
+			t.Errorf("%v: expected %v, got %v", test.carrier, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package thrift_rpc
+
+import (
+	"fmt"
+
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+)
+
+const compactCollectorPath = "/_rpc/v1/reports/compact"
+
+// ThriftProtocol selects the thrift encoding of reports sent to the
+// collector, which determines both the protocol and the collector endpoint.
+type ThriftProtocol string
+
+const (
+	// ThriftProtocolBinary is the default.
+	ThriftProtocolBinary ThriftProtocol = "binary"
+
+	// ThriftProtocolCompact produces smaller reports than
+	// ThriftProtocolBinary, but requires a collector that accepts it.
+	ThriftProtocolCompact ThriftProtocol = "compact"
+)
+
+func (p ThriftProtocol) validate() error {
+	switch p {
+	case "", ThriftProtocolBinary, ThriftProtocolCompact:
+		return nil
+	}
+	return fmt.Errorf("unknown thrift protocol %q", string(p))
+}
+
+// collectorPath returns the collector endpoint accepting reports encoded
+// with p.
+func (p ThriftProtocol) collectorPath() string {
+	if p == ThriftProtocolCompact {
+		return compactCollectorPath
+	}
+	return collectorPath
+}
+
+func (p ThriftProtocol) protocolFactory() thrift.TProtocolFactory {
+	if p == ThriftProtocolCompact {
+		return thrift.NewTCompactProtocolFactory()
+	}
+	return thrift.NewTBinaryProtocolFactoryDefault()
+}
@@ -0,0 +1,91 @@
+package thrift_rpc
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+func TestThriftProtocol(t *testing.T) {
+	for _, test := range []struct {
+		protocol ThriftProtocol
+		factory  thrift.TProtocolFactory
+		path     string
+	}{
+		{"", thrift.NewTBinaryProtocolFactoryDefault(), collectorPath},
+		{ThriftProtocolBinary, thrift.NewTBinaryProtocolFactoryDefault(), collectorPath},
+		{ThriftProtocolCompact, thrift.NewTCompactProtocolFactory(), compactCollectorPath},
+	} {
+		collector := newTestCollectorProtocol(test.factory)
+		rec := NewRecorder(Options{
+			AccessToken:      "0987654321",
+			MaxLogMessageLen: 1024,
+			Collector:        collector.endpoint(),
+			ThriftProtocol:   test.protocol,
+		})
+		rec.RecordSpan(makeRawSpan("op", nil))
+		rec.Flush()
+
+		if path := collector.lastPath(); path != test.path {
+			t.Errorf("%q: expected a report to %s, got %q", test.protocol, test.path, path)
+		}
+		req := collector.backend.lastRequest()
+		if req == nil || len(req.SpanRecords) != 1 {
+			t.Errorf("%q: the collector could not decode the report: %v", test.protocol, req)
+		}
+		collector.Close()
+	}
+
+	if _, err := NewRecorderE(Options{AccessToken: "0987654321", ThriftProtocol: "json"}); err == nil {
+		t.Errorf("expected an error for an unknown protocol")
+	}
+}
+
+// makeAttributeHeavySpans returns n spans with many short tags, which the
+// compact protocol encodes most compactly relative to binary.
+func makeAttributeHeavySpans(n int) []basictracer.RawSpan {
+	spans := make([]basictracer.RawSpan, n)
+	for i := range spans {
+		tags := ot.Tags{}
+		for j := 0; j < 20; j++ {
+			tags["attr."+strconv.Itoa(j)] = i * j
+		}
+		spans[i] = makeRawSpan("op", tags)
+	}
+	return spans
+}
+
+// reportSize returns the size on the wire of a report of spans encoded
+// with protocol.
+func reportSize(t testing.TB, protocol ThriftProtocol, factory thrift.TProtocolFactory, spans []basictracer.RawSpan) int {
+	collector := newTestCollectorProtocol(factory)
+	defer collector.Close()
+	rec := NewRecorder(Options{
+		AccessToken:      "0987654321",
+		MaxLogMessageLen: 1024,
+		Collector:        collector.endpoint(),
+		ThriftProtocol:   protocol,
+	})
+	defer rec.Close()
+	for _, raw := range spans {
+		rec.RecordSpan(raw)
+	}
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("%q: unexpected flush error: %v", protocol, err)
+	}
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	return collector.sizes[0]
+}
+
+func TestThriftProtocolReportSize(t *testing.T) {
+	spans := makeAttributeHeavySpans(100)
+	binary := reportSize(t, ThriftProtocolBinary, thrift.NewTBinaryProtocolFactoryDefault(), spans)
+	compact := reportSize(t, ThriftProtocolCompact, thrift.NewTCompactProtocolFactory(), spans)
+	if compact >= binary*3/4 {
+		t.Errorf("expected the compact report to be well under the binary one's %d bytes, got %d", binary, compact)
+	}
+}
@@ -0,0 +1,34 @@
+package thrift_rpc
+
+import "time"
+
+// spanRateLimiter is a token bucket bounding the rate at which spans are
+// reported. It holds up to one second's worth of spans, so reports below
+// the rate are never limited however they are spread over time.
+type spanRateLimiter struct {
+	rate   float64 // spans per second
+	tokens float64
+	last   time.Time
+}
+
+func newSpanRateLimiter(rate float64, now time.Time) *spanRateLimiter {
+	return &spanRateLimiter{rate: rate, tokens: rate, last: now}
+}
+
+// take returns how many of n spans may be reported at now, consuming
+// their share of the bucket.
+func (l *spanRateLimiter) take(now time.Time, n int) int {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+	}
+	allowed := n
+	if float64(allowed) > l.tokens {
+		allowed = int(l.tokens)
+	}
+	l.tokens -= float64(allowed)
+	return allowed
+}
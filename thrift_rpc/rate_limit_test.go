@@ -0,0 +1,29 @@
+package thrift_rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpanRateLimiter(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	l := newSpanRateLimiter(100, start)
+	if n := l.take(start, 150); n != 100 {
+		t.Errorf("expected a burst of one second's worth of spans, got %d", n)
+	}
+	if n := l.take(start.Add(100*time.Millisecond), 50); n != 10 {
+		t.Errorf("expected 10 spans to be allowed after 100ms, got %d", n)
+	}
+	// Staying under the rate is never limited.
+	now := start.Add(10 * time.Second)
+	for i := 0; i < 20; i++ {
+		now = now.Add(100 * time.Millisecond)
+		if n := l.take(now, 10); n != 10 {
+			t.Fatalf("expected spans under the rate to be allowed, got %d of 10", n)
+		}
+	}
+	// Idle time does not accumulate beyond the burst.
+	if n := l.take(now.Add(time.Hour), 1000); n != 100 {
+		t.Errorf("expected the bucket to be capped at one second's worth, got %d", n)
+	}
+}
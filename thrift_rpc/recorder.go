@@ -1,11 +1,17 @@
 package thrift_rpc
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,11 +22,15 @@ import (
 	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
 	"github.com/opentracing/basictracer-go"
 	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 )
 
 const (
 	collectorPath = "/_rpc/v1/reports/binary"
 
+	// userAgent identifies the tracer in report requests.
+	userAgent = "lightstep-tracer-go/" + TracerVersionValue
+
 	defaultPlainPort  = 80
 	defaultSecurePort = 443
 
@@ -32,13 +42,56 @@ const (
 	defaultMaxReportingPeriod = 2500 * time.Millisecond
 	minReportingPeriod        = 500 * time.Millisecond
 
+	// defaultFlushThresholdRatio is how full the buffer gets before a
+	// report is sent early, unless Options.FlushThresholdRatio is set.
+	defaultFlushThresholdRatio = 0.5
+
+	// defaultReportTimeout bounds each report RPC unless
+	// Options.ReportTimeout is set.
+	defaultReportTimeout = 60 * time.Second
+
+	// defaultStreamInterval is the default minimum time between reports in
+	// streaming mode.
+	defaultStreamInterval = 10 * time.Millisecond
+
+	// srvRefreshInterval is how often a collector discovered through
+	// Options.CollectorSRV is re-resolved, in addition to after each failed
+	// report.
+	srvRefreshInterval = 5 * time.Minute
+
+	// defaultReconnectAfterFailures is how many reports in a row may fail
+	// before the transport is rebuilt, unless
+	// Options.ReconnectAfterFailures is set.
+	defaultReconnectAfterFailures = 3
+
 	// ParentSpanGUIDKey is the tag key used to record the relationship
 	// between child and parent spans.
 	ParentSpanGUIDKey = "parent_span_guid"
 
+	// BaggageKeyPrefix prefixes the attribute keys under which baggage
+	// items are reported, as the thrift SpanRecord has no baggage field.
+	BaggageKeyPrefix = "baggage:"
+
+	// CoalescedCountKey is the tag key used to record how many identical
+	// spans were merged into a span when Options.CoalesceSpans is set.
+	CoalescedCountKey = "coalesced_count"
+
+	// EventKey is the tag key that marks spans recorded by RecordEvent.
+	EventKey = "lightstep.event"
+
+	// StartupSpanOperation is the operation name of the span recorded at
+	// construction when Options.ReportStartupSpan is set.
+	StartupSpanOperation = "tracer.started"
+
 	TracerPlatformValue = "go"
 	TracerVersionValue  = "0.9.1"
 
+	// ReportSchemaVersionValue identifies the feature set used by reports:
+	// log levels and error flags, span links, coalesced span counts, and
+	// event spans. It is bumped whenever the conversion of spans changes
+	// in a way the collector or support tooling may need to know about.
+	ReportSchemaVersionValue = "2"
+
 	TracerPlatformKey        = "lightstep.tracer_platform"
 	TracerPlatformVersionKey = "lightstep.tracer_platform_version"
 	TracerVersionKey         = "lightstep.tracer_version"
@@ -46,8 +99,23 @@ const (
 	GUIDKey                  = "lightstep.guid" // <- runtime guid, not span guid
 	HostnameKey              = "lightstep.hostname"
 	CommandLineKey           = "lightstep.command_line"
+	ReportSchemaVersionKey   = "lightstep.report_schema_version"
 )
 
+var errEmptyAccessToken = errors.New("LightStep Recorder options.AccessToken must not be empty")
+
+// ErrRecorderDisabled is returned by Flush once the Recorder has been
+// disabled or closed.
+var ErrRecorderDisabled = errors.New("LightStep Recorder is disabled")
+
+// CollectorErrors is returned by Flush when the collector accepted a report
+// but returned errors for it. The report is not retried.
+type CollectorErrors []string
+
+func (e CollectorErrors) Error() string {
+	return "collector returned errors: " + strings.Join(e, "; ")
+}
+
 // Endpoint describes a collection or web API host/port and whether or
 // not to use plaintext communicatation.
 type Endpoint struct {
@@ -56,11 +124,6 @@ type Endpoint struct {
 	Plaintext bool   `yaml:"plaintext" usage:"whether or not to encrypt data send to the endpoint"`
 }
 
-// A set of counter values for a given time window
-type counterSet struct {
-	droppedSpans int64
-}
-
 // Options control how the LightStep Tracer behaves.
 type Options struct {
 	// AccessToken is the unique API key for your LightStep project.  It is
@@ -71,6 +134,23 @@ type Options struct {
 	// for the collector.
 	Collector Endpoint `yaml:"collector"`
 
+	// CollectorSRV, if set, is the name of a DNS SRV record (e.g.
+	// "_lightstep._tcp.example.com") listing the collectors to report to.
+	// It overrides Collector's host and port; Collector.Plaintext still
+	// applies. The record is re-resolved periodically and after a failed
+	// report, moving to another target if one is available.
+	CollectorSRV string `yaml:"collector_srv"`
+
+	// ThriftProtocol is the encoding used for reports, and selects the
+	// matching collector endpoint. If empty, ThriftProtocolBinary is used.
+	ThriftProtocol ThriftProtocol `yaml:"thrift_protocol"`
+
+	// CollectorPath, if set, replaces the path of the collector endpoint
+	// selected by ThriftProtocol, e.g. for a reverse proxy that mounts the
+	// collector under a prefix. The scheme, host, and port still come from
+	// Collector or CollectorSRV, so it must be a path beginning with "/".
+	CollectorPath string `yaml:"collector_path"`
+
 	// Tags are arbitrary key-value pairs that apply to all spans generated by
 	// this Tracer.
 	Tags ot.Tags
@@ -83,10 +163,25 @@ type Options struct {
 	// before sending them to a collector.
 	MaxBufferedSpans int `yaml:"max_buffered_spans"`
 
+	// MaxBufferedBytes, if positive, also bounds the buffer by the
+	// approximate serialized size of its spans, so that a few spans with
+	// large tags or logs cannot use more memory than that. Reports are sent
+	// early, and spans dropped, as the size nears or would pass the limit,
+	// as for MaxBufferedSpans. The spans' tags, baggage, and log fields are
+	// counted at their formatted lengths, before MaxLogMessageLen applies.
+	MaxBufferedBytes int `yaml:"max_buffered_bytes"`
+
+	// OverflowPolicy selects which spans are dropped when the buffer is
+	// full. If empty, OverflowDropNewest is used.
+	OverflowPolicy OverflowPolicy `yaml:"overflow_policy"`
+
 	// ReportingPeriod is the maximum duration of time between sending spans
 	// to a collector.  If zero, the default will be used.
 	ReportingPeriod time.Duration `yaml:"reporting_period"`
 
+	// ReportTimeout bounds each report RPC, including connecting to the
+	// collector. Spans in a report that times out are kept for the next
+	// one. If zero, a default of 60 seconds is used.
 	ReportTimeout time.Duration `yaml:"report_timeout"`
 
 	// DropSpanLogs turns log events on all Spans into no-ops.
@@ -100,17 +195,337 @@ type Options struct {
 
 	// MaxLogsPerSpan limits the number of logs in a single span.
 	MaxLogsPerSpan int `yaml:"max_logs_per_span"`
+
+	// TruncationMarker ends log events and payloads truncated to
+	// MaxLogMessageLen, counting towards the limit. If empty, an ellipsis
+	// ("…") is used.
+	TruncationMarker string `yaml:"truncation_marker"`
+
+	// OmitTruncationMarker truncates log events and payloads without a
+	// TruncationMarker.
+	OmitTruncationMarker bool `yaml:"omit_truncation_marker"`
+
+	// AttributeAllowlist, when non-nil, restricts the span tags that are
+	// reported to those whose keys appear in the list. All other tags are
+	// dropped and counted. Join tags and the parent span GUID are always
+	// reported.
+	AttributeAllowlist []string `yaml:"attribute_allowlist"`
+
+	// CoalesceSpans merges consecutive identical spans recorded within a
+	// report window into a single span carrying a CoalescedCountKey tag.
+	// Spans are identical when they share an operation name and the values
+	// of every tag listed in CoalesceKeyTags.
+	CoalesceSpans   bool     `yaml:"coalesce_spans"`
+	CoalesceKeyTags []string `yaml:"coalesce_key_tags"`
+
+	// IDFormatter formats span and trace IDs for the SpanGuid, TraceGuid,
+	// and parent span GUID fields of reported spans. If nil, IDs are
+	// formatted in hexadecimal.
+	IDFormatter func(id uint64) string
+
+	// GUIDGenerator, if set, generates the Recorder's runtime GUID (unless
+	// Tags sets GUIDKey) and the trace and span IDs of spans the Recorder
+	// creates itself, such as those of RecordEvent. IDs of traced spans are
+	// still generated by basictracer. It must be safe for concurrent use. If
+	// nil, a seeded pseudo-random generator is used.
+	GUIDGenerator func() uint64
+
+	// ReportPayloadQuotaBytes caps the total bytes of log payload JSON
+	// included in a single report. Once the quota is spent, the remaining
+	// payloads of the report are not encoded at all: they are replaced by a
+	// placeholder and counted as dropped. Each payload encoded within the
+	// quota is marshalled in full before being truncated to
+	// MaxLogMessageLen, so the quota does not bound the memory used by any
+	// one payload. If zero, payloads are not limited.
+	ReportPayloadQuotaBytes int `yaml:"report_payload_quota_bytes"`
+
+	// BasicAuthUsername and BasicAuthPassword, if set, are sent as HTTP
+	// basic auth credentials on every report, for collectors behind a
+	// proxy requiring them. They are independent of the AccessToken.
+	BasicAuthUsername string `yaml:"basic_auth_username"`
+	BasicAuthPassword string `yaml:"basic_auth_password"`
+
+	// CustomHeaders are set on every report request, e.g. routing or auth
+	// headers required by a gateway. They may replace the default
+	// User-Agent of "lightstep-tracer-go/" followed by TracerVersionValue,
+	// but not the Authorization header set by BasicAuthUsername or the
+	// Content-Type.
+	CustomHeaders map[string]string `yaml:"custom_headers"`
+
+	// DialContext, if set, opens the network connections used to send
+	// reports, e.g. to bind a source address or dial through a proxy. If
+	// nil, the default net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// HTTPClient, if set, sends reports in place of the default client,
+	// e.g. to route through a proxy or use a custom TLS configuration. Its
+	// Transport (http.DefaultTransport if nil) is wrapped to honor collector
+	// throttling and FlushWithContext, and ReportTimeout applies if the
+	// client sets no Timeout. DialContext is ignored.
+	HTTPClient *http.Client
+
+	// RecordQueueSize, if positive, makes RecordSpan hand spans to a
+	// background goroutine through a queue of that many spans, rather than
+	// buffering them itself, so that goroutines recording spans do not
+	// contend for the lock held while reports are built. A span that
+	// finds the queue full is buffered directly. Spans still queued are
+	// buffered before each report. It is ignored in Synchronous mode.
+	RecordQueueSize int `yaml:"record_queue_size"`
+
+	// ReconnectAfterFailures is how many reports in a row may fail to
+	// reach the collector before the Recorder replaces its transport with a
+	// new one, closing the idle connections of the old, in case the
+	// connection itself is bad, e.g. kept alive to a collector that has
+	// since failed over. If zero, a default of 3 is used. It is ignored
+	// when Backend is set.
+	ReconnectAfterFailures int `yaml:"reconnect_after_failures"`
+
+	// StreamSpans, intended for debugging, reports each span as soon as it
+	// is recorded rather than waiting for the buffer thresholds and reporting
+	// period. Spans recorded within StreamInterval of the previous report
+	// are sent together in the next one, as are those recorded while the
+	// collector has asked us to back off. This trades throughput and
+	// connection efficiency for latency.
+	StreamSpans bool `yaml:"stream_spans"`
+
+	// StreamInterval is the minimum time between reports when StreamSpans is
+	// set. If zero, a default of 10ms is used.
+	StreamInterval time.Duration `yaml:"stream_interval"`
+
+	// Synchronous, for short-lived processes such as CLI tools and
+	// serverless functions, runs no background report loop. Instead the
+	// goroutine recording a span reports the buffer once it holds
+	// SynchronousBatchSize spans, and Close reports whatever remains, so
+	// every span is delivered as long as Close is called before exiting.
+	// While the collector has asked us to back off, spans stay buffered
+	// until the first one recorded after the backoff expires.
+	// Each report blocks the span's caller for the duration of the RPC, so
+	// this suits low span rates; StreamSpans and ReportingPeriod are
+	// ignored.
+	Synchronous bool `yaml:"synchronous"`
+
+	// SynchronousBatchSize is how many spans are buffered before each
+	// report in Synchronous mode. If zero, each span is reported as soon as
+	// it is recorded.
+	SynchronousBatchSize int `yaml:"synchronous_batch_size"`
+
+	// TrackActiveSpans counts spans that have been started but not yet
+	// finished, reported as Stats().ActiveSpans. A steadily growing count
+	// indicates spans that are never finished.
+	TrackActiveSpans bool `yaml:"track_active_spans"`
+
+	// OperationNamePrefix is prepended to the operation name of every
+	// reported span, e.g. "checkout." to namespace a service's spans.
+	OperationNamePrefix string `yaml:"operation_name_prefix"`
+
+	// ReportStartupSpan records a single StartupSpanOperation span when the
+	// Recorder is constructed, tagged with its effective configuration, to
+	// make it easy to see how a given process's tracer was set up. As the
+	// first report is sent at the report loop's first check, half a second
+	// after construction, the span also confirms soon that the AccessToken
+	// and Collector are correct; if not, the report's error is returned by
+	// LastReportError.
+	ReportStartupSpan bool `yaml:"report_startup_span"`
+
+	// TraceSamplingRate is the fraction of traces to report, in (0, 1). The
+	// decision is made per trace ID, so either all of a trace's spans are
+	// reported or none are. If zero, every trace is reported.
+	TraceSamplingRate float64 `yaml:"trace_sampling_rate"`
+
+	// PerOperationSampleRates overrides TraceSamplingRate for spans whose
+	// operation name matches a glob pattern, in which "*" matches any run
+	// of characters and "?" any single one; e.g. {"payment.*": 1,
+	// "health_check": 0.01}. The longest matching pattern applies. As
+	// with TraceSamplingRate, the decision for a given rate depends only
+	// on the trace ID.
+	PerOperationSampleRates map[string]float64 `yaml:"per_operation_sample_rates"`
+
+	// SpanDropTags drops spans, before they are buffered, carrying any of
+	// the listed tags with the listed value (compared as the tag would be
+	// reported), e.g. {"health_check": "true"}. Dropped spans are counted
+	// as filtered.
+	SpanDropTags map[string]string `yaml:"span_drop_tags"`
+
+	// SuppressEmptyReports skips the report RPC when there are no spans to
+	// send and every internal counter is zero, saving RPCs for low-traffic
+	// services.
+	SuppressEmptyReports bool `yaml:"suppress_empty_reports"`
+
+	// OnCommand, if set, is called with every command returned by the
+	// collector in a report response, before the Recorder's own handling
+	// of it (currently just Disable). It is called from Flush, and so must
+	// not call Flush itself, nor Disable if DrainOnDisable is set.
+	OnCommand func(cmd *lightstep_thrift.Command)
+
+	// DrainOnDisable makes Disable, including a Disable command from the
+	// collector, first flush the spans already buffered, which are only
+	// discarded if that report fails.
+	DrainOnDisable bool `yaml:"drain_on_disable"`
+
+	// GroupSpansByTrace orders the spans in each report so that spans of
+	// the same trace are adjacent, with traces in the order their first
+	// span was recorded.
+	GroupSpansByTrace bool `yaml:"group_spans_by_trace"`
+
+	// ReportCPUChanges adds the process's GOMAXPROCS and cgroup CPU quota
+	// to the runtime attributes, refreshed on every report, so that changes
+	// such as a container being throttled or resized are visible.
+	ReportCPUChanges bool `yaml:"report_cpu_changes"`
+
+	// MaxSpanDelay, if set, bounds how long a recorded span may wait to be
+	// reported, flushing early, even at low volume, once the oldest buffered
+	// span approaches this age. The bound excludes the duration of the
+	// report RPC itself.
+	MaxSpanDelay time.Duration `yaml:"max_span_delay"`
+
+	// CounterMode selects whether internal counters are reported as deltas
+	// since the previous report (the default) or as running totals.
+	CounterMode CounterMode `yaml:"counter_mode"`
+
+	// Compression is applied to report request bodies. If empty,
+	// CompressionNone is used. BenchmarkFlushGzip measures its CPU cost
+	// for a given report size.
+	Compression Compression `yaml:"compression"`
+
+	// DegradationLadder sheds detail from spans recorded while the buffer
+	// is filling up, bounding the memory they hold while preserving their
+	// timing, operation name, and trace structure. Every step whose Fill
+	// has been reached applies. Degraded spans are counted. If empty, spans
+	// are always buffered in full.
+	DegradationLadder []DegradationStep
+
+	// LowValueTags lists the tag keys shed by a DetailTags step.
+	LowValueTags []string `yaml:"low_value_tags"`
+
+	// OnDroppedSpans, if set, is called with the number of spans discarded
+	// because the buffer was full since its previous call. It runs on a
+	// separate goroutine, never blocking or holding locks of the recording
+	// path, so spans dropped in quick succession may be reported together.
+	OnDroppedSpans func(count int)
+
+	// MaxSpansPerSecond, if positive, caps the rate at which spans are
+	// reported. Spans over the limit when a report is built are dropped,
+	// counted both as dropped and, separately, as throttled. Bursts of up
+	// to a second's worth of spans are reported in full.
+	MaxSpansPerSecond float64 `yaml:"max_spans_per_second"`
+
+	// FlushThresholdRatio is how full the buffer may get, as a fraction of
+	// MaxBufferedSpans (and of MaxBufferedBytes, if set) in (0, 1], before
+	// a report is sent early. If zero, 0.5 is used.
+	FlushThresholdRatio float64 `yaml:"flush_threshold_ratio"`
+
+	// MaxSpansPerReport, if positive, caps the number of spans in each
+	// report request, so that a large buffer is sent as several requests,
+	// one after the other, rather than one the collector might reject for
+	// its size. If one fails, the spans not yet delivered are kept for the
+	// next report.
+	MaxSpansPerReport int `yaml:"max_spans_per_report"`
+
+	// Backend, if set, receives every report in place of the collector,
+	// e.g. a RecordingBackend in tests. The collector and transport options
+	// are then ignored. Report must not retain the request after returning.
+	Backend lightstep_thrift.ReportingService
+
+	// Context, if set, ties the Recorder's lifetime to it: once it is done,
+	// the Recorder is closed as if by Close, sending a final report and
+	// stopping the report loop.
+	Context context.Context
+
+	// clock replaces the real clock in tests.
+	clock clock
+}
+
+// Stats is a snapshot of a Recorder's internal state.
+type Stats struct {
+	// ActiveSpans is the number of spans started but not yet finished. It
+	// is only tracked when Options.TrackActiveSpans is set.
+	ActiveSpans int64
+
+	// LastConversionTime is how long the most recent Flush spent converting
+	// buffered spans to thrift, excluding the report RPC itself.
+	LastConversionTime time.Duration
+
+	// RecordedSpans is the number of spans accepted into the buffer, and
+	// DroppedSpans the number discarded because the buffer was full or
+	// over Options.MaxSpansPerSecond, since the Recorder was created.
+	// ThrottledSpans is the number of the latter.
+	RecordedSpans  int64
+	DroppedSpans   int64
+	ThrottledSpans int64
+
+	// TruncatedLogs and TruncatedPayloads are the numbers of log messages
+	// or fields, and of payloads, truncated to Options.MaxLogMessageLen,
+	// and TruncatedBytes the number of bytes cut from them, since the
+	// Recorder was created.
+	TruncatedLogs     int64
+	TruncatedPayloads int64
+	TruncatedBytes    int64
+
+	// BufferedSpans is the number of spans awaiting the next report, out
+	// of a capacity of BufferCapacity. BufferedBytes is their approximate
+	// serialized size, only tracked when Options.MaxBufferedBytes is set.
+	BufferedSpans  int
+	BufferCapacity int
+	BufferedBytes  int
+
+	// ReportsSent is the number of reports delivered to the collector. See
+	// Recorder.LastReportError for the outcome of the most recent one.
+	ReportsSent int64
 }
 
 // NewTracer returns a new Tracer that reports spans to a LightStep
-// collector.
+// collector. If the Recorder cannot be constructed, it logs the error and
+// returns a no-op Tracer. Use NewTracerE to handle the error explicitly.
 func NewTracer(opts Options) ot.Tracer {
+	tracer, err := NewTracerE(opts)
+	if err != nil {
+		logError(opts.Verbose, err)
+		return ot.NoopTracer{}
+	}
+	return tracer
+}
+
+// NewTracerE is like NewTracer, but returns an error if the Recorder cannot
+// be constructed.
+func NewTracerE(opts Options) (ot.Tracer, error) {
+	rec, err := NewRecorderE(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewTracerWithRecorder(rec.(*Recorder)), nil
+}
+
+// NewTracerWithRecorder returns a new Tracer recording into rec, e.g. one
+// created by NewRecorder or taken from another Tracer with GetRecorder, so
+// that several subsystems' tracers share one buffer, report loop, and
+// collector connection. The Tracer samples, tracks active spans, and
+// limits logs as set by the Options rec was created with.
+//
+// Tracers sharing a Recorder report the same component attributes, those
+// of its Options.Tags; wrap a Tracer with WithComponentAttributes to give
+// its spans their own. Closing the Recorder, e.g. with CloseLightStepTracer
+// on any of them, stops reporting the spans of all of them.
+func NewTracerWithRecorder(rec *Recorder) ot.Tracer {
 	options := basictracer.DefaultOptions()
-	options.ShouldSample = func(_ uint64) bool { return true }
-	options.Recorder = NewRecorder(opts)
-	options.DropAllLogs = opts.DropSpanLogs
-	options.MaxLogsPerSpan = opts.MaxLogsPerSpan
-	return basictracer.NewWithOptions(options)
+	options.ShouldSample = TraceSampler(rec.tracerOpts.TraceSamplingRate)
+	options.Recorder = rec
+	if rec.tracerOpts.TrackActiveSpans {
+		options.NewSpanEventListener = rec.NewSpanEventListener
+	}
+	options.DropAllLogs = rec.tracerOpts.DropSpanLogs
+	options.MaxLogsPerSpan = rec.tracerOpts.MaxLogsPerSpan
+	return NewReferenceTracer(basictracer.NewWithOptions(options))
+}
+
+// GetRecorder returns the Recorder of a Tracer created by NewTracer, e.g. to
+// Flush it or read its Stats. It returns false for any other Tracer.
+func GetRecorder(tracer ot.Tracer) (*Recorder, bool) {
+	basicTracer, ok := tracer.(basictracer.Tracer)
+	if !ok {
+		return nil, false
+	}
+	rec, ok := basicTracer.Options().Recorder.(*Recorder)
+	return rec, ok
 }
 
 func FlushLightStepTracer(lsTracer ot.Tracer) error {
@@ -124,14 +539,17 @@ func FlushLightStepTracer(lsTracer ot.Tracer) error {
 	if !ok {
 		return fmt.Errorf("Not a LightStep Recorder type: %v", reflect.TypeOf(basicRecorder))
 	}
-	lsRecorder.Flush()
-	return nil
+	return lsRecorder.Flush()
 }
 
 // Recorder buffers spans and forwards them to a LightStep collector.
 type Recorder struct {
 	lock sync.Mutex
 
+	// flushLock serializes calls to Flush. It is always acquired before
+	// lock, never while holding it.
+	flushLock sync.Mutex
+
 	// auth and runtime information
 	auth       *lightstep_thrift.Auth
 	attributes map[string]string
@@ -141,16 +559,57 @@ type Recorder struct {
 	reportOldest   time.Time
 	reportYoungest time.Time
 
+	// windowOverride is the explicit window set by SetReportWindow, or nil.
+	windowOverride *reportWindow
+
 	// buffered data
 	buffer   spansBuffer
 	counters counterSet // The unreported count
 
+	// counterTotals are the counts reported so far, in cumulative mode.
+	counterMode   CounterMode
+	counterTotals counterSet
+
+	degradationLadder []DegradationStep
+	lowValueTags      map[string]bool
+
+	// rateLimiter is set by Options.MaxSpansPerSecond.
+	rateLimiter *spanRateLimiter
+
+	flushThresholdRatio float64
+	maxSpansPerReport   int
+
+	clock              clock
 	lastReportAttempt  time.Time
 	maxReportingPeriod time.Duration
 	reportInFlight     bool
+	// reportCtx is the context of the report in flight, applied to its
+	// HTTP request by throttleTransport.
+	reportCtx context.Context
 	// Remote service that will receive reports
 	backend lightstep_thrift.ReportingService
 
+	// httpClient and authHeader are used to build the backend for
+	// collectorURL.
+	httpClient    *http.Client
+	authHeader    string
+	customHeaders map[string]string
+	collectorURL  string
+	collectorPath string
+	protocol      ThriftProtocol
+
+	// collectorSRV is set by Options.CollectorSRV; srvResolvedAt is when it
+	// was last resolved.
+	collectorSRV       string
+	collectorPlaintext bool
+	srvResolvedAt      time.Time
+
+	// reportFailures counts the reports in a row that failed to reach the
+	// collector; the backend is rebuilt once it reaches
+	// reconnectAfterFailures.
+	reportFailures         int
+	reconnectAfterFailures int
+
 	// apiURL is the base URL of the LightStep web API, used for
 	// explicit trace collection requests.
 	apiURL string
@@ -165,25 +624,134 @@ type Recorder struct {
 	// time, turning all potentially costly runtime operations into
 	// no-ops.
 	disabled bool
+	// drainOnDisable is set by Options.DrainOnDisable; draining is set
+	// while Disable flushes.
+	drainOnDisable bool
+	draining       bool
 
 	// flags replacement
 	maxLogMessageLen int
+	truncationMarker string // see Options.TruncationMarker
+	omitTruncation   bool   // see Options.OmitTruncationMarker
+
+	// attributeAllowlist is nil unless Options.AttributeAllowlist was set.
+	attributeAllowlist map[string]struct{}
+
+	formatID func(id uint64) string // see Options.IDFormatter
+	genGUID  func() uint64          // see Options.GUIDGenerator
+
+	operationNamePrefix string // see Options.OperationNamePrefix
+
+	// payloadQuotaBytes is set by Options.ReportPayloadQuotaBytes;
+	// reportPayloadBytes counts the payload bytes encoded by the current
+	// Flush.
+	payloadQuotaBytes  int
+	reportPayloadBytes int
+
+	// In streaming mode, RecordSpan signals streamch to request a report;
+	// streamch is nil otherwise.
+	streamch       chan struct{}
+	streamInterval time.Duration
+
+	// queue is set by Options.RecordQueueSize.
+	queue chan basictracer.RawSpan
+
+	// syncBatchSize is non-zero in Synchronous mode; see
+	// Options.SynchronousBatchSize.
+	syncBatchSize int
+
+	// Close closes closech to stop the report loop, which closes loopDone
+	// on exit.
+	closech  chan struct{}
+	loopDone chan struct{}
+	closed   bool
+
+	activeSpans int64 // accessed atomically; see Options.TrackActiveSpans
+
+	// tracerOpts holds the Options that NewTracerWithRecorder applies to
+	// the tracers recording into the Recorder.
+	tracerOpts Options
+
+	// dropUnsampled is set when Options.TraceSamplingRate is positive.
+	dropUnsampled bool
+
+	operationSamplers []operationSampler // see Options.PerOperationSampleRates
+
+	spanDropTags map[string]string // see Options.SpanDropTags
+
+	suppressEmptyReports bool // see Options.SuppressEmptyReports
+
+	onCommand func(cmd *lightstep_thrift.Command) // see Options.OnCommand
+
+	groupByTrace bool // see Options.GroupSpansByTrace
+
+	reportCPUChanges bool   // see Options.ReportCPUChanges
+	cgroupRoot       string // where the cgroup filesystem is mounted
+
+	maxSpanDelay time.Duration // see Options.MaxSpanDelay
+
+	lastConversionTime time.Duration // see Stats.LastConversionTime
+
+	// When Options.OnDroppedSpans is set, dropch signals notifyDropped to
+	// report droppedUnnotified (accessed atomically).
+	dropch            chan struct{}
+	droppedUnnotified int64
+
+	// Lifetime totals; see Stats.
+	spansRecorded   int64
+	spansDropped    int64
+	spansThrottled  int64
+	reportsSent     int64
+	lastReportError error
+	// lastReportDone is when the report resulting in lastReportError
+	// completed.
+	lastReportDone time.Time
+	// reportDone is completed, and replaced, whenever a flush returns, to
+	// wake WaitForFlush.
+	reportDone *reportOutcome
+
+	logsTruncated     int64
+	payloadsTruncated int64
+	bytesTruncated    int64
+
+	// The report loop, including in streaming mode, does not flush before
+	// backoffUntil, which is set when the collector asks us to back off.
+	backoffUntil time.Time
 }
 
+// NewRecorder returns a Recorder reporting to the collector described by
+// opts. If the Recorder cannot be constructed, e.g. because
+// opts.AccessToken is empty, it logs the error and returns nil. Use
+// NewRecorderE to handle those errors explicitly.
 func NewRecorder(opts Options) *Recorder {
-	if len(opts.AccessToken) == 0 {
-		// TODO maybe return a no-op recorder instead?
-		panic("LightStep Recorder options.AccessToken must not be empty")
+	rec, err := NewRecorderE(opts)
+	if err != nil {
+		logError(opts.Verbose, err)
+		return nil
+	}
+	return rec.(*Recorder)
+}
+
+// NewRecorderE is like NewRecorder, but returns an error rather than
+// logging it if the Recorder cannot be constructed, so that callers may
+// fail fast on misconfiguration; see Options.Validate.
+func NewRecorderE(opts Options) (basictracer.SpanRecorder, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 	if opts.Tags == nil {
 		opts.Tags = make(map[string]interface{})
 	}
+	genGUID := opts.GUIDGenerator
+	if genGUID == nil {
+		genGUID = genSeededGUID
+	}
 	// Set some default attributes if not found in options
 	if _, found := opts.Tags[ComponentNameKey]; !found {
 		opts.Tags[ComponentNameKey] = path.Base(os.Args[0])
 	}
 	if _, found := opts.Tags[GUIDKey]; !found {
-		opts.Tags[GUIDKey] = genSeededGUID()
+		opts.Tags[GUIDKey] = genGUID()
 	}
 	if _, found := opts.Tags[HostnameKey]; !found {
 		hostname, _ := os.Hostname()
@@ -194,20 +762,32 @@ func NewRecorder(opts Options) *Recorder {
 	}
 
 	attributes := make(map[string]string)
+	var attributeErrs []error
 	for k, v := range opts.Tags {
-		attributes[k] = fmt.Sprint(v)
+		value, err := formatAttributeValue(v)
+		if err != nil {
+			attributeErrs = append(attributeErrs, fmt.Errorf("skipping component attribute %q: %v", k, err))
+			continue
+		}
+		attributes[k] = value
 	}
 	// Don't let the Options override these values. That would be confusing.
 	attributes[TracerPlatformKey] = TracerPlatformValue
 	attributes[TracerPlatformVersionKey] = runtime.Version()
 	attributes[TracerVersionKey] = TracerVersionValue
+	attributes[ReportSchemaVersionKey] = ReportSchemaVersionValue
 
-	now := time.Now()
+	clk := opts.clock
+	if clk == nil {
+		clk = realClock{}
+	}
+	now := clk.Now()
 	rec := &Recorder{
 		auth: &lightstep_thrift.Auth{
 			AccessToken: thrift.StringPtr(opts.AccessToken),
 		},
 		attributes:         attributes,
+		clock:              clk,
 		startTime:          now,
 		reportOldest:       now,
 		reportYoungest:     now,
@@ -216,126 +796,562 @@ func NewRecorder(opts Options) *Recorder {
 		apiURL:             getAPIURL(opts),
 		AccessToken:        opts.AccessToken,
 		maxLogMessageLen:   opts.MaxLogMessageLen,
+		truncationMarker:   opts.TruncationMarker,
+		dropUnsampled:      opts.TraceSamplingRate > 0,
+		spanDropTags:       opts.SpanDropTags,
+		formatID:           opts.IDFormatter,
+		genGUID:            genGUID,
+
+		omitTruncation:       opts.OmitTruncationMarker,
+		operationNamePrefix:  opts.OperationNamePrefix,
+		payloadQuotaBytes:    opts.ReportPayloadQuotaBytes,
+		suppressEmptyReports: opts.SuppressEmptyReports,
+		onCommand:            opts.OnCommand,
+		drainOnDisable:       opts.DrainOnDisable,
+		groupByTrace:         opts.GroupSpansByTrace,
+		reportCPUChanges:     opts.ReportCPUChanges,
+		cgroupRoot:           defaultCgroupRoot,
+		maxSpanDelay:         opts.MaxSpanDelay,
+		operationSamplers:    newOperationSamplers(opts.PerOperationSampleRates),
+		counterMode:          opts.CounterMode,
+		degradationLadder:    opts.DegradationLadder,
+		lowValueTags:         make(map[string]bool, len(opts.LowValueTags)),
+	}
+	for _, key := range opts.LowValueTags {
+		rec.lowValueTags[key] = true
 	}
+	if opts.MaxSpansPerSecond > 0 {
+		rec.rateLimiter = newSpanRateLimiter(opts.MaxSpansPerSecond, now)
+	}
+	rec.flushThresholdRatio = defaultFlushThresholdRatio
+	if opts.FlushThresholdRatio != 0 {
+		rec.flushThresholdRatio = opts.FlushThresholdRatio
+	}
+	rec.maxSpansPerReport = opts.MaxSpansPerReport
 	rec.buffer.setDefaults()
+	rec.buffer.setClock(clk)
+
+	for _, err := range attributeErrs {
+		rec.maybeLogError(err)
+	}
+
+	if rec.formatID == nil {
+		rec.formatID = formatIDHex
+	}
+	if opts.ReportingPeriod != 0 {
+		rec.maxReportingPeriod = opts.ReportingPeriod
+		if opts.ReportingPeriod < minReportingPeriod {
+			rec.maybeLogError(fmt.Errorf("ReportingPeriod %v is below the minimum of %v; using the minimum",
+				opts.ReportingPeriod, minReportingPeriod))
+			rec.maxReportingPeriod = minReportingPeriod
+		}
+	}
+
+	if opts.AttributeAllowlist != nil {
+		rec.attributeAllowlist = make(map[string]struct{}, len(opts.AttributeAllowlist))
+		for _, key := range opts.AttributeAllowlist {
+			rec.attributeAllowlist[key] = struct{}{}
+		}
+	}
 
 	if opts.MaxBufferedSpans > 0 {
 		rec.buffer.setMaxBufferSize(opts.MaxBufferedSpans)
 	}
+	rec.buffer.setMaxBytes(opts.MaxBufferedBytes)
+	rec.buffer.setOverflowPolicy(opts.OverflowPolicy)
+	if opts.CoalesceSpans {
+		rec.buffer.setCoalescing(opts.CoalesceKeyTags)
+	}
+	if opts.Synchronous {
+		rec.syncBatchSize = 1
+		if opts.SynchronousBatchSize > 0 {
+			rec.syncBatchSize = opts.SynchronousBatchSize
+		}
+	} else if opts.StreamSpans {
+		rec.streamch = make(chan struct{}, 1)
+		rec.streamInterval = defaultStreamInterval
+		if opts.StreamInterval > 0 {
+			rec.streamInterval = opts.StreamInterval
+		}
+	}
+	if opts.RecordQueueSize > 0 && rec.syncBatchSize == 0 {
+		rec.queue = make(chan basictracer.RawSpan, opts.RecordQueueSize)
+	}
 
-	timeout := 60 * time.Second
+	timeout := defaultReportTimeout
 	if opts.ReportTimeout > 0 {
 		timeout = opts.ReportTimeout
 	}
-	transport, err := thrift.NewTHttpPostClient(getCollectorURL(opts), timeout)
-	if err != nil {
-		rec.maybeLogError(err)
-		return nil
+	if opts.HTTPClient != nil {
+		client := *opts.HTTPClient
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client.Transport = &throttleTransport{opts.Compression.wrap(base), rec}
+		if client.Timeout == 0 {
+			client.Timeout = timeout
+		}
+		rec.httpClient = &client
+	} else {
+		base := &http.Transport{DialContext: opts.DialContext}
+		rec.httpClient = &http.Client{
+			Transport: &throttleTransport{opts.Compression.wrap(base), rec},
+			Timeout:   timeout,
+		}
+	}
+	if opts.BasicAuthUsername != "" || opts.BasicAuthPassword != "" {
+		rec.authHeader = basicAuthHeader(opts.BasicAuthUsername, opts.BasicAuthPassword)
+	}
+	rec.customHeaders = opts.CustomHeaders
+
+	rec.protocol = opts.ThriftProtocol
+	rec.collectorPath = getCollectorPath(opts)
+	rec.tracerOpts = Options{
+		TraceSamplingRate: opts.TraceSamplingRate,
+		TrackActiveSpans:  opts.TrackActiveSpans,
+		DropSpanLogs:      opts.DropSpanLogs,
+		MaxLogsPerSpan:    opts.MaxLogsPerSpan,
+	}
+	rec.reconnectAfterFailures = defaultReconnectAfterFailures
+	if opts.ReconnectAfterFailures > 0 {
+		rec.reconnectAfterFailures = opts.ReconnectAfterFailures
+	}
+	if opts.Backend != nil {
+		rec.backend = opts.Backend
+	} else {
+		rec.collectorURL = getCollectorURL(opts)
+		if opts.CollectorSRV != "" {
+			rec.collectorSRV = opts.CollectorSRV
+			rec.collectorPlaintext = opts.Collector.Plaintext
+			urls, err := rec.resolveCollectorSRV()
+			if err != nil {
+				return nil, fmt.Errorf("LightStep Recorder could not resolve collector: %v", err)
+			}
+			rec.collectorURL = urls[0]
+			rec.srvResolvedAt = now
+		}
+		backend, err := rec.newBackend(rec.collectorURL)
+		if err != nil {
+			return nil, err
+		}
+		rec.backend = backend
 	}
-	rec.backend = lightstep_thrift.NewReportingServiceClientFactory(
-		transport, thrift.NewTBinaryProtocolFactoryDefault())
 
-	go rec.reportLoop()
+	rec.closech = make(chan struct{})
+	rec.loopDone = make(chan struct{})
+	rec.reportDone = newReportOutcome()
+	if opts.OnDroppedSpans != nil {
+		rec.dropch = make(chan struct{}, 1)
+		go rec.notifyDropped(opts.OnDroppedSpans)
+	}
 
-	return rec
+	if opts.ReportStartupSpan {
+		rec.RecordEvent(StartupSpanOperation, rec.configTags(opts))
+	}
+
+	if rec.syncBatchSize > 0 {
+		close(rec.loopDone)
+	} else {
+		go rec.reportLoop()
+	}
+	if rec.queue != nil {
+		go rec.drainQueue()
+	}
+	if opts.Context != nil {
+		go rec.closeWhenDone(opts.Context)
+	}
+
+	return rec, nil
 }
 
 func (r *Recorder) RecordSpan(raw basictracer.RawSpan) {
+	if r.queue != nil {
+		select {
+		case r.queue <- raw:
+			return
+		default:
+			// The queue is full, so buffer the span here instead.
+		}
+	}
 	r.lock.Lock()
-	defer r.lock.Unlock()
+	defer r.unlockAndMaybeReport()
+	r.recordSpanLocked(raw)
+}
 
+// recordSpanLocked buffers raw, unless it is sampled out or filtered.
+// caller must hold r.lock
+func (r *Recorder) recordSpanLocked(raw basictracer.RawSpan) {
 	// Early-out for disabled runtimes.
 	if r.disabled {
 		return
 	}
+	if !r.shouldRecord(&raw) {
+		return
+	}
+	if r.matchesDropTags(&raw) {
+		atomic.AddInt64(&r.counters.filteredSpans, 1)
+		return
+	}
+	// Spans with a positive sampling priority are reported in full, and
+	// displace the oldest buffered spans rather than being dropped.
+	var evicted int
+	if priority, ok := SamplingPriority(&raw); ok && priority > 0 {
+		evicted = r.buffer.makeRoomFor(1, r.buffer.spanSize(&raw))
+	} else {
+		r.degrade(&raw)
+	}
 
-	atomic.AddInt64(&r.counters.droppedSpans, int64(r.buffer.addSpans([]basictracer.RawSpan{raw})))
+	accepted, dropped := r.buffer.addSpan(raw)
+	r.spansRecorded += int64(accepted)
+	r.noteDropped(evicted + dropped)
+	r.signalStream()
 }
 
-func (r *Recorder) Flush() {
+// drainQueue buffers the spans handed over by RecordSpan, in batches, until
+// the Recorder is closed; see Options.RecordQueueSize.
+func (r *Recorder) drainQueue() {
+	for {
+		select {
+		case raw := <-r.queue:
+			r.lock.Lock()
+			r.recordSpanLocked(raw)
+			r.drainQueueLocked()
+			r.lock.Unlock()
+		case <-r.closech:
+			return
+		}
+	}
+}
+
+// drainQueueLocked buffers the spans waiting in r.queue, up to its
+// capacity so that a steady stream of spans cannot hold r.lock forever.
+// caller must hold r.lock
+func (r *Recorder) drainQueueLocked() {
+	for i := 0; i < cap(r.queue); i++ {
+		select {
+		case raw := <-r.queue:
+			r.recordSpanLocked(raw)
+		default:
+			return
+		}
+	}
+}
+
+// RecordSpanRecords buffers spans that are already in thrift form, e.g.
+// when forwarding spans received from another process, to be reported
+// unchanged without converting them again. The records must not be
+// modified afterwards. Sampling, SpanDropTags, and the other options
+// transforming spans do not apply to them.
+func (r *Recorder) RecordSpanRecords(records []*lightstep_thrift.SpanRecord) {
 	r.lock.Lock()
+	defer r.unlockAndMaybeReport()
 
 	if r.disabled {
-		r.lock.Unlock()
 		return
 	}
+	accepted, dropped := r.buffer.addRecords(records)
+	r.spansRecorded += int64(accepted)
+	r.noteDropped(dropped)
+	r.signalStream()
+}
 
-	if r.reportInFlight == true {
-		r.maybeLogError(fmt.Errorf("A previous Report is still in flight; aborting Flush()."))
-		r.lock.Unlock()
+// unlockAndMaybeReport releases r.lock, then, in Synchronous mode, reports
+// the buffer if it holds a full batch and the collector has not asked us
+// to back off.
+// caller must hold r.lock
+func (r *Recorder) unlockAndMaybeReport() {
+	report := r.syncBatchSize > 0 && !r.disabled && r.buffer.len() >= r.syncBatchSize &&
+		r.backoffRemaining(r.clock.Now()) == 0
+	r.lock.Unlock()
+	if report {
+		r.Flush()
+	}
+}
+
+// noteDropped counts spans discarded because the buffer was full, and
+// schedules an Options.OnDroppedSpans notification.
+// caller must hold r.lock
+func (r *Recorder) noteDropped(count int) {
+	if count == 0 {
 		return
 	}
+	atomic.AddInt64(&r.counters.droppedSpans, int64(count))
+	r.spansDropped += int64(count)
+	if r.dropch != nil {
+		atomic.AddInt64(&r.droppedUnnotified, int64(count))
+		// Never block the caller; a pending signal covers these spans too.
+		select {
+		case r.dropch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyDropped runs Options.OnDroppedSpans, outside of r.lock, until the
+// Recorder is closed.
+func (r *Recorder) notifyDropped(onDropped func(count int)) {
+	for {
+		select {
+		case <-r.dropch:
+			if count := atomic.SwapInt64(&r.droppedUnnotified, 0); count > 0 {
+				onDropped(int(count))
+			}
+		case <-r.closech:
+			return
+		}
+	}
+}
+
+// signalStream requests a report in streaming mode.
+// caller must hold r.lock
+func (r *Recorder) signalStream() {
+	if r.streamch != nil {
+		// Never block the caller; a pending signal covers this span too.
+		select {
+		case r.streamch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NewSpanEventListener returns a basictracer span event listener that tracks
+// the number of active spans. Install it as
+// basictracer.Options.NewSpanEventListener.
+func (r *Recorder) NewSpanEventListener() func(basictracer.SpanEvent) {
+	return func(e basictracer.SpanEvent) {
+		switch e.(type) {
+		case basictracer.EventCreate:
+			atomic.AddInt64(&r.activeSpans, 1)
+		case basictracer.EventFinish:
+			atomic.AddInt64(&r.activeSpans, -1)
+		}
+	}
+}
+
+// Stats returns a snapshot of the Recorder's internal state.
+func (r *Recorder) Stats() Stats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return Stats{
+		ActiveSpans:        atomic.LoadInt64(&r.activeSpans),
+		LastConversionTime: r.lastConversionTime,
+		RecordedSpans:      r.spansRecorded,
+		DroppedSpans:       r.spansDropped,
+		ThrottledSpans:     r.spansThrottled,
+		TruncatedLogs:      r.logsTruncated,
+		TruncatedPayloads:  r.payloadsTruncated,
+		TruncatedBytes:     r.bytesTruncated,
+		BufferedSpans:      r.buffer.len(),
+		BufferCapacity:     r.buffer.cap(),
+		BufferedBytes:      r.buffer.bytes,
+		ReportsSent:        r.reportsSent,
+	}
+}
+
+// LastReportError returns when the most recent report completed, and its
+// error, or nil if it succeeded. The time is zero before the first report. A health check can use it to detect that spans are not
+// reaching the collector, e.g. when the error is non-nil and recent.
+func (r *Recorder) LastReportError() (time.Time, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastReportDone, r.lastReportError
+}
+
+// RecordEvent records a discrete event that is not tied to a span, such as a
+// deploy marker. The event is reported with the next batch as a zero-duration
+// span named `name` carrying `tags`.
+func (r *Recorder) RecordEvent(name string, tags map[string]interface{}) {
+	eventTags := make(ot.Tags, len(tags)+1)
+	for k, v := range tags {
+		eventTags[k] = v
+	}
+	eventTags[EventKey] = true
+	r.RecordSpan(basictracer.RawSpan{
+		Context: basictracer.SpanContext{
+			TraceID: r.genGUID(),
+			SpanID:  r.genGUID(),
+			Sampled: true,
+		},
+		Operation: name,
+		Start:     r.clock.Now(),
+		Tags:      eventTags,
+	})
+}
+
+type reportWindow struct {
+	oldest, youngest time.Time
+}
+
+// SetReportWindow sets the time window covered by the next successful
+// report, in place of the window derived from the wall clock. This is
+// intended for replaying historical spans, e.g. imported from logs, so that
+// the collector places them at their true times rather than treating them
+// as current.
+func (r *Recorder) SetReportWindow(oldest, youngest time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.windowOverride = &reportWindow{oldest, youngest}
+}
+
+// configTags describes the effective configuration of the Recorder for the
+// startup span. Credentials are deliberately left out.
+func (r *Recorder) configTags(opts Options) map[string]interface{} {
+	tags := map[string]interface{}{
+		"lightstep.config.collector":           r.collectorURL,
+		"lightstep.config.max_buffered_spans":  r.buffer.cap(),
+		"lightstep.config.reporting_period":    r.maxReportingPeriod.String(),
+		"lightstep.config.drop_span_logs":      opts.DropSpanLogs,
+		"lightstep.config.max_logs_per_span":   opts.MaxLogsPerSpan,
+		"lightstep.config.coalesce_spans":      opts.CoalesceSpans,
+		"lightstep.config.stream_spans":        opts.StreamSpans,
+		"lightstep.config.trace_sampling_rate": opts.TraceSamplingRate,
+	}
+	if len(opts.PerOperationSampleRates) > 0 {
+		if rates, err := formatAttributeValue(opts.PerOperationSampleRates); err == nil {
+			tags["lightstep.config.per_operation_sample_rates"] = rates
+		}
+	}
+	return tags
+}
+
+// Flush sends the buffered spans to the collector. It is safe to call
+// concurrently: overlapping calls are queued behind the report in flight,
+// and each then reports whatever was recorded in the meantime.
+//
+// Flush returns ErrRecorderDisabled if the Recorder is disabled, the
+// transport error if the report could not be sent (the spans are then kept
+// for the next report), or CollectorErrors if the collector reported
+// errors.
+func (r *Recorder) Flush() error {
+	return r.FlushWithContext(context.Background())
+}
+
+// FlushWithContext is like Flush, but aborts the report RPC when ctx is
+// done, returning ctx.Err() and keeping the spans for the next report.
+func (r *Recorder) FlushWithContext(ctx context.Context) error {
+	// A Disable command is acted on once flushLock is released, so that
+	// Disable can drain the buffer.
+	var disable bool
+	r.flushLock.Lock()
+	defer func() {
+		r.flushLock.Unlock()
+		if disable {
+			r.Disable()
+		}
+	}()
+
+	r.lock.Lock()
+	refresh := r.collectorSRV != "" && r.clock.Now().Sub(r.srvResolvedAt) >= srvRefreshInterval
+	r.lock.Unlock()
+	if refresh {
+		r.refreshCollector(false)
+	}
 
-	now := time.Now()
+	r.lock.Lock()
+
+	if r.disabled {
+		r.finishReport(ErrRecorderDisabled)
+		r.lock.Unlock()
+		return ErrRecorderDisabled
+	}
+	r.drainQueueLocked()
+
+	now := r.clock.Now()
 	r.lastReportAttempt = now
 	r.reportYoungest = now
 
+	if r.reportCPUChanges {
+		r.updateCPUAttributes()
+	}
+
 	rawSpans := r.buffer.current()
-	// Convert them to thrift.
-	recs := make([]*lightstep_thrift.SpanRecord, len(rawSpans))
-	// TODO: could pool lightstep_thrift.SpanRecords
-	for i, raw := range rawSpans {
-		var joinIds []*lightstep_thrift.TraceJoinId
-		var attributes []*lightstep_thrift.KeyValue
-		for key, value := range raw.Tags {
-			if strings.HasPrefix(key, "join:") {
-				joinIds = append(joinIds, &lightstep_thrift.TraceJoinId{key, fmt.Sprint(value)})
-			} else {
-				attributes = append(attributes, &lightstep_thrift.KeyValue{key, fmt.Sprint(value)})
-			}
+	if r.rateLimiter != nil {
+		if allowed := r.rateLimiter.take(now, len(rawSpans)); allowed < len(rawSpans) {
+			throttled := len(rawSpans) - allowed
+			rawSpans = rawSpans[:allowed]
+			atomic.AddInt64(&r.counters.throttledSpans, int64(throttled))
+			r.spansThrottled += int64(throttled)
+			r.noteDropped(throttled)
 		}
-		logs := make([]*lightstep_thrift.LogRecord, len(raw.Logs))
-		for j, log := range raw.Logs {
-			thriftLogRecord := &lightstep_thrift.LogRecord{
-				TimestampMicros: thrift.Int64Ptr(log.Timestamp.UnixNano() / 1000),
-			}
-			// In the deprecated thrift case, we can reuse a single "field"
-			// encoder across all of the N log fields.
-			lfe := logFieldEncoder{thriftLogRecord, r}
-			for _, f := range log.Fields {
-				f.Marshal(&lfe)
-			}
-			logs[j] = thriftLogRecord
+	}
+	if r.groupByTrace {
+		groupByTrace(rawSpans)
+	}
+	groupByComponent(rawSpans)
+	records := r.buffer.currentRecords()
+	r.reportPayloadBytes = 0
+	// Convert them to thrift.
+	conversionStart := time.Now()
+	recs := make([]*lightstep_thrift.SpanRecord, 0, len(rawSpans))
+	converted := rawSpans[:0]
+	for _, raw := range rawSpans {
+		rec, err := r.convertSpanSafely(raw)
+		if err != nil {
+			// Skip the span rather than losing the whole report.
+			atomic.AddInt64(&r.counters.unconvertibleSpans, 1)
+			r.maybeLogError(err)
+			continue
 		}
+		recs = append(recs, rec)
+		converted = append(converted, raw)
+	}
+	rawSpans = converted
 
-		// TODO implement baggage
-		if raw.ParentSpanID != 0 {
-			attributes = append(attributes, &lightstep_thrift.KeyValue{ParentSpanGUIDKey,
-				strconv.FormatUint(raw.ParentSpanID, 16)})
+	// Widen the report window to cover every span in it, e.g. spans whose
+	// Start was set explicitly to before the window opened.
+	for _, raw := range rawSpans {
+		if raw.Start.Before(r.reportOldest) {
+			r.reportOldest = raw.Start
 		}
-
-		recs[i] = &lightstep_thrift.SpanRecord{
-			SpanGuid:       thrift.StringPtr(strconv.FormatUint(raw.Context.SpanID, 16)),
-			TraceGuid:      thrift.StringPtr(strconv.FormatUint(raw.Context.TraceID, 16)),
-			SpanName:       thrift.StringPtr(raw.Operation),
-			JoinIds:        joinIds,
-			OldestMicros:   thrift.Int64Ptr(raw.Start.UnixNano() / 1000),
-			YoungestMicros: thrift.Int64Ptr(raw.Start.Add(raw.Duration).UnixNano() / 1000),
-			Attributes:     attributes,
-			LogRecords:     logs,
+	}
+	for _, record := range records {
+		if start := time.Unix(0, record.GetOldestMicros()*1000); start.Before(r.reportOldest) {
+			r.reportOldest = start
 		}
 	}
+	recs = append(recs, records...)
+
+	r.lastConversionTime = time.Since(conversionStart)
+	conversionMicros := int64(r.lastConversionTime / time.Microsecond)
 
-	// TODO the handling of droppedPending / droppedSpans is very
-	// manual. Add abstraction for the second client-side count to
-	// avoid duplicating all the atomic ops.
-	droppedPending := atomic.SwapInt64(&r.counters.droppedSpans, 0)
+	pending := r.counters.swap()
 
+	if r.suppressEmptyReports && len(recs) == 0 && pending.isZero() {
+		// Nothing worth an RPC; the window stays open for the next report.
+		r.finishReport(nil)
+		r.lock.Unlock()
+		return nil
+	}
+
+	reported := pending
+	if r.counterMode == CounterModeCumulative {
+		reported = r.counterTotals.plus(pending)
+	}
 	metrics := lightstep_thrift.Metrics{
-		Counts: []*lightstep_thrift.MetricsSample{
+		Counts: reported.metricsSamples(),
+		Gauges: []*lightstep_thrift.MetricsSample{
 			&lightstep_thrift.MetricsSample{
-				Name:       "spans.dropped",
-				Int64Value: &droppedPending,
+				Name:       "report.conversion_micros",
+				Int64Value: &conversionMicros,
 			},
 		},
 	}
-	req := &lightstep_thrift.ReportRequest{
-		OldestMicros:    thrift.Int64Ptr(r.reportOldest.UnixNano() / 1000),
-		YoungestMicros:  thrift.Int64Ptr(r.reportYoungest.UnixNano() / 1000),
-		Runtime:         r.thriftRuntime(),
-		SpanRecords:     recs,
-		InternalMetrics: &metrics,
+	oldest, youngest := r.reportOldest, r.reportYoungest
+	if r.windowOverride != nil {
+		oldest, youngest = r.windowOverride.oldest, r.windowOverride.youngest
+	}
+	// Each component's spans are reported in chunks of at most
+	// maxSpansPerReport spans, all sent in turn. Only the first chunk
+	// carries the metrics.
+	var chunks []componentReport
+	for _, part := range r.splitByComponent(rawSpans, recs) {
+		for _, chunk := range chunkSpanRecords(part.records, r.maxSpansPerReport) {
+			chunks = append(chunks, componentReport{part.runtime, chunk})
+		}
 	}
+	oldestMicros := thrift.Int64Ptr(oldest.UnixNano() / 1000)
+	youngestMicros := thrift.Int64Ptr(youngest.UnixNano() / 1000)
 
 	// Do *not* wait until the report RPC finishes to clear the buffer.
 	// Consider the case of a new span coming in during the RPC: it'll be
@@ -344,53 +1360,374 @@ func (r *Recorder) Flush() {
 	r.buffer.reset()
 
 	r.reportInFlight = true
+	r.reportCtx = ctx
+	backend := r.backend
 	r.lock.Unlock() // unlock before making the RPC itself
 
-	resp, err := r.backend.Report(r.auth, req)
-	if err != nil {
-		r.maybeLogError(err)
-	} else if len(resp.Errors) > 0 {
-		// These should never occur, since this library should understand what
-		// makes for valid logs and spans, but just in case, log it anyway.
-		for _, err := range resp.Errors {
-			r.maybeLogError(fmt.Errorf("Remote report returned error: %s", err))
+	var (
+		err          error
+		remoteErrors CollectorErrors
+		commands     []*lightstep_thrift.Command
+		sentChunks   int
+		sentSpans    int
+	)
+	for i, chunk := range chunks {
+		if i > 0 && ctx.Err() != nil {
+			err = ctx.Err()
+			break
 		}
-	} else {
-		r.maybeLogInfof("Report: resp=%v, err=%v", resp, err)
+		req := &lightstep_thrift.ReportRequest{
+			OldestMicros:   oldestMicros,
+			YoungestMicros: youngestMicros,
+			Runtime:        chunk.runtime,
+			SpanRecords:    chunk.records,
+		}
+		if i == 0 {
+			req.InternalMetrics = &metrics
+		}
+		var resp *lightstep_thrift.ReportResponse
+		resp, err = backend.Report(r.auth, req)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			r.maybeLogError(err)
+			break
+		}
+		if len(resp.Errors) > 0 {
+			// These should never occur, since this library should understand what
+			// makes for valid logs and spans, but just in case, log it anyway.
+			for _, err := range resp.Errors {
+				r.maybeLogError(fmt.Errorf("Remote report returned error: %s", err))
+			}
+			remoteErrors = append(remoteErrors, resp.Errors...)
+		} else {
+			r.maybeLogInfof("Report: resp=%v, err=%v", resp, err)
+		}
+		commands = append(commands, resp.Commands...)
+		sentChunks++
+		sentSpans += len(chunk.records)
+	}
+	var remoteErr error
+	if len(remoteErrors) > 0 {
+		remoteErr = remoteErrors
 	}
 
 	r.lock.Lock()
 	r.reportInFlight = false
+	r.reportCtx = nil
+	r.lastReportDone = r.clock.Now()
+	r.reportsSent += int64(sentChunks)
+	if sentChunks > 0 && r.counterMode == CounterModeCumulative {
+		r.counterTotals = r.counterTotals.plus(pending)
+	}
 	if err != nil {
-		// Restore the records that did not get sent correctly
-		atomic.AddInt64(&r.counters.droppedSpans, int64(r.buffer.addSpans(rawSpans))+droppedPending)
+		r.lastReportError = err
+		r.finishReport(err)
+		// Restore the records that did not get sent correctly: those of
+		// the failed chunk and any after it.
+		unsentSpans, unsentRecords := rawSpans, records
+		if sentSpans < len(rawSpans) {
+			unsentSpans = rawSpans[sentSpans:]
+		} else {
+			unsentSpans = nil
+			unsentRecords = records[sentSpans-len(rawSpans):]
+		}
+		r.noteDropped(r.buffer.restore(unsentSpans, unsentRecords))
+		if sentChunks == 0 {
+			r.counters.add(pending)
+		}
+		// A report abandoned with its context says nothing of the
+		// connection.
+		if err != ctx.Err() {
+			r.reportFailures++
+		}
+		reconnect := r.collectorURL != "" && r.reportFailures >= r.reconnectAfterFailures
 		r.lock.Unlock()
-		return
+		disable = r.applyCommands(commands)
+		if r.collectorSRV != "" {
+			r.refreshCollector(true)
+		}
+		if reconnect {
+			r.reconnect(backend)
+		}
+		return err
 	}
 
+	r.lastReportError = remoteErr
+	r.finishReport(remoteErr)
+	r.reportFailures = 0
+
 	// Reset the buffers
 	r.reportOldest = now
 	r.reportYoungest = now
+	r.windowOverride = nil
 
 	// TODO something about timing
 	r.lock.Unlock()
 
-	if droppedPending != 0 {
-		r.maybeLogInfof("client reported %d dropped spans", droppedPending)
+	if pending.droppedSpans != 0 {
+		r.maybeLogInfof("client reported %d dropped spans", pending.droppedSpans)
 	}
 
-	for _, c := range resp.Commands {
+	disable = r.applyCommands(commands)
+	return remoteErr
+}
+
+// applyCommands passes the collector's commands to Options.OnCommand,
+// returning whether one of them disables the Recorder.
+func (r *Recorder) applyCommands(commands []*lightstep_thrift.Command) (disable bool) {
+	for _, c := range commands {
+		if r.onCommand != nil {
+			r.onCommand(c)
+		}
 		if c.Disable != nil && *c.Disable {
-			r.Disable()
+			disable = true
+		}
+	}
+	return disable
+}
+
+// chunkSpanRecords splits recs into chunks of at most size records, or a
+// single chunk if size is not positive. There is always at least one chunk,
+// so that an empty buffer is still reported.
+func chunkSpanRecords(recs []*lightstep_thrift.SpanRecord, size int) [][]*lightstep_thrift.SpanRecord {
+	if size <= 0 || len(recs) <= size {
+		return [][]*lightstep_thrift.SpanRecord{recs}
+	}
+	chunks := make([][]*lightstep_thrift.SpanRecord, 0, (len(recs)+size-1)/size)
+	for len(recs) > size {
+		chunks = append(chunks, recs[:size])
+		recs = recs[size:]
+	}
+	return append(chunks, recs)
+}
+
+// ForceFlush reports everything recorded so far, flushing until the buffer
+// is empty and no report is in flight, so that once it returns nil every
+// span recorded before the call has reached the collector. Unlike Flush,
+// a report that fails is retried, every half second or once any backoff
+// requested by the collector expires, until ctx is done; ForceFlush then
+// returns the last report error, or ctx.Err() if spans were still being
+// recorded faster than they could be reported.
+func (r *Recorder) ForceFlush(ctx context.Context) error {
+	for {
+		err := r.FlushWithContext(ctx)
+		if err == ErrRecorderDisabled {
+			return err
+		}
+		if _, ok := err.(CollectorErrors); err == nil || ok {
+			// The report was delivered, if not every span in it accepted.
+			r.lock.Lock()
+			drained := r.buffer.len() == 0 && !r.reportInFlight
+			r.lock.Unlock()
+			if drained {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		r.lock.Lock()
+		wait := r.backoffRemaining(r.clock.Now())
+		r.lock.Unlock()
+		if wait < minReportingPeriod {
+			wait = minReportingPeriod
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-r.clock.After(wait):
+		}
+	}
+}
+
+// WaitForFlush blocks until the next flush returns, whether started by the
+// report loop or by a call to Flush, and returns its error as Flush would:
+// nil for an empty report skipped under SuppressEmptyReports, and
+// ErrRecorderDisabled if the Recorder is, or meanwhile becomes, disabled.
+// It returns ctx.Err() if ctx is done first. It lets tests wait for the report loop
+// to deliver what they recorded, rather than sleeping past the reporting
+// period.
+func (r *Recorder) WaitForFlush(ctx context.Context) error {
+	r.lock.Lock()
+	if r.disabled {
+		r.lock.Unlock()
+		return ErrRecorderDisabled
+	}
+	outcome := r.reportDone
+	r.lock.Unlock()
+	select {
+	case <-outcome.done:
+		return outcome.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reportOutcome is the result of a flush, available once done is closed.
+type reportOutcome struct {
+	done chan struct{}
+	err  error
+}
+
+func newReportOutcome() *reportOutcome {
+	return &reportOutcome{done: make(chan struct{})}
+}
+
+// finishReport wakes WaitForFlush with the outcome of the current flush.
+// caller must hold r.lock
+func (r *Recorder) finishReport(err error) {
+	r.reportDone.err = err
+	close(r.reportDone.done)
+	r.reportDone = newReportOutcome()
+}
+
+// convertSpanSafely converts raw to thrift, returning an error rather than
+// panicking if the conversion (e.g. of a pathological log payload) panics.
+// caller must hold r.lock
+func (r *Recorder) convertSpanSafely(raw basictracer.RawSpan) (rec *lightstep_thrift.SpanRecord, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("could not convert span %q: %v", raw.Operation, p)
+		}
+	}()
+	return r.convertSpan(raw), nil
+}
+
+// caller must hold r.lock
+func (r *Recorder) convertSpan(raw basictracer.RawSpan) *lightstep_thrift.SpanRecord {
+	var joinIds []*lightstep_thrift.TraceJoinId
+	var attributes []*lightstep_thrift.KeyValue
+	for key, value := range raw.Tags {
+		if strings.HasPrefix(key, "join:") {
+			joinIds = append(joinIds, &lightstep_thrift.TraceJoinId{key, formatTagValue(value)})
+		} else if strings.HasPrefix(key, ComponentAttributePrefix) {
+			// Reported in the runtime; see splitByComponent.
+		} else if !r.isAttributeAllowed(key) {
+			atomic.AddInt64(&r.counters.droppedTags, 1)
+		} else if links, ok := value.([]SpanLink); ok && key == SpanLinksKey {
+			attributes = r.appendSpanLinks(attributes, links)
+		} else {
+			attributes = append(attributes, &lightstep_thrift.KeyValue{key, formatTagValue(value)})
+		}
+	}
+	logs := make([]*lightstep_thrift.LogRecord, len(raw.Logs))
+	for j, log := range raw.Logs {
+		thriftLogRecord := &lightstep_thrift.LogRecord{
+			TimestampMicros: thrift.Int64Ptr(log.Timestamp.UnixNano() / 1000),
+		}
+		// In the deprecated thrift case, we can reuse a single "field"
+		// encoder across all of the N log fields.
+		lfe := logFieldEncoder{thriftLogRecord, r}
+		for _, f := range log.Fields {
+			f.Marshal(&lfe)
+		}
+		logs[j] = thriftLogRecord
+	}
+
+	if len(raw.Context.Baggage) > 0 {
+		keys := make([]string, 0, len(raw.Context.Baggage))
+		for k := range raw.Context.Baggage {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			attributes = append(attributes, &lightstep_thrift.KeyValue{BaggageKeyPrefix + k,
+				raw.Context.Baggage[k]})
+		}
+	}
+	if raw.ParentSpanID != 0 {
+		attributes = append(attributes, &lightstep_thrift.KeyValue{ParentSpanGUIDKey,
+			r.formatID(raw.ParentSpanID)})
+	}
+
+	// Derive the end time from the span's (monotonic) Duration rather
+	// than from wall-clock arithmetic, so that the reported duration is
+	// exactly Duration regardless of how Start was obtained. basictracer
+	// records no finish timestamp to use instead. Both are rounded to the
+	// nearest microsecond, so a sub-microsecond span isn't reported as
+	// taking no time at all.
+	oldestMicros := roundMicros(raw.Start.UnixNano())
+	youngestMicros := oldestMicros + roundMicros(int64(raw.Duration))
+	rec := &lightstep_thrift.SpanRecord{
+		SpanGuid:       thrift.StringPtr(r.formatID(raw.Context.SpanID)),
+		TraceGuid:      thrift.StringPtr(r.formatID(raw.Context.TraceID)),
+		SpanName:       thrift.StringPtr(r.operationNamePrefix + raw.Operation),
+		JoinIds:        joinIds,
+		OldestMicros:   thrift.Int64Ptr(oldestMicros),
+		YoungestMicros: thrift.Int64Ptr(youngestMicros),
+		Attributes:     attributes,
+		LogRecords:     logs,
+	}
+	if isErrorSpan(&raw) {
+		rec.ErrorFlag = thrift.BoolPtr(true)
+	}
+	return rec
+}
+
+// isErrorSpan reports whether raw is tagged as failed with ext.Error, as a
+// bool or a string such as "true". The collector recognizes failed spans by
+// the record's error flag; the tag, formatted as a string attribute, is
+// only displayed.
+func isErrorSpan(raw *basictracer.RawSpan) bool {
+	switch v := raw.Tags[string(ext.Error)].(type) {
+	case bool:
+		return v
+	case string:
+		isError, _ := strconv.ParseBool(v)
+		return isError
+	}
+	return false
+}
+
+// roundMicros converts a non-negative number of nanoseconds to the nearest
+// microsecond, rounding halves up.
+func roundMicros(nanos int64) int64 {
+	return (nanos + 500) / 1000
+}
+
+func formatIDHex(id uint64) string {
+	return strconv.FormatUint(id, 16)
+}
+
+// matchesDropTags reports whether raw carries any of Options.SpanDropTags.
+func (r *Recorder) matchesDropTags(raw *basictracer.RawSpan) bool {
+	for key, dropValue := range r.spanDropTags {
+		if value, ok := raw.Tags[key]; ok && formatTagValue(value) == dropValue {
+			return true
 		}
 	}
+	return false
+}
+
+// isAttributeAllowed reports whether a span tag with the given key may be
+// reported under the configured AttributeAllowlist. The coalesced span count
+// is internal bookkeeping and is always allowed.
+func (r *Recorder) isAttributeAllowed(key string) bool {
+	if r.attributeAllowlist == nil || key == CoalescedCountKey {
+		return true
+	}
+	_, ok := r.attributeAllowlist[key]
+	return ok
 }
 
 // caller must hold r.lock
 func (r *Recorder) thriftRuntime() *lightstep_thrift.Runtime {
-	runtimeAttrs := []*lightstep_thrift.KeyValue{}
-	for k, v := range r.attributes {
-		runtimeAttrs = append(runtimeAttrs, &lightstep_thrift.KeyValue{k, v})
+	return r.runtimeWith(r.attributes)
+}
+
+// runtimeWith is like thriftRuntime, but with the given attributes.
+func (r *Recorder) runtimeWith(attributes map[string]string) *lightstep_thrift.Runtime {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	runtimeAttrs := make([]*lightstep_thrift.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		runtimeAttrs = append(runtimeAttrs, &lightstep_thrift.KeyValue{k, attributes[k]})
 	}
 	return &lightstep_thrift.Runtime{
 		StartMicros: thrift.Int64Ptr(r.startTime.UnixNano() / 1000),
@@ -398,18 +1735,84 @@ func (r *Recorder) thriftRuntime() *lightstep_thrift.Runtime {
 	}
 }
 
+// Disable discards any buffered spans, after flushing them if
+// Options.DrainOnDisable is set, and stops recording and reporting until
+// Enable is called. The collector disables a Recorder by returning a
+// Disable command.
 func (r *Recorder) Disable() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	if r.disabled {
+	if r.disabled || r.draining {
 		return
 	}
+	if r.drainOnDisable {
+		r.draining = true
+		r.lock.Unlock()
+		if err := r.Flush(); err != nil {
+			r.maybeLogError(fmt.Errorf("could not drain buffered spans before disabling: %v", err))
+		}
+		r.lock.Lock()
+		r.draining = false
+		if r.disabled {
+			return
+		}
+	}
 
 	fmt.Printf("Disabling Runtime instance: %p", r)
 
 	r.buffer.reset()
 	r.disabled = true
+	r.finishReport(ErrRecorderDisabled)
+}
+
+// Enable resumes recording and reporting after Disable, e.g. from an
+// Options.OnCommand callback or once the application decides a collector
+// disable was transient. It has no effect on a closed Recorder.
+func (r *Recorder) Enable() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.disabled || r.closed {
+		return
+	}
+
+	r.maybeLogInfof("re-enabling Runtime instance: %p", r)
+
+	// Don't let the next report's window cover the time spent disabled.
+	now := r.clock.Now()
+	r.reportOldest = now
+	r.reportYoungest = now
+	r.disabled = false
+}
+
+// SetReportingPeriod changes the maximum time between reports, as set by
+// Options.ReportingPeriod, from the report loop's next check on. It returns
+// an error, leaving the period unchanged, if d is below the minimum of
+// 500ms.
+func (r *Recorder) SetReportingPeriod(d time.Duration) error {
+	if d < minReportingPeriod {
+		return fmt.Errorf("ReportingPeriod %v is below the minimum of %v", d, minReportingPeriod)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.maxReportingPeriod = d
+	return nil
+}
+
+// SetMaxBufferedSpans changes the capacity of the span buffer, as set by
+// Options.MaxBufferedSpans. Spans that no longer fit are dropped, and
+// counted as such, according to Options.OverflowPolicy: the oldest under
+// OverflowDropOldest, otherwise the most recently recorded. It returns an
+// error, leaving the buffer unchanged, if n is not positive.
+func (r *Recorder) SetMaxBufferedSpans(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("MaxBufferedSpans %d is not positive", n)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.noteDropped(r.buffer.resize(n))
+	return nil
 }
 
 // Every minReportingPeriod the reporting loop wakes up and checks to see if
@@ -429,50 +1832,178 @@ func (r *Recorder) shouldFlush() bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	if time.Now().Add(minReportingPeriod).Sub(r.lastReportAttempt) > r.maxReportingPeriod {
+	now := r.clock.Now()
+	if r.backoffRemaining(now) > 0 {
+		// The collector asked us to back off.
+		r.maybeLogInfof("--> backing off")
+		return false
+	}
+
+	if now.Add(minReportingPeriod).Sub(r.lastReportAttempt) > r.maxReportingPeriod {
 		// Flush timeout.
 		r.maybeLogInfof("--> timeout")
 		return true
-	} else if r.buffer.len() > r.buffer.cap()/2 {
+	} else if n := r.buffer.len(); float64(n) > float64(r.buffer.cap())*r.flushThresholdRatio || n >= r.buffer.cap() {
 		// Too many queued span records.
 		r.maybeLogInfof("--> span queue")
 		return true
+	} else if r.buffer.maxBytes > 0 && float64(r.buffer.bytes) > float64(r.buffer.maxBytes)*r.flushThresholdRatio {
+		// Too many queued bytes.
+		r.maybeLogInfof("--> span bytes")
+		return true
+	} else if r.maxSpanDelay > 0 && !r.buffer.oldestAdded.IsZero() &&
+		now.Sub(r.buffer.oldestAdded) >= r.maxSpanDelay-r.delayCheckPeriod() {
+		// The oldest span would exceed its delay bound by the next check.
+		r.maybeLogInfof("--> span delay")
+		return true
 	}
 	return false
 }
 
-func (r *Recorder) reportLoop() {
-	// (Thrift really should do this internally, but we saw some too-many-fd's
-	// errors and thrift is the most likely culprit.)
-	switch b := r.backend.(type) {
+// backoffRemaining returns how long the collector has asked us to wait,
+// from now, before sending another report.
+// caller must hold r.lock
+func (r *Recorder) backoffRemaining(now time.Time) time.Duration {
+	if now.Before(r.backoffUntil) {
+		return r.backoffUntil.Sub(now)
+	}
+	return 0
+}
+
+// delayCheckPeriod is how often the report loop checks whether to flush. It
+// is tightened to a fraction of Options.MaxSpanDelay if that is set, so that
+// spans are flushed before exceeding it.
+func (r *Recorder) delayCheckPeriod() time.Duration {
+	if r.maxSpanDelay > 0 && r.maxSpanDelay/4 < minReportingPeriod {
+		return r.maxSpanDelay / 4
+	}
+	return minReportingPeriod
+}
+
+// Close flushes any buffered spans, stops the reporting loop (waiting for
+// an in-flight report to finish), and closes the connection to the
+// collector, returning any error from the final report. Spans recorded
+// afterwards are discarded. Close may be called more than once.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.lock.Unlock()
+
+	close(r.closech)
+	<-r.loopDone
+
+	err := r.Flush()
+	if err == ErrRecorderDisabled {
+		err = nil
+	}
+
+	r.lock.Lock()
+	r.buffer.reset()
+	r.disabled = true
+	r.lock.Unlock()
+	if closeErr := r.closeBackend(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeBackend closes the transport of the thrift client. (Thrift really
+// should do this internally, but we saw some too-many-fd's errors and thrift
+// is the most likely culprit.)
+func (r *Recorder) closeBackend() error {
+	r.lock.Lock()
+	backend := r.backend
+	r.lock.Unlock()
+	return closeTransport(backend)
+}
+
+// closeTransport closes backend's transport, if it is a thrift client.
+func closeTransport(backend lightstep_thrift.ReportingService) error {
+	switch b := backend.(type) {
 	case *lightstep_thrift.ReportingServiceClient:
-		// TODO This is a bit racy with other calls to Flush, but we're
-		// currently assuming that no one calls Flush after Disable.
-		defer b.Transport.Close()
+		return b.Transport.Close()
 	}
+	return nil
+}
 
-	tickerChan := time.Tick(minReportingPeriod)
-	for range tickerChan {
-		r.maybeLogInfof("reporting alarm fired")
+func (r *Recorder) reportLoop() {
+	defer close(r.loopDone)
+
+	ticker := r.clock.NewTicker(r.delayCheckPeriod())
+	defer ticker.Stop()
+
+	// Streamed reports are rate-limited by ignoring streamch until
+	// streamResume fires.
+	streamch := r.streamch
+	var streamResume <-chan time.Time
+	for {
+		select {
+		case <-r.closech:
+			// Close sends the final report and closes the transport.
+			return
+		case <-ticker.Chan():
+			r.maybeLogInfof("reporting alarm fired")
+
+			// Stay alive while disabled, so that reporting resumes if
+			// the Recorder is re-enabled.
+			r.lock.Lock()
+			disabled := r.disabled
+			r.lock.Unlock()
 
-		// Kill the reportLoop() if we've been disabled.
-		r.lock.Lock()
-		if r.disabled {
+			if !disabled && r.shouldFlush() {
+				r.Flush()
+			}
+		case <-streamch:
+			r.lock.Lock()
+			wait := r.backoffRemaining(r.clock.Now())
+			if wait > 0 {
+				// Keep the request pending until the backoff expires.
+				r.signalStream()
+			}
 			r.lock.Unlock()
-			break
+			if wait == 0 {
+				r.Flush()
+				wait = r.streamInterval
+			}
+			// Rate-limit streamed reports; spans recorded meanwhile are
+			// batched into the next one.
+			streamch, streamResume = nil, r.clock.After(wait)
+		case <-streamResume:
+			streamch, streamResume = r.streamch, nil
 		}
-		r.lock.Unlock()
+	}
+}
 
-		if r.shouldFlush() {
-			r.Flush()
-		}
+// closeWhenDone closes the Recorder once ctx is done; see Options.Context.
+func (r *Recorder) closeWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		// The final report's errors are logged by Flush.
+		r.Close()
+	case <-r.closech:
 	}
 }
 
+func basicAuthHeader(username, password string) string {
+	credentials := username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
 func getCollectorURL(opts Options) string {
 	return getURL(opts.Collector,
 		defaultCollectorHost,
-		collectorPath)
+		getCollectorPath(opts))
+}
+
+func getCollectorPath(opts Options) string {
+	if opts.CollectorPath != "" {
+		return opts.CollectorPath
+	}
+	return opts.ThriftProtocol.collectorPath()
 }
 
 func getAPIURL(opts Options) string {
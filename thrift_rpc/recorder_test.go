@@ -0,0 +1,2392 @@
+package thrift_rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// mockReportingService records every ReportRequest it receives.
+type mockReportingService struct {
+	lock     sync.Mutex
+	requests []*lightstep_thrift.ReportRequest
+	response *lightstep_thrift.ReportResponse
+	err      error
+}
+
+func (m *mockReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests = append(m.requests, copyReportRequest(request))
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.response != nil {
+		return m.response, nil
+	}
+	return &lightstep_thrift.ReportResponse{}, nil
+}
+
+func (m *mockReportingService) requestCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.requests)
+}
+
+func (m *mockReportingService) lastRequest() *lightstep_thrift.ReportRequest {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.requests) == 0 {
+		return nil
+	}
+	return m.requests[len(m.requests)-1]
+}
+
+// testCollector is an HTTP server speaking the collector's thrift protocol.
+// Decoded reports are recorded by its mockReportingService.
+type testCollector struct {
+	*httptest.Server
+	backend *mockReportingService
+
+	lock    sync.Mutex
+	headers []http.Header
+	paths   []string
+	sizes   []int // request body sizes on the wire
+}
+
+func newTestCollector() *testCollector {
+	return newTestCollectorProtocol(thrift.NewTBinaryProtocolFactoryDefault())
+}
+
+// newTestCollectorProtocol returns a testCollector decoding reports with the
+// given protocol.
+func newTestCollectorProtocol(factory thrift.TProtocolFactory) *testCollector {
+	c := &testCollector{backend: &mockReportingService{}}
+	processor := lightstep_thrift.NewReportingServiceProcessor(c.backend)
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.lock.Lock()
+		c.headers = append(c.headers, req.Header)
+		c.paths = append(c.paths, req.URL.Path)
+		c.lock.Unlock()
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.lock.Lock()
+		c.sizes = append(c.sizes, len(body))
+		c.lock.Unlock()
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, err = ioutil.ReadAll(zr)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		in := thrift.NewTMemoryBuffer()
+		in.Write(body)
+		out := thrift.NewTMemoryBuffer()
+		processor.Process(factory.GetProtocol(in), factory.GetProtocol(out))
+		w.Write(out.Bytes())
+	}))
+	return c
+}
+
+// endpoint returns the plaintext Endpoint the collector is listening on.
+func (c *testCollector) endpoint() Endpoint {
+	host, port, _ := net.SplitHostPort(c.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return Endpoint{Host: host, Port: portNum, Plaintext: true}
+}
+
+func (c *testCollector) lastPath() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.paths) == 0 {
+		return ""
+	}
+	return c.paths[len(c.paths)-1]
+}
+
+func (c *testCollector) lastHeader() http.Header {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.headers) == 0 {
+		return nil
+	}
+	return c.headers[len(c.headers)-1]
+}
+
+// newTestRecorder returns a Recorder reporting to a mockReportingService. The
+// report loop is held off so that tests drive Flush() explicitly.
+func newTestRecorder(opts Options) (*Recorder, *mockReportingService) {
+	if opts.AccessToken == "" {
+		opts.AccessToken = "0987654321"
+	}
+	if opts.MaxLogMessageLen == 0 {
+		opts.MaxLogMessageLen = 1024
+	}
+	rec := NewRecorder(opts)
+	backend := &mockReportingService{}
+	rec.lock.Lock()
+	rec.backend = backend
+	rec.lastReportAttempt = rec.clock.Now()
+	rec.lock.Unlock()
+	return rec, backend
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+func makeRawSpan(operation string, tags ot.Tags) basictracer.RawSpan {
+	return basictracer.RawSpan{
+		Context: basictracer.SpanContext{
+			TraceID: 1,
+			SpanID:  2,
+			Sampled: true,
+		},
+		Operation: operation,
+		Start:     time.Now(),
+		Duration:  time.Millisecond,
+		Tags:      tags,
+	}
+}
+
+func findAttribute(attrs []*lightstep_thrift.KeyValue, key string) (string, bool) {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return "", false
+}
+
+func findMetric(req *lightstep_thrift.ReportRequest, name string) int64 {
+	for _, m := range req.InternalMetrics.Counts {
+		if m.Name == name {
+			return m.GetInt64Value()
+		}
+	}
+	return 0
+}
+
+func TestAttributeAllowlist(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		AttributeAllowlist: []string{"allowed"},
+	})
+	raw := makeRawSpan("op", ot.Tags{
+		"allowed":     "yes",
+		"secret":      "no",
+		"join:user":   "abc",
+		"also_secret": 42,
+	})
+	raw.ParentSpanID = 7
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 {
+		t.Fatalf("expected a report with one span, got %v", req)
+	}
+	span := req.SpanRecords[0]
+	if v, ok := findAttribute(span.Attributes, "allowed"); !ok || v != "yes" {
+		t.Errorf("allowlisted tag missing: %v", span.Attributes)
+	}
+	for _, key := range []string{"secret", "also_secret"} {
+		if _, ok := findAttribute(span.Attributes, key); ok {
+			t.Errorf("non-allowlisted tag %q was reported", key)
+		}
+	}
+	if _, ok := findAttribute(span.Attributes, ParentSpanGUIDKey); !ok {
+		t.Errorf("parent span guid should always be reported")
+	}
+	if len(span.JoinIds) != 1 || span.JoinIds[0].TraceKey != "join:user" {
+		t.Errorf("join tags should always be reported: %v", span.JoinIds)
+	}
+	if dropped := findMetric(req, "tags.dropped"); dropped != 2 {
+		t.Errorf("expected 2 dropped tags, got %d", dropped)
+	}
+}
+
+func TestAttributeAllowlistUnset(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.RecordSpan(makeRawSpan("op", ot.Tags{"a": 1, "b": 2}))
+	rec.Flush()
+
+	span := backend.lastRequest().SpanRecords[0]
+	if len(span.Attributes) != 2 {
+		t.Errorf("expected all tags to be reported, got %v", span.Attributes)
+	}
+}
+
+func TestCoalesceSpans(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		CoalesceSpans:   true,
+		CoalesceKeyTags: []string{"target"},
+	})
+	for i := 0; i < 10; i++ {
+		rec.RecordSpan(makeRawSpan("poll", ot.Tags{"target": "db"}))
+	}
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 1 {
+		t.Fatalf("expected one coalesced span, got %d", len(req.SpanRecords))
+	}
+	if v, _ := findAttribute(req.SpanRecords[0].Attributes, CoalescedCountKey); v != "10" {
+		t.Errorf("expected coalesced count 10, got %q", v)
+	}
+}
+
+func TestIDFormatter(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		IDFormatter: func(id uint64) string { return fmt.Sprintf("%016x", id) },
+	})
+	raw := makeRawSpan("op", nil)
+	raw.Context.TraceID = 0xabc
+	raw.Context.SpanID = 0xdef
+	raw.ParentSpanID = 0x123
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	span := backend.lastRequest().SpanRecords[0]
+	if span.GetSpanGuid() != "0000000000000def" {
+		t.Errorf("unexpected span guid %q", span.GetSpanGuid())
+	}
+	if span.GetTraceGuid() != "0000000000000abc" {
+		t.Errorf("unexpected trace guid %q", span.GetTraceGuid())
+	}
+	if v, _ := findAttribute(span.Attributes, ParentSpanGUIDKey); v != "0000000000000123" {
+		t.Errorf("unexpected parent span guid %q", v)
+	}
+}
+
+func TestIDFormatterDefault(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	raw := makeRawSpan("op", nil)
+	raw.Context.SpanID = 255
+	rec.RecordSpan(raw)
+	rec.Flush()
+
+	if guid := backend.lastRequest().SpanRecords[0].GetSpanGuid(); guid != "ff" {
+		t.Errorf("expected hexadecimal span guid, got %q", guid)
+	}
+}
+
+func makeLargePayloadSpans(count, payloadLen int) []basictracer.RawSpan {
+	payload := strings.Repeat("x", payloadLen)
+	spans := make([]basictracer.RawSpan, count)
+	for i := range spans {
+		spans[i] = makeRawSpan("op", nil)
+		spans[i].Logs = []ot.LogRecord{{
+			Timestamp: time.Now(),
+			Fields: []log.Field{
+				log.String("event", "large"),
+				log.Object("payload", payload),
+			},
+		}}
+	}
+	return spans
+}
+
+func TestReportPayloadQuotaBytes(t *testing.T) {
+	const payloadLen = 1000
+	rec, backend := newTestRecorder(Options{
+		MaxLogMessageLen:        2 * payloadLen,
+		ReportPayloadQuotaBytes: 10 * payloadLen,
+	})
+	for _, raw := range makeLargePayloadSpans(100, payloadLen) {
+		rec.RecordSpan(raw)
+	}
+	rec.Flush()
+
+	req := backend.lastRequest()
+	encoded, dropped := 0, 0
+	for _, span := range req.SpanRecords {
+		payload := span.LogRecords[0].GetPayloadJson()
+		if payload == payloadQuotaExceeded {
+			dropped++
+		} else {
+			encoded += len(payload)
+		}
+	}
+	if len(req.SpanRecords) != 100 {
+		t.Errorf("spans must be reported even when their payloads are dropped")
+	}
+	if encoded > 10*(payloadLen+2) {
+		t.Errorf("encoded %d payload bytes, exceeding the quota", encoded)
+	}
+	if dropped != 90 {
+		t.Errorf("expected 90 dropped payloads, got %d", dropped)
+	}
+	if m := findMetric(req, "payloads.dropped"); m != 90 {
+		t.Errorf("expected payloads.dropped of 90, got %d", m)
+	}
+
+	// The quota applies per report.
+	for _, raw := range makeLargePayloadSpans(1, payloadLen) {
+		rec.RecordSpan(raw)
+	}
+	rec.Flush()
+	if payload := backend.lastRequest().SpanRecords[0].LogRecords[0].GetPayloadJson(); payload == payloadQuotaExceeded {
+		t.Errorf("the payload quota was not reset for the next report")
+	}
+}
+
+func TestReportPayloadQuotaSkipsEncoding(t *testing.T) {
+	// Marshalling this payload allocates for every element, so encoding it
+	// dominates the allocations of a flush.
+	payload := make([]interface{}, 100)
+	for i := range payload {
+		payload[i] = i
+	}
+	flushAllocs := func(quota int) float64 {
+		rec, _ := newTestRecorder(Options{ReportPayloadQuotaBytes: quota})
+		raw := makeRawSpan("op", nil)
+		raw.Logs = []ot.LogRecord{{
+			Timestamp: raw.Start,
+			Fields:    []log.Field{log.Object("payload", payload)},
+		}}
+		return testing.AllocsPerRun(10, func() {
+			for i := 0; i < 20; i++ {
+				rec.RecordSpan(raw)
+			}
+			rec.Flush()
+		})
+	}
+
+	unlimited, quota := flushAllocs(0), flushAllocs(1)
+	if quota*2 > unlimited {
+		t.Errorf("expected payloads beyond the quota not to be encoded: %v allocations per flush, %v without a quota",
+			quota, unlimited)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.RecordEvent("deploy", map[string]interface{}{"version": "1.2.3"})
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 1 {
+		t.Fatalf("expected the event to be reported, got %d spans", len(req.SpanRecords))
+	}
+	span := req.SpanRecords[0]
+	if span.GetSpanName() != "deploy" {
+		t.Errorf("unexpected event name %q", span.GetSpanName())
+	}
+	if span.GetOldestMicros() != span.GetYoungestMicros() {
+		t.Errorf("events should have zero duration")
+	}
+	if v, _ := findAttribute(span.Attributes, "version"); v != "1.2.3" {
+		t.Errorf("event tag missing: %v", span.Attributes)
+	}
+	if v, _ := findAttribute(span.Attributes, EventKey); v != "true" {
+		t.Errorf("event marker missing: %v", span.Attributes)
+	}
+}
+
+func TestGUIDGenerator(t *testing.T) {
+	var next uint64
+	rec, backend := newTestRecorder(Options{
+		GUIDGenerator: func() uint64 { return atomic.AddUint64(&next, 1) },
+	})
+	rec.RecordEvent("deploy", nil)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if guid, _ := findAttribute(req.Runtime.Attrs, GUIDKey); guid != "1" {
+		t.Errorf("expected the generated runtime GUID 1, got %q", guid)
+	}
+	span := req.SpanRecords[0]
+	if span.GetTraceGuid() != formatIDHex(2) || span.GetSpanGuid() != formatIDHex(3) {
+		t.Errorf("expected generated event IDs 2 and 3, got %s and %s", span.GetTraceGuid(), span.GetSpanGuid())
+	}
+
+	// An explicit GUID tag still wins.
+	rec, backend = newTestRecorder(Options{
+		Tags:          ot.Tags{GUIDKey: "fixed"},
+		GUIDGenerator: func() uint64 { return 99 },
+	})
+	rec.Flush()
+	if guid, _ := findAttribute(backend.lastRequest().Runtime.Attrs, GUIDKey); guid != "fixed" {
+		t.Errorf("expected the GUID tag to override the generator, got %q", guid)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	rec := NewRecorder(Options{
+		AccessToken:       "0987654321",
+		Collector:         collector.endpoint(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "secret",
+	})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	rec.Flush()
+
+	header := collector.lastHeader()
+	if header == nil {
+		t.Fatalf("no report reached the collector")
+	}
+	if auth := header.Get("Authorization"); auth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+	if req := collector.backend.lastRequest(); req == nil || len(req.SpanRecords) != 1 {
+		t.Errorf("the report was not decoded by the collector")
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	rec := NewRecorder(Options{AccessToken: "0987654321", Collector: collector.endpoint()})
+	rec.Flush()
+	rec.Close()
+	if ua := collector.lastHeader().Get("User-Agent"); ua != "lightstep-tracer-go/"+TracerVersionValue {
+		t.Errorf("unexpected default User-Agent %q", ua)
+	}
+
+	rec = NewRecorder(Options{
+		AccessToken:       "0987654321",
+		Collector:         collector.endpoint(),
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "secret",
+		CustomHeaders: map[string]string{
+			"X-Gateway-Route": "tracing",
+			"User-Agent":      "my-service",
+			"Authorization":   "Bearer ignored",
+		},
+	})
+	rec.Flush()
+	rec.Close()
+	header := collector.lastHeader()
+	for key, want := range map[string]string{
+		"X-Gateway-Route": "tracing",
+		"User-Agent":      "my-service",
+		"Authorization":   "Basic dXNlcjpzZWNyZXQ=",
+		"Content-Type":    "application/x-thrift",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("expected header %s: %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	var lock sync.Mutex
+	var dialed []string
+	rec := NewRecorder(Options{
+		AccessToken: "0987654321",
+		Collector:   collector.endpoint(),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, addr)
+			lock.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	rec.Flush()
+
+	if req := collector.backend.lastRequest(); req == nil || len(req.SpanRecords) != 1 {
+		t.Fatalf("the report did not reach the collector")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := collector.Listener.Addr().String(); len(dialed) == 0 || dialed[0] != expected {
+		t.Errorf("expected the dialer to be asked for %s, got %v", expected, dialed)
+	}
+}
+
+func TestNewRecorderE(t *testing.T) {
+	rec, err := NewRecorderE(Options{AccessToken: "0987654321"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := rec.(*Recorder); !ok {
+		t.Errorf("expected a *Recorder, got %T", rec)
+	}
+
+	if _, err := NewRecorderE(Options{}); err != errEmptyAccessToken {
+		t.Errorf("expected errEmptyAccessToken, got %v", err)
+	}
+
+	rec, err = NewRecorderE(Options{
+		AccessToken: "0987654321",
+		Collector:   Endpoint{Host: "bad%host"},
+	})
+	if err == nil {
+		t.Errorf("expected a transport error")
+	}
+	if rec != nil {
+		t.Errorf("expected no recorder on error, got %v", rec)
+	}
+	if NewRecorder(Options{AccessToken: "0987654321", Collector: Endpoint{Host: "bad%host"}}) != nil {
+		t.Errorf("NewRecorder should return nil on a transport error")
+	}
+	if NewRecorder(Options{}) != nil {
+		t.Errorf("NewRecorder should return nil for an empty access token")
+	}
+}
+
+func TestNewTracerConstructionFailure(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{AccessToken: "0987654321", Collector: Endpoint{Host: "bad%host"}},
+	} {
+		if _, ok := NewTracer(opts).(ot.NoopTracer); !ok {
+			t.Errorf("expected a no-op tracer for %+v", opts)
+		}
+		if tracer, err := NewTracerE(opts); err == nil || tracer != nil {
+			t.Errorf("expected an error and no tracer for %+v, got %v", opts, tracer)
+		}
+	}
+}
+
+func TestRuntimeAttributes(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		Tags: ot.Tags{
+			TracerPlatformKey: "overridden",
+			ComponentNameKey:  "component",
+		},
+	})
+	rec.Flush()
+
+	attrs := backend.lastRequest().Runtime.Attrs
+	for i := 1; i < len(attrs); i++ {
+		if attrs[i-1].Key >= attrs[i].Key {
+			t.Errorf("runtime attributes are not sorted by key: %q before %q", attrs[i-1].Key, attrs[i].Key)
+		}
+	}
+	if v, _ := findAttribute(attrs, TracerPlatformKey); v != TracerPlatformValue {
+		t.Errorf("expected %s=%s, got %q", TracerPlatformKey, TracerPlatformValue, v)
+	}
+	if v, _ := findAttribute(attrs, ComponentNameKey); v != "component" {
+		t.Errorf("expected %s=component, got %q", ComponentNameKey, v)
+	}
+}
+
+func TestStreamSpans(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		StreamSpans:    true,
+		StreamInterval: time.Millisecond,
+	})
+	for i := 0; i < 3; i++ {
+		recorded := time.Now()
+		rec.RecordSpan(makeRawSpan(fmt.Sprint("op", i), nil))
+		if !waitFor(minReportingPeriod/2, func() bool { return backend.requestCount() == i+1 }) {
+			t.Fatalf("span %d was not streamed promptly", i)
+		}
+		if latency := time.Since(recorded); latency >= minReportingPeriod {
+			t.Errorf("span %d took %v to be reported", i, latency)
+		}
+		req := backend.lastRequest()
+		if len(req.SpanRecords) != 1 || req.SpanRecords[0].GetSpanName() != fmt.Sprint("op", i) {
+			t.Errorf("expected span op%d to be sent individually, got %v", i, req.SpanRecords)
+		}
+	}
+}
+
+func TestStreamIntervalDoesNotDelayClose(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		StreamSpans:    true,
+		StreamInterval: time.Hour,
+	})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if !waitFor(minReportingPeriod, func() bool { return backend.requestCount() == 1 }) {
+		t.Fatalf("the span was not streamed")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rec.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the stream interval")
+	}
+}
+
+func TestTrackActiveSpans(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:      "0987654321",
+		TrackActiveSpans: true,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+
+	var spans []ot.Span
+	for i := 0; i < 3; i++ {
+		spans = append(spans, tracer.StartSpan("leaky"))
+		if active := rec.Stats().ActiveSpans; active != int64(i+1) {
+			t.Errorf("expected %d active spans, got %d", i+1, active)
+		}
+	}
+	spans[0].Finish()
+	if active := rec.Stats().ActiveSpans; active != 2 {
+		t.Errorf("expected 2 active spans after Finish, got %d", active)
+	}
+}
+
+func TestOperationNamePrefix(t *testing.T) {
+	rec, backend := newTestRecorder(Options{OperationNamePrefix: "checkout."})
+	rec.RecordSpan(makeRawSpan("charge", nil))
+	rec.Flush()
+
+	if name := backend.lastRequest().SpanRecords[0].GetSpanName(); name != "checkout.charge" {
+		t.Errorf("expected prefixed span name, got %q", name)
+	}
+}
+
+func TestConcurrentFlush(t *testing.T) {
+	const goroutines, spansPerGoroutine = 20, 50
+	rec, backend := newTestRecorder(Options{
+		MaxBufferedSpans: goroutines * spansPerGoroutine,
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < spansPerGoroutine; i++ {
+				rec.RecordSpan(makeRawSpan("op", nil))
+				rec.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+	rec.Flush()
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	reported := 0
+	for _, req := range backend.requests {
+		reported += len(req.SpanRecords)
+	}
+	if reported != goroutines*spansPerGoroutine {
+		t.Errorf("expected %d spans to be reported, got %d", goroutines*spansPerGoroutine, reported)
+	}
+	// Every call reports: none is aborted because another is in flight.
+	if len(backend.requests) < goroutines*spansPerGoroutine+1 {
+		t.Errorf("expected every Flush to report, got %d reports", len(backend.requests))
+	}
+}
+
+func TestReportStartupSpan(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		ReportStartupSpan:       true,
+		MaxBufferedSpans:        42,
+		TraceSamplingRate:       0.25,
+		PerOperationSampleRates: map[string]float64{"db.*": 0.5, "health": 0},
+	})
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 {
+		t.Fatalf("expected a report with the startup span, got %v", req)
+	}
+	span := req.SpanRecords[0]
+	if span.GetSpanName() != StartupSpanOperation {
+		t.Errorf("unexpected startup span name %q", span.GetSpanName())
+	}
+	for key, expected := range map[string]string{
+		"lightstep.config.max_buffered_spans":         "42",
+		"lightstep.config.reporting_period":           defaultMaxReportingPeriod.String(),
+		"lightstep.config.collector":                  getCollectorURL(Options{}),
+		"lightstep.config.trace_sampling_rate":        "0.25",
+		"lightstep.config.per_operation_sample_rates": `{"db.*":0.5,"health":0}`,
+	} {
+		if value, _ := findAttribute(span.Attributes, key); value != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, value)
+		}
+	}
+
+	// The startup span is off by default.
+	rec, backend = newTestRecorder(Options{})
+	rec.Flush()
+	if req := backend.lastRequest(); req != nil && len(req.SpanRecords) != 0 {
+		t.Errorf("expected no startup span, got %v", req.SpanRecords)
+	}
+}
+
+func TestReportedDurationMatchesMonotonicDuration(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+
+	// The wall clock was stepped back an hour between Start and the
+	// monotonic Duration measurement. Start also has a sub-microsecond
+	// component, so wall-clock arithmetic on the end time would round the
+	// duration differently.
+	start := time.Now().Add(-time.Hour).Round(0).Truncate(time.Microsecond).Add(999)
+	span := makeRawSpan("op", nil)
+	span.Start = start
+	span.Duration = 250*time.Millisecond + 1001
+	rec.RecordSpan(span)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 {
+		t.Fatalf("expected a report with one span, got %v", req)
+	}
+	record := req.SpanRecords[0]
+	if record.GetOldestMicros() != start.UnixNano()/1000+1 {
+		t.Errorf("expected the start rounded up to the next microsecond, got %d", record.GetOldestMicros())
+	}
+	if micros := record.GetYoungestMicros() - record.GetOldestMicros(); micros != 250001 {
+		t.Errorf("expected a reported duration of 250001us, got %dus", micros)
+	}
+}
+
+func TestReportedDurationRounding(t *testing.T) {
+	base := time.Unix(1500000000, 0)
+	for _, test := range []struct {
+		name                     string
+		start                    time.Time
+		duration                 time.Duration
+		oldestMicros, durationUs int64
+	}{
+		{"500ns span", base, 500, base.UnixNano() / 1000, 1},
+		{"499ns span", base, 499, base.UnixNano() / 1000, 0},
+		{"sub-microsecond start rounded down", base.Add(400), 2600, base.UnixNano() / 1000, 3},
+		{"sub-microsecond start rounded up", base.Add(600), 2400, base.UnixNano()/1000 + 1, 2},
+	} {
+		rec, backend := newTestRecorder(Options{})
+		span := makeRawSpan("op", nil)
+		span.Start = test.start
+		span.Duration = test.duration
+		rec.RecordSpan(span)
+		rec.Flush()
+
+		record := backend.lastRequest().SpanRecords[0]
+		if got := record.GetOldestMicros(); got != test.oldestMicros {
+			t.Errorf("%s: expected start %d, got %d", test.name, test.oldestMicros, got)
+		}
+		if got := record.GetYoungestMicros() - record.GetOldestMicros(); got != test.durationUs {
+			t.Errorf("%s: expected a duration of %dus, got %dus", test.name, test.durationUs, got)
+		}
+	}
+}
+
+func TestSpanLinks(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	options := basictracer.DefaultOptions()
+	options.Recorder = rec
+	tracer := basictracer.NewWithOptions(options)
+
+	first := tracer.StartSpan("request")
+	second := tracer.StartSpan("request")
+	batch := tracer.StartSpan("batch")
+	SetSpanLinks(batch, first.Context(), second.Context())
+	batch.Finish()
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 1 {
+		t.Fatalf("expected a report with one span, got %v", req)
+	}
+	var links []string
+	for _, kv := range req.SpanRecords[0].Attributes {
+		if kv.Key == SpanLinksKey {
+			links = append(links, kv.Value)
+		}
+	}
+	var expected []string
+	for _, span := range []ot.Span{first, second} {
+		sc := span.Context().(basictracer.SpanContext)
+		expected = append(expected, formatIDHex(sc.TraceID)+":"+formatIDHex(sc.SpanID))
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected links %v, got %v", expected, links)
+	}
+}
+
+func TestFollowsFromReferences(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	options := basictracer.DefaultOptions()
+	options.Recorder = rec
+	tracer := NewReferenceTracer(basictracer.NewWithOptions(options))
+
+	parent := tracer.StartSpan("parent")
+	tracer.StartSpan("child", ot.ChildOf(parent.Context())).Finish()
+	tracer.StartSpan("async", ot.FollowsFrom(parent.Context())).Finish()
+	parent.Finish()
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil || len(req.SpanRecords) != 3 {
+		t.Fatalf("expected a report with three spans, got %v", req)
+	}
+	parentGUID := formatIDHex(parent.Context().(basictracer.SpanContext).SpanID)
+	for _, span := range req.SpanRecords {
+		refType, tagged := findAttribute(span.Attributes, ReferenceTypeKey)
+		switch *span.SpanName {
+		case "parent", "child":
+			if tagged {
+				t.Errorf("%s: unexpected %s %q", *span.SpanName, ReferenceTypeKey, refType)
+			}
+		case "async":
+			if refType != FollowsFromReferenceType {
+				t.Errorf("async: expected %s %q, got %q", ReferenceTypeKey, FollowsFromReferenceType, refType)
+			}
+		}
+		if *span.SpanName != "parent" {
+			if guid, _ := findAttribute(span.Attributes, ParentSpanGUIDKey); guid != parentGUID {
+				t.Errorf("%s: expected parent %s, got %s", *span.SpanName, parentGUID, guid)
+			}
+		}
+	}
+}
+
+func TestGetRecorder(t *testing.T) {
+	tracer := NewTracer(Options{AccessToken: "0987654321", MaxLogMessageLen: 1024})
+	rec, ok := GetRecorder(tracer)
+	if !ok || rec != tracer.(basictracer.Tracer).Options().Recorder {
+		t.Fatalf("expected the Tracer's Recorder, got %v", rec)
+	}
+	rec.Close()
+	if _, ok := GetRecorder(ot.NoopTracer{}); ok {
+		t.Error("expected no Recorder for a no-op Tracer")
+	}
+}
+
+// retainingReportingService keeps every ReportRequest as is, without
+// copying it.
+type retainingReportingService struct {
+	requests []*lightstep_thrift.ReportRequest
+}
+
+func (m *retainingReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	m.requests = append(m.requests, request)
+	return &lightstep_thrift.ReportResponse{}, nil
+}
+
+func TestBackendMayRetainRequests(t *testing.T) {
+	backend := &retainingReportingService{}
+	rec, _ := newTestRecorder(Options{})
+	rec.lock.Lock()
+	rec.backend = backend
+	rec.lock.Unlock()
+
+	first := makeRawSpan("first", ot.Tags{"a": 1, "join:b": 2})
+	first.ParentSpanID = 7
+	rec.RecordSpan(first)
+	rec.Flush()
+	rec.RecordSpan(makeRawSpan("second", ot.Tags{"c": 3}))
+	rec.Flush()
+
+	// Nothing of the second report may be written into the first.
+	span := backend.requests[0].SpanRecords[0]
+	if span.GetSpanName() != "first" || len(span.JoinIds) != 1 || span.JoinIds[0].TraceKey != "join:b" {
+		t.Errorf("expected the first report to keep its span, got %v", span)
+	}
+	if value, _ := findAttribute(span.Attributes, "a"); value != "1" {
+		t.Errorf("expected the first report to keep its attributes, got %v", span.Attributes)
+	}
+}
+
+func TestErrorTag(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	defer rec.Close()
+	tracer := NewTracerWithRecorder(rec)
+	for _, test := range []struct {
+		operation string
+		set       func(ot.Span)
+	}{
+		{"failed", func(span ot.Span) { ext.Error.Set(span, true) }},
+		{"string", func(span ot.Span) { span.SetTag(string(ext.Error), "true") }},
+		{"recovered", func(span ot.Span) { ext.Error.Set(span, false) }},
+		{"untagged", func(ot.Span) {}},
+	} {
+		span := tracer.StartSpan(test.operation)
+		test.set(span)
+		span.Finish()
+	}
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	for _, span := range backend.lastRequest().SpanRecords {
+		expected := span.GetSpanName() == "failed" || span.GetSpanName() == "string"
+		if span.GetErrorFlag() != expected {
+			t.Errorf("%s: expected error flag %v, got %v", span.GetSpanName(), expected, span.ErrorFlag)
+		}
+		if value, _ := findAttribute(span.Attributes, string(ext.Error)); expected && value != "true" {
+			t.Errorf("%s: expected the error tag to be kept as an attribute, got %q", span.GetSpanName(), value)
+		}
+	}
+}
+
+func TestNewTracerWithRecorder(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxBufferedSpans: 1000, TrackActiveSpans: true})
+	defer rec.Close()
+	tracers := []ot.Tracer{
+		NewTracerWithRecorder(rec),
+		NewTracerWithRecorder(rec),
+		WithComponentAttributes(NewTracerWithRecorder(rec), map[string]string{ComponentNameKey: "billing"}),
+	}
+	for _, tracer := range tracers {
+		if shared, ok := GetRecorder(tracer); !ok || shared != rec {
+			t.Fatalf("expected the Tracer to record into the shared Recorder, got %v", shared)
+		}
+	}
+
+	// Spans from every tracer, recorded concurrently, share the buffer.
+	var wg sync.WaitGroup
+	for _, tracer := range tracers {
+		wg.Add(1)
+		go func(tracer ot.Tracer) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tracer.StartSpan("op").Finish()
+			}
+		}(tracer)
+	}
+	wg.Wait()
+	stats := rec.Stats()
+	if stats.RecordedSpans != 300 || stats.BufferedSpans != 300 || stats.ActiveSpans != 0 {
+		t.Errorf("expected 300 recorded and buffered spans and none active, got %+v", stats)
+	}
+
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	components := map[string]int{}
+	backend.lock.Lock()
+	for _, req := range backend.requests {
+		name, _ := findAttribute(req.Runtime.Attrs, ComponentNameKey)
+		components[name] += len(req.SpanRecords)
+	}
+	backend.lock.Unlock()
+	if components["billing"] != 100 || len(components) != 2 {
+		t.Errorf("expected 200 spans under the Recorder's component and 100 under billing, got %v", components)
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:       "0987654321",
+		MaxLogMessageLen:  1024,
+		MaxBufferedSpans:  1000,
+		TraceSamplingRate: 0.5,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	rec.lock.Lock()
+	rec.backend = &mockReportingService{}
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	const traces = 200
+	for i := 0; i < traces; i++ {
+		root := tracer.StartSpan("root")
+		for j := 0; j < 2; j++ {
+			tracer.StartSpan("child", ot.ChildOf(root.Context())).Finish()
+		}
+		root.Finish()
+	}
+
+	rec.lock.Lock()
+	spans := rec.buffer.current()
+	rec.lock.Unlock()
+	spansPerTrace := make(map[uint64]int)
+	for _, span := range spans {
+		spansPerTrace[span.Context.TraceID]++
+	}
+	for traceID, count := range spansPerTrace {
+		if count != 3 {
+			t.Errorf("trace %x: expected all 3 spans to be kept, got %d", traceID, count)
+		}
+	}
+	if kept := len(spansPerTrace); kept < traces/4 || kept > traces*3/4 {
+		t.Errorf("expected roughly half of %d traces to be kept, got %d", traces, kept)
+	}
+}
+
+func TestForceRecord(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:       "0987654321",
+		MaxLogMessageLen:  1024,
+		TraceSamplingRate: 0.0001,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	rec.lock.Lock()
+	rec.backend = &mockReportingService{}
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	// Find a trace that is not sampled.
+	var root ot.Span
+	for root == nil {
+		span := tracer.StartSpan("root")
+		if !span.Context().(basictracer.SpanContext).Sampled {
+			root = span
+		}
+	}
+	tracer.StartSpan("unforced", ot.ChildOf(root.Context())).Finish()
+	ForceRecord(root)
+	child := tracer.StartSpan("child", ot.ChildOf(root.Context()))
+	tracer.StartSpan("grandchild", ot.ChildOf(child.Context())).Finish()
+	child.Finish()
+	root.Finish()
+
+	// A context propagated from elsewhere as unsampled, but carrying the
+	// override, is recorded too.
+	remote := basictracer.SpanContext{
+		TraceID: 1,
+		SpanID:  2,
+		Baggage: map[string]string{ForceRecordKey: "true"},
+	}
+	tracer.StartSpan("remote", ot.ChildOf(remote)).Finish()
+
+	rec.lock.Lock()
+	spans := rec.buffer.current()
+	rec.lock.Unlock()
+	var operations []string
+	for _, span := range spans {
+		operations = append(operations, span.Operation)
+	}
+	expected := []string{"grandchild", "child", "root", "remote"}
+	if !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected %v to be recorded, got %v", expected, operations)
+	}
+}
+
+func TestSamplingPriority(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:       "0987654321",
+		TraceSamplingRate: 0.0001,
+		MaxBufferedSpans:  2,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	rec.lock.Lock()
+	rec.backend = &mockReportingService{}
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	var sampled, unsampled ot.Span
+	for sampled == nil || unsampled == nil {
+		span := tracer.StartSpan("span")
+		if span.Context().(basictracer.SpanContext).Sampled {
+			sampled = span
+		} else {
+			unsampled = span
+		}
+	}
+	ext.SamplingPriority.Set(sampled, 0)
+	sampled.SetOperationName("zero").Finish()
+	tracer.StartSpan("zero-tag", ot.Tag{Key: string(ext.SamplingPriority), Value: 0}).Finish()
+	ext.SamplingPriority.Set(unsampled, 1)
+	unsampled.SetOperationName("positive").Finish()
+
+	bufferedOperations := func() []string {
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		var operations []string
+		for _, span := range rec.buffer.current() {
+			operations = append(operations, span.Operation)
+		}
+		return operations
+	}
+	if operations := bufferedOperations(); !reflect.DeepEqual(operations, []string{"positive"}) {
+		t.Errorf("expected only the positive-priority span to be recorded, got %v", operations)
+	}
+	rec.Flush()
+
+	// Positive-priority spans displace buffered spans once the buffer is full.
+	rec.RecordSpan(makeRawSpan("a", nil))
+	rec.RecordSpan(makeRawSpan("b", nil))
+	rec.RecordSpan(makeRawSpan("c", ot.Tags{string(ext.SamplingPriority): 2}))
+	rec.RecordSpan(makeRawSpan("d", nil))
+	if operations := bufferedOperations(); !reflect.DeepEqual(operations, []string{"b", "c"}) {
+		t.Errorf("expected [b c] to be buffered, got %v", operations)
+	}
+	if dropped := rec.Stats().DroppedSpans; dropped != 2 {
+		t.Errorf("expected 2 dropped spans, got %d", dropped)
+	}
+}
+
+func TestConversionTime(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxBufferedSpans: 1000})
+	if rec.Stats().LastConversionTime != 0 {
+		t.Errorf("expected no conversion time before the first flush")
+	}
+	for _, span := range makeLargePayloadSpans(1000, 512) {
+		rec.RecordSpan(span)
+	}
+	start := time.Now()
+	rec.Flush()
+	elapsed := time.Since(start)
+
+	conversionTime := rec.Stats().LastConversionTime
+	if conversionTime <= 0 || conversionTime > elapsed {
+		t.Errorf("implausible conversion time %v for a flush taking %v", conversionTime, elapsed)
+	}
+	req := backend.lastRequest()
+	var gauge *lightstep_thrift.MetricsSample
+	for _, m := range req.InternalMetrics.Gauges {
+		if m.Name == "report.conversion_micros" {
+			gauge = m
+		}
+	}
+	if gauge == nil || gauge.GetInt64Value() != int64(conversionTime/time.Microsecond) {
+		t.Errorf("expected the conversion time to be reported, got %v", gauge)
+	}
+}
+
+func TestSpanDropTags(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		SpanDropTags: map[string]string{"synthetic": "true", "health_check": "true", "sample_rate": "0.00001"},
+	})
+	rec.RecordSpan(makeRawSpan("probe", ot.Tags{"synthetic": true}))
+	rec.RecordSpan(makeRawSpan("healthz", ot.Tags{"health_check": "true"}))
+	rec.RecordSpan(makeRawSpan("checkout", ot.Tags{"synthetic": false}))
+	rec.RecordSpan(makeRawSpan("sampled", ot.Tags{"sample_rate": 0.00001}))
+	rec.RecordSpan(makeRawSpan("login", nil))
+	rec.Flush()
+
+	req := backend.lastRequest()
+	var operations []string
+	for _, span := range req.SpanRecords {
+		operations = append(operations, span.GetSpanName())
+	}
+	if expected := []string{"checkout", "login"}; !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, operations)
+	}
+	if filtered := findMetric(req, "spans.filtered"); filtered != 3 {
+		t.Errorf("expected 3 filtered spans, got %d", filtered)
+	}
+	if dropped := findMetric(req, "spans.dropped"); dropped != 0 {
+		t.Errorf("filtered spans should not count as dropped, got %d", dropped)
+	}
+}
+
+// panickingPayload panics when encoded as JSON.
+type panickingPayload struct{}
+
+func (panickingPayload) MarshalJSON() ([]byte, error) {
+	panic("pathological payload")
+}
+
+func TestUnconvertibleSpanIsSkipped(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	bad := makeRawSpan("bad", nil)
+	bad.Logs = []ot.LogRecord{{
+		Timestamp: time.Now(),
+		Fields:    []log.Field{log.Object("payload", panickingPayload{})},
+	}}
+	rec.RecordSpan(makeRawSpan("before", nil))
+	rec.RecordSpan(bad)
+	rec.RecordSpan(makeRawSpan("after", nil))
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req == nil {
+		t.Fatalf("expected a report")
+	}
+	var operations []string
+	for _, span := range req.SpanRecords {
+		operations = append(operations, span.GetSpanName())
+	}
+	if expected := []string{"before", "after"}; !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected %v to be reported, got %v", expected, operations)
+	}
+	if count := findMetric(req, "spans.unconvertible"); count != 1 {
+		t.Errorf("expected 1 unconvertible span, got %d", count)
+	}
+}
+
+func TestReportWindowCoversOldestSpan(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.lock.Lock()
+	windowStart := rec.reportOldest
+	rec.lock.Unlock()
+
+	span := makeRawSpan("early", nil)
+	span.Start = windowStart.Add(-time.Minute)
+	rec.RecordSpan(span)
+	rec.RecordSpan(makeRawSpan("later", nil))
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if oldest := req.GetOldestMicros(); oldest != span.Start.UnixNano()/1000 {
+		t.Errorf("expected the report window to start at %d, got %d", span.Start.UnixNano()/1000, oldest)
+	}
+}
+
+func TestSetReportWindow(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+
+	// Replay a minute of spans from a year ago.
+	windowStart := time.Now().AddDate(-1, 0, 0)
+	windowEnd := windowStart.Add(time.Minute)
+	for _, offset := range []time.Duration{0, 30 * time.Second, 59 * time.Second} {
+		span := makeRawSpan("imported", nil)
+		span.Start = windowStart.Add(offset)
+		span.Duration = time.Second
+		rec.RecordSpan(span)
+	}
+	rec.SetReportWindow(windowStart, windowEnd)
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if req.GetOldestMicros() != windowStart.UnixNano()/1000 ||
+		req.GetYoungestMicros() != windowEnd.UnixNano()/1000 {
+		t.Errorf("expected the window [%v, %v], got [%d, %d]",
+			windowStart, windowEnd, req.GetOldestMicros(), req.GetYoungestMicros())
+	}
+
+	// The override only applies to one report.
+	before := time.Now()
+	rec.Flush()
+	req = backend.lastRequest()
+	if req.GetYoungestMicros() < before.UnixNano()/1000 {
+		t.Errorf("expected the next report window to end now, got %d", req.GetYoungestMicros())
+	}
+}
+
+func TestReportSchemaVersion(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		// Like the tracer version, the schema version cannot be overridden.
+		Tags: ot.Tags{ReportSchemaVersionKey: "0"},
+	})
+	rec.Flush()
+
+	req := backend.lastRequest()
+	version, found := findAttribute(req.Runtime.Attrs, ReportSchemaVersionKey)
+	if !found || version != ReportSchemaVersionValue {
+		t.Errorf("expected schema version %q, got %q", ReportSchemaVersionValue, version)
+	}
+}
+
+func TestSuppressEmptyReports(t *testing.T) {
+	rec, backend := newTestRecorder(Options{SuppressEmptyReports: true})
+	rec.Flush()
+	if n := backend.requestCount(); n != 0 {
+		t.Errorf("expected an empty flush to send nothing, got %d reports", n)
+	}
+
+	// Non-zero counters are still worth reporting.
+	atomic.AddInt64(&rec.counters.droppedSpans, 1)
+	rec.Flush()
+	if n := backend.requestCount(); n != 1 {
+		t.Errorf("expected a report carrying the dropped span count, got %d reports", n)
+	}
+
+	rec.RecordSpan(makeRawSpan("op", nil))
+	rec.Flush()
+	if n := backend.requestCount(); n != 2 {
+		t.Errorf("expected a report carrying the span, got %d reports", n)
+	}
+
+	// Empty reports are sent by default.
+	rec, backend = newTestRecorder(Options{})
+	rec.Flush()
+	if n := backend.requestCount(); n != 1 {
+		t.Errorf("expected an empty report without suppression, got %d reports", n)
+	}
+}
+
+func TestRecordSpanRecords(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		MaxBufferedSpans:    2,
+		OperationNamePrefix: "local.",
+	})
+	forwarded := &lightstep_thrift.SpanRecord{
+		SpanGuid:       thrift.StringPtr("abc"),
+		TraceGuid:      thrift.StringPtr("def"),
+		SpanName:       thrift.StringPtr("remote-op"),
+		OldestMicros:   thrift.Int64Ptr(1000),
+		YoungestMicros: thrift.Int64Ptr(2000),
+		Attributes:     []*lightstep_thrift.KeyValue{{Key: "origin", Value: "proxy"}},
+	}
+	rec.RecordSpan(makeRawSpan("op", nil))
+	rec.RecordSpanRecords([]*lightstep_thrift.SpanRecord{forwarded, forwarded})
+	rec.Flush()
+
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 2 {
+		t.Fatalf("expected 2 spans within the buffer limit, got %d", len(req.SpanRecords))
+	}
+	// The mock backend copies each request, so compare by value.
+	if got := req.SpanRecords[1]; got.GetSpanGuid() != "abc" || got.GetTraceGuid() != "def" ||
+		got.GetOldestMicros() != 1000 || got.GetYoungestMicros() != 2000 ||
+		!reflect.DeepEqual(got.Attributes, forwarded.Attributes) {
+		t.Errorf("expected the forwarded record to be reported unchanged, got %v", got)
+	}
+	if req.SpanRecords[1].GetSpanName() != "remote-op" {
+		t.Errorf("the forwarded record should not be renamed, got %q", req.SpanRecords[1].GetSpanName())
+	}
+	if dropped := findMetric(req, "spans.dropped"); dropped != 1 {
+		t.Errorf("expected 1 dropped span, got %d", dropped)
+	}
+	if req.GetOldestMicros() != 1000 {
+		t.Errorf("expected the report window to cover the forwarded span, got %d", req.GetOldestMicros())
+	}
+}
+
+func TestOnCommand(t *testing.T) {
+	var received []*lightstep_thrift.Command
+	rec, backend := newTestRecorder(Options{
+		OnCommand: func(cmd *lightstep_thrift.Command) {
+			received = append(received, cmd)
+		},
+	})
+	commands := []*lightstep_thrift.Command{
+		{Disable: thrift.BoolPtr(false)},
+		{},
+		{Disable: thrift.BoolPtr(true)},
+	}
+	backend.response = &lightstep_thrift.ReportResponse{Commands: commands}
+	rec.Flush()
+
+	if !reflect.DeepEqual(received, commands) {
+		t.Errorf("expected the callback for each of %v, got %v", commands, received)
+	}
+	rec.lock.Lock()
+	disabled := rec.disabled
+	rec.lock.Unlock()
+	if !disabled {
+		t.Errorf("expected the built-in Disable handling to still apply")
+	}
+}
+
+// disablingReportingService answers the first report with a Disable
+// command, after a span was recorded while that report was in flight.
+type disablingReportingService struct {
+	*mockReportingService
+	rec   *Recorder
+	first bool
+}
+
+func (d *disablingReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	if d.first {
+		return d.mockReportingService.Report(auth, request)
+	}
+	d.first = true
+	d.rec.RecordSpan(makeRawSpan("during", nil))
+	d.mockReportingService.Report(auth, request)
+	return &lightstep_thrift.ReportResponse{
+		Commands: []*lightstep_thrift.Command{{Disable: thrift.BoolPtr(true)}},
+	}, nil
+}
+
+func TestDrainOnDisable(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		rec, backend := newTestRecorder(Options{DrainOnDisable: drain})
+		rec.lock.Lock()
+		rec.backend = &disablingReportingService{mockReportingService: backend, rec: rec}
+		rec.lock.Unlock()
+
+		rec.RecordSpan(makeRawSpan("before", nil))
+		rec.Flush()
+		if err := rec.Flush(); err != ErrRecorderDisabled {
+			t.Errorf("drain %v: expected the Recorder to be disabled, got %v", drain, err)
+		}
+		want := 1
+		if drain {
+			want = 2
+		}
+		if n := backend.requestCount(); n != want {
+			t.Fatalf("drain %v: expected %d reports, got %d", drain, want, n)
+		}
+		last := backend.lastRequest()
+		if drain && (len(last.SpanRecords) != 1 || last.SpanRecords[0].GetSpanName() != "during") {
+			t.Errorf("expected the span buffered during the report to be drained, got %v", last.SpanRecords)
+		}
+
+		rec.Enable()
+		rec.Flush()
+		if spans := backend.lastRequest().SpanRecords; len(spans) != 0 {
+			t.Errorf("drain %v: expected the buffer to be empty after Disable, got %v", drain, spans)
+		}
+	}
+
+	// Spans that fail to drain are discarded.
+	rec, backend := newTestRecorder(Options{DrainOnDisable: true})
+	backend.err = fmt.Errorf("unavailable")
+	rec.RecordSpan(makeRawSpan("lost", nil))
+	rec.Disable()
+	backend.err = nil
+	rec.Enable()
+	rec.Flush()
+	if spans := backend.lastRequest().SpanRecords; len(spans) != 0 {
+		t.Errorf("expected the spans that failed to drain to be discarded, got %v", spans)
+	}
+}
+
+func TestGroupSpansByTrace(t *testing.T) {
+	rec, backend := newTestRecorder(Options{GroupSpansByTrace: true})
+	for _, s := range []struct {
+		traceID   uint64
+		operation string
+	}{
+		{1, "a1"}, {2, "b1"}, {1, "a2"}, {3, "c1"}, {2, "b2"}, {1, "a3"},
+	} {
+		span := makeRawSpan(s.operation, nil)
+		span.Context.TraceID = s.traceID
+		rec.RecordSpan(span)
+	}
+	rec.Flush()
+
+	var operations []string
+	for _, span := range backend.lastRequest().SpanRecords {
+		operations = append(operations, span.GetSpanName())
+	}
+	if expected := []string{"a1", "a2", "a3", "b1", "b2", "c1"}; !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected spans grouped by trace %v, got %v", expected, operations)
+	}
+}
+
+func TestMaxSpanDelay(t *testing.T) {
+	const maxDelay = 100 * time.Millisecond
+	shouldFlushAfter := func(rec *Recorder, age time.Duration) bool {
+		rec.lock.Lock()
+		rec.buffer.oldestAdded = time.Now().Add(-age)
+		rec.lock.Unlock()
+		return rec.shouldFlush()
+	}
+
+	rec, _ := newTestRecorder(Options{MaxSpanDelay: maxDelay})
+	if period := rec.delayCheckPeriod(); period != maxDelay/4 {
+		t.Errorf("expected the loop to check every %v, got %v", maxDelay/4, period)
+	}
+	rec.RecordSpan(makeRawSpan("op", nil))
+
+	// A single span, far from the buffer thresholds and the reporting
+	// period, is flushed by the last check before it would exceed the
+	// bound.
+	if shouldFlushAfter(rec, maxDelay/2) {
+		t.Error("expected no flush while the span is well within its delay bound")
+	}
+	if !shouldFlushAfter(rec, maxDelay-maxDelay/4) {
+		t.Error("expected a flush once the next check would exceed the delay bound")
+	}
+
+	rec, _ = newTestRecorder(Options{})
+	if period := rec.delayCheckPeriod(); period != minReportingPeriod {
+		t.Errorf("expected the default check period, got %v", period)
+	}
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if shouldFlushAfter(rec, maxDelay) {
+		t.Error("expected no delay bound without MaxSpanDelay")
+	}
+}
+
+func TestPerOperationSampleRates(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:       "0987654321",
+		MaxLogMessageLen:  1024,
+		MaxBufferedSpans:  10000,
+		TraceSamplingRate: 0.5,
+		PerOperationSampleRates: map[string]float64{
+			"payment.*":    1,
+			"health*":      0.01,
+			"health.debug": 0,
+		},
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	rec.lock.Lock()
+	rec.backend = &mockReportingService{}
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	const traces = 1000
+	operations := []string{"payment.charge", "healthz", "health.debug", "inventory"}
+	for i := 0; i < traces; i++ {
+		for _, operation := range operations {
+			tracer.StartSpan(operation).Finish()
+		}
+	}
+
+	rec.lock.Lock()
+	spans := rec.buffer.current()
+	rec.lock.Unlock()
+	counts := make(map[string]int)
+	for _, span := range spans {
+		counts[span.Operation]++
+	}
+	for _, test := range []struct {
+		operation string
+		min, max  int
+	}{
+		{"payment.charge", traces, traces},
+		{"healthz", 1, 30},
+		// The longest matching pattern wins.
+		{"health.debug", 0, 0},
+		// Unmatched operations fall back to TraceSamplingRate.
+		{"inventory", 400, 600},
+	} {
+		if count := counts[test.operation]; count < test.min || count > test.max {
+			t.Errorf("%s: expected between %d and %d of %d spans, got %d",
+				test.operation, test.min, test.max, traces, count)
+		}
+	}
+}
+
+func TestCounterMode(t *testing.T) {
+	for _, test := range []struct {
+		mode     CounterMode
+		expected []int64
+	}{
+		{"", []int64{2, 3, 0}},
+		{CounterModeDelta, []int64{2, 3, 0}},
+		{CounterModeCumulative, []int64{2, 5, 5}},
+	} {
+		rec, backend := newTestRecorder(Options{CounterMode: test.mode})
+		for i, add := range []int64{2, 3, 0} {
+			atomic.AddInt64(&rec.counters.droppedSpans, add)
+			rec.Flush()
+			if got := findMetric(backend.lastRequest(), "spans.dropped"); got != test.expected[i] {
+				t.Errorf("mode %q report %d: expected %d dropped spans, got %d",
+					test.mode, i, test.expected[i], got)
+			}
+		}
+	}
+}
+
+func TestCounterModeFailedReport(t *testing.T) {
+	rec, backend := newTestRecorder(Options{CounterMode: CounterModeCumulative})
+	atomic.AddInt64(&rec.counters.droppedSpans, 2)
+	rec.Flush()
+
+	// A failed report must neither lose nor double-count the pending delta.
+	backend.err = fmt.Errorf("unavailable")
+	atomic.AddInt64(&rec.counters.droppedSpans, 1)
+	rec.Flush()
+	backend.err = nil
+	rec.Flush()
+	if got := findMetric(backend.lastRequest(), "spans.dropped"); got != 3 {
+		t.Errorf("expected a running total of 3 dropped spans, got %d", got)
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxBufferedSpans: 2, OverflowPolicy: OverflowDropOldest})
+	for _, op := range []string{"a", "b", "c"} {
+		rec.RecordSpan(makeRawSpan(op, nil))
+	}
+	rec.Flush()
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 2 || req.SpanRecords[0].GetSpanName() != "b" || req.SpanRecords[1].GetSpanName() != "c" {
+		t.Errorf("expected the two newest spans to be reported, got %v", req.SpanRecords)
+	}
+	if got := findMetric(req, "spans.dropped"); got != 1 {
+		t.Errorf("expected 1 dropped span, got %d", got)
+	}
+
+	if _, err := NewRecorderE(Options{AccessToken: "token", OverflowPolicy: "drop_random"}); err == nil {
+		t.Error("expected an error for an unknown overflow policy")
+	}
+}
+
+func TestInvalidCounterMode(t *testing.T) {
+	if _, err := NewRecorderE(Options{AccessToken: "token", CounterMode: "sometimes"}); err == nil {
+		t.Error("expected an error for an unknown counter mode")
+	}
+}
+
+// blockingReportingService holds each report until release is closed.
+type blockingReportingService struct {
+	*mockReportingService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.mockReportingService.Report(auth, request)
+}
+
+func TestCountersDuringReport(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		rec, backend := newTestRecorder(Options{MaxBufferedSpans: 2})
+		if fail {
+			backend.err = fmt.Errorf("unavailable")
+		}
+		slow := &blockingReportingService{backend, make(chan struct{}), make(chan struct{})}
+		rec.lock.Lock()
+		rec.backend = slow
+		rec.lock.Unlock()
+
+		// One span is dropped before the report and one during it.
+		for i := 0; i < 3; i++ {
+			rec.RecordSpan(makeRawSpan("before", nil))
+		}
+		done := make(chan struct{})
+		go func() {
+			rec.Flush()
+			close(done)
+		}()
+		<-slow.started
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec.RecordSpan(makeRawSpan("during", nil))
+			}()
+		}
+		wg.Wait()
+		close(slow.release)
+		<-done
+
+		if got := findMetric(backend.lastRequest(), "spans.dropped"); got != 1 {
+			t.Errorf("fail=%v: expected the first report to count 1 dropped span, got %d", fail, got)
+		}
+		backend.err = nil
+		go func() { <-slow.started }()
+		rec.Flush()
+		// A failed report's count is carried over, and its two spans,
+		// restored into a buffer already full, are dropped too.
+		expected := int64(1)
+		if fail {
+			expected = 4
+		}
+		if got := findMetric(backend.lastRequest(), "spans.dropped"); got != expected {
+			t.Errorf("fail=%v: expected the next report to count %d dropped spans, got %d", fail, expected, got)
+		}
+	}
+}
+
+func TestDegradationLadder(t *testing.T) {
+	rec, backend := newTestRecorder(Options{
+		MaxBufferedSpans: 4,
+		DegradationLadder: []DegradationStep{
+			{Fill: 0.5, Shed: DetailPayloads},
+			{Fill: 0.75, Shed: DetailLogs | DetailTags},
+		},
+		LowValueTags: []string{"debug"},
+	})
+	for i := 0; i < 4; i++ {
+		raw := makeRawSpan(fmt.Sprintf("op-%d", i), ot.Tags{"debug": "x", "keep": "y"})
+		raw.Logs = []ot.LogRecord{{
+			Timestamp: raw.Start,
+			Fields:    []log.Field{log.String("event", "start"), log.Object("payload", "detail")},
+		}}
+		rec.RecordSpan(raw)
+	}
+	rec.Flush()
+
+	recs := backend.lastRequest().SpanRecords
+	if len(recs) != 4 {
+		t.Fatalf("expected every span to be retained, got %d", len(recs))
+	}
+	for i, sr := range recs {
+		expectLogs, expectPayload, expectDebug := i < 3, i < 2, i < 3
+		if got := len(sr.LogRecords) == 1; got != expectLogs {
+			t.Errorf("span %d: expected logs %v, got %v", i, expectLogs, sr.LogRecords)
+			continue
+		}
+		if expectLogs {
+			if got := sr.LogRecords[0].PayloadJson != nil; got != expectPayload {
+				t.Errorf("span %d: expected payload %v, got %v", i, expectPayload, got)
+			}
+			if sr.LogRecords[0].GetStableName() != "start" {
+				t.Errorf("span %d: expected the log event to be kept", i)
+			}
+		}
+		if _, got := findAttribute(sr.Attributes, "debug"); got != expectDebug {
+			t.Errorf("span %d: expected debug tag %v, got %v", i, expectDebug, got)
+		}
+		if _, ok := findAttribute(sr.Attributes, "keep"); !ok {
+			t.Errorf("span %d: expected the keep tag to be retained", i)
+		}
+	}
+	if n := findMetric(backend.lastRequest(), "spans.degraded"); n != 2 {
+		t.Errorf("expected 2 degraded spans, got %d", n)
+	}
+}
+
+func TestReportingPeriod(t *testing.T) {
+	shouldFlushAfter := func(rec *Recorder, elapsed time.Duration) bool {
+		rec.lock.Lock()
+		rec.lastReportAttempt = time.Now().Add(-elapsed)
+		rec.lock.Unlock()
+		return rec.shouldFlush()
+	}
+
+	// The loop wakes every minReportingPeriod, so a 750ms period is
+	// flushed by any check 250ms or more after the last report.
+	rec, _ := newTestRecorder(Options{ReportingPeriod: 750 * time.Millisecond})
+	if shouldFlushAfter(rec, 150*time.Millisecond) {
+		t.Error("expected no flush before the reporting period is due")
+	}
+	if !shouldFlushAfter(rec, 300*time.Millisecond) {
+		t.Error("expected a flush once the reporting period is due")
+	}
+
+	rec, _ = newTestRecorder(Options{})
+	if rec.maxReportingPeriod != defaultMaxReportingPeriod {
+		t.Errorf("expected the default period, got %v", rec.maxReportingPeriod)
+	}
+	if shouldFlushAfter(rec, 300*time.Millisecond) {
+		t.Error("expected no flush before the default reporting period is due")
+	}
+
+	rec, _ = newTestRecorder(Options{ReportingPeriod: 100 * time.Millisecond})
+	if rec.maxReportingPeriod != minReportingPeriod {
+		t.Errorf("expected the period to be clamped to %v, got %v", minReportingPeriod, rec.maxReportingPeriod)
+	}
+}
+
+func TestJoinTags(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.RecordSpan(makeRawSpan("op", ot.Tags{"join:foo": "bar", "other": "baz"}))
+	rec.Flush()
+
+	span := backend.lastRequest().SpanRecords[0]
+	if len(span.JoinIds) != 1 || span.JoinIds[0].TraceKey != "join:foo" || span.JoinIds[0].Value != "bar" {
+		t.Errorf("expected join:foo to be reported as a join ID, got %v", span.JoinIds)
+	}
+	if _, ok := findAttribute(span.Attributes, "join:foo"); ok {
+		t.Error("join:foo should not be reported as an attribute")
+	}
+	if _, ok := findAttribute(span.Attributes, "other"); !ok {
+		t.Error("expected other tags to be reported as attributes")
+	}
+}
+
+func TestClose(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := backend.requestCount(); n != 1 || len(backend.lastRequest().SpanRecords) != 1 {
+		t.Fatalf("expected Close to report the buffered span, got %d reports", n)
+	}
+	select {
+	case <-rec.loopDone:
+	default:
+		t.Error("expected the report loop to have exited")
+	}
+
+	rec.RecordSpan(makeRawSpan("late", nil))
+	rec.Flush()
+	if n := backend.requestCount(); n != 1 {
+		t.Errorf("expected spans recorded after Close to be discarded, got %d reports", n)
+	}
+	if err := rec.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+}
+
+func TestBaggage(t *testing.T) {
+	tracer := NewTracer(Options{
+		AccessToken:      "0987654321",
+		MaxLogMessageLen: 1024,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	backend := &mockReportingService{}
+	rec.lock.Lock()
+	rec.backend = backend
+	rec.lastReportAttempt = time.Now()
+	rec.lock.Unlock()
+
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("tenant", "acme")
+	child := tracer.StartSpan("child", ot.ChildOf(parent.Context()))
+	child.Finish()
+	parent.Finish()
+	rec.Flush()
+
+	recs := backend.lastRequest().SpanRecords
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(recs))
+	}
+	for _, sr := range recs {
+		if value, ok := findAttribute(sr.Attributes, BaggageKeyPrefix+"tenant"); !ok || value != "acme" {
+			t.Errorf("%s: expected tenant baggage to be reported, got %q", sr.GetSpanName(), value)
+		}
+	}
+}
+
+func TestFlushErrors(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if err := rec.Flush(); err != nil {
+		t.Errorf("expected a successful flush, got %v", err)
+	}
+
+	transportErr := fmt.Errorf("unavailable")
+	backend.err = transportErr
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if err := rec.Flush(); err != transportErr {
+		t.Errorf("expected the transport error, got %v", err)
+	}
+	if n := rec.buffer.len(); n != 1 {
+		t.Errorf("expected the span to be kept after a failed flush, got %d", n)
+	}
+
+	backend.err = nil
+	backend.response = &lightstep_thrift.ReportResponse{Errors: []string{"bad span"}}
+	err := rec.Flush()
+	if errs, ok := err.(CollectorErrors); !ok || len(errs) != 1 || errs[0] != "bad span" {
+		t.Errorf("expected CollectorErrors, got %v", err)
+	}
+
+	rec.Disable()
+	if err := rec.Flush(); err != ErrRecorderDisabled {
+		t.Errorf("expected ErrRecorderDisabled, got %v", err)
+	}
+}
+
+func TestFlushWithContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Simulate a collector outage.
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	rec := NewRecorder(Options{
+		AccessToken: "0987654321",
+		Collector:   Endpoint{Host: host, Port: portNum, Plaintext: true},
+	})
+	defer func() {
+		// Unblock any report without a deadline before shutting down, as
+		// the server waits for active connections to finish.
+		close(release)
+		rec.Close()
+		server.Close()
+	}()
+	rec.RecordSpan(makeRawSpan("op", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := rec.FlushWithContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the report to be aborted at the deadline, took %v", elapsed)
+	}
+	rec.lock.Lock()
+	buffered := rec.buffer.len()
+	rec.lock.Unlock()
+	if buffered != 1 {
+		t.Errorf("expected the span to be restored to the buffer, got %d", buffered)
+	}
+}
+
+func TestReportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Simulate a stalled collector.
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	rec := NewRecorder(Options{
+		AccessToken:   "0987654321",
+		Collector:     Endpoint{Host: host, Port: portNum, Plaintext: true},
+		ReportTimeout: 100 * time.Millisecond,
+	})
+	defer func() {
+		close(release)
+		rec.Close()
+		server.Close()
+	}()
+	rec.RecordSpan(makeRawSpan("op", nil))
+
+	start := time.Now()
+	if err := rec.Flush(); err == nil {
+		t.Error("expected the stalled report to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the report to time out, took %v", elapsed)
+	}
+	rec.lock.Lock()
+	buffered := rec.buffer.len()
+	rec.lock.Unlock()
+	if buffered != 1 {
+		t.Errorf("expected the span to be restored to the buffer, got %d", buffered)
+	}
+}
+
+// countingTransport counts the requests it forwards to http.DefaultTransport.
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	transport := &countingTransport{}
+	rec := NewRecorder(Options{
+		AccessToken: "0987654321",
+		Collector:   collector.endpoint(),
+		HTTPClient:  &http.Client{Transport: transport},
+	})
+	defer rec.Close()
+	rec.RecordSpan(makeRawSpan("op", nil))
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&transport.requests); n == 0 {
+		t.Error("expected the report to be sent through the custom client")
+	}
+	if req := collector.backend.lastRequest(); req == nil || len(req.SpanRecords) != 1 {
+		t.Error("the report did not reach the collector")
+	}
+}
+
+func TestStatsCounts(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxBufferedSpans: 2})
+	for i := 0; i < 3; i++ {
+		rec.RecordSpan(makeRawSpan("op", nil))
+	}
+	stats := rec.Stats()
+	if stats.RecordedSpans != 2 || stats.DroppedSpans != 1 {
+		t.Errorf("expected 2 recorded and 1 dropped span, got %+v", stats)
+	}
+	if stats.BufferedSpans != 2 || stats.BufferCapacity != 2 {
+		t.Errorf("expected a full buffer of 2, got %+v", stats)
+	}
+
+	backend.err = fmt.Errorf("unavailable")
+	rec.Flush()
+	stats = rec.Stats()
+	if _, err := rec.LastReportError(); stats.ReportsSent != 0 || err != backend.err {
+		t.Errorf("expected the failed report to be recorded, got %v with %+v", err, stats)
+	}
+
+	backend.err = nil
+	rec.Flush()
+	stats = rec.Stats()
+	if _, err := rec.LastReportError(); stats.ReportsSent != 1 || err != nil || stats.BufferedSpans != 0 {
+		t.Errorf("expected a successful report, got %v with %+v", err, stats)
+	}
+	// Dropped spans are not reset by a report.
+	if stats.DroppedSpans != 1 {
+		t.Errorf("expected the dropped span total to be kept, got %d", stats.DroppedSpans)
+	}
+}
+
+func TestLastReportError(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{clock: clk})
+	if at, err := rec.LastReportError(); err != nil || !at.IsZero() {
+		t.Errorf("expected no report yet, got %v at %v", err, at)
+	}
+
+	clk.advance(time.Second)
+	backend.err = fmt.Errorf("unavailable")
+	rec.Flush()
+	if at, err := rec.LastReportError(); err != backend.err || !at.Equal(clk.Now()) {
+		t.Errorf("expected the failed report at %v, got %v at %v", clk.Now(), err, at)
+	}
+
+	clk.advance(time.Second)
+	backend.err = nil
+	backend.response = &lightstep_thrift.ReportResponse{Errors: []string{"bad span"}}
+	rec.Flush()
+	if _, err := rec.LastReportError(); err == nil {
+		t.Error("expected the collector's errors to be reported")
+	}
+
+	clk.advance(time.Second)
+	backend.response = nil
+	rec.Flush()
+	if at, err := rec.LastReportError(); err != nil || !at.Equal(clk.Now()) {
+		t.Errorf("expected the successful report at %v, got %v at %v", clk.Now(), err, at)
+	}
+}
+
+func TestOnDroppedSpans(t *testing.T) {
+	var notified int64
+	var rec *Recorder
+	rec, _ = newTestRecorder(Options{
+		MaxBufferedSpans: 2,
+		OnDroppedSpans: func(count int) {
+			// The recording path's lock must not be held.
+			rec.lock.Lock()
+			rec.lock.Unlock()
+			atomic.AddInt64(&notified, int64(count))
+		},
+	})
+	defer rec.Close()
+	for i := 0; i < 5; i++ {
+		rec.RecordSpan(makeRawSpan("op", nil))
+	}
+	if !waitFor(time.Second, func() bool { return atomic.LoadInt64(&notified) == 3 }) {
+		t.Errorf("expected 3 dropped spans to be notified, got %d", atomic.LoadInt64(&notified))
+	}
+}
+
+func TestMaxSpansPerSecond(t *testing.T) {
+	clk := newFakeClock()
+	rec, backend := newTestRecorder(Options{MaxSpansPerSecond: 5, clock: clk})
+	for i := 0; i < 8; i++ {
+		rec.RecordSpan(makeRawSpan("op", nil))
+	}
+	rec.Flush()
+	req := backend.lastRequest()
+	if len(req.SpanRecords) != 5 {
+		t.Errorf("expected the report to be capped at 5 spans, got %d", len(req.SpanRecords))
+	}
+	if n := findMetric(req, "spans.throttled"); n != 3 {
+		t.Errorf("expected 3 throttled spans, got %d", n)
+	}
+	if n := findMetric(req, "spans.dropped"); n != 3 {
+		t.Errorf("expected throttled spans to be counted as dropped, got %d", n)
+	}
+
+	clk.advance(time.Second)
+	for i := 0; i < 4; i++ {
+		rec.RecordSpan(makeRawSpan("op", nil))
+	}
+	rec.Flush()
+	if n := len(backend.lastRequest().SpanRecords); n != 4 {
+		t.Errorf("expected spans under the limit to be reported, got %d", n)
+	}
+	if stats := rec.Stats(); stats.DroppedSpans != 3 || stats.ThrottledSpans != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCollectorPath(t *testing.T) {
+	for _, test := range []struct {
+		opts Options
+		url  string
+	}{
+		{Options{}, "https://collector.lightstep.com:443/_rpc/v1/reports/binary"},
+		{Options{ThriftProtocol: ThriftProtocolCompact}, "https://collector.lightstep.com:443" + compactCollectorPath},
+		{Options{CollectorPath: "/lightstep/reports"}, "https://collector.lightstep.com:443/lightstep/reports"},
+		{Options{
+			Collector:      Endpoint{Host: "proxy.internal", Port: 8080, Plaintext: true},
+			ThriftProtocol: ThriftProtocolCompact,
+			CollectorPath:  "/lightstep/reports",
+		}, "http://proxy.internal:8080/lightstep/reports"},
+	} {
+		test.opts.AccessToken = "0987654321"
+		rec, err := NewRecorderE(test.opts)
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", test.opts, err)
+			continue
+		}
+		rec.(*Recorder).Close()
+		if got := rec.(*Recorder).collectorURL; got != test.url {
+			t.Errorf("expected collector URL %q, got %q", test.url, got)
+		}
+	}
+
+	for _, path := range []string{"lightstep/reports", "https://proxy.internal/lightstep/reports"} {
+		if _, err := NewRecorderE(Options{AccessToken: "0987654321", CollectorPath: path}); err == nil {
+			t.Errorf("expected an error for CollectorPath %q", path)
+		}
+	}
+}
+
+func TestSynchronous(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	// A short-lived process: a few spans, then an immediate shutdown, long
+	// before any reporting period could elapse.
+	tracer := NewTracer(Options{
+		AccessToken:          "0987654321",
+		Collector:            collector.endpoint(),
+		Synchronous:          true,
+		SynchronousBatchSize: 3,
+	})
+	rec := tracer.(basictracer.Tracer).Options().Recorder.(*Recorder)
+	for i := 0; i < 3; i++ {
+		tracer.StartSpan("batched").Finish()
+	}
+	if n := collector.backend.requestCount(); n != 1 {
+		t.Errorf("expected a full batch to be reported as it was recorded, got %d reports", n)
+	}
+	tracer.StartSpan("remainder").Finish()
+	tracer.StartSpan("remainder").Finish()
+	rec.Close()
+
+	var names []string
+	collector.backend.lock.Lock()
+	for _, req := range collector.backend.requests {
+		for _, span := range req.SpanRecords {
+			names = append(names, span.GetSpanName())
+		}
+	}
+	collector.backend.lock.Unlock()
+	expected := []string{"batched", "batched", "batched", "remainder", "remainder"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected every span to be delivered, got %v", names)
+	}
+}
+
+// flakyReportingService fails its first report, recording a span while it
+// is in flight.
+type flakyReportingService struct {
+	*mockReportingService
+	rec    *Recorder
+	failed bool
+}
+
+func (f *flakyReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	if f.failed {
+		return f.mockReportingService.Report(auth, request)
+	}
+	f.failed = true
+	f.rec.RecordSpan(makeRawSpan("during", nil))
+	return nil, fmt.Errorf("unavailable")
+}
+
+func TestForceFlush(t *testing.T) {
+	rec, backend := newTestRecorder(Options{})
+	defer rec.Close()
+	rec.lock.Lock()
+	rec.backend = &flakyReportingService{mockReportingService: backend, rec: rec}
+	rec.lock.Unlock()
+
+	rec.RecordSpan(makeRawSpan("before", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rec.ForceFlush(ctx); err != nil {
+		t.Fatalf("expected ForceFlush to succeed, got %v", err)
+	}
+	var operations []string
+	backend.lock.Lock()
+	for _, req := range backend.requests {
+		for _, span := range req.SpanRecords {
+			operations = append(operations, span.GetSpanName())
+		}
+	}
+	backend.lock.Unlock()
+	sort.Strings(operations)
+	if expected := []string{"before", "during"}; !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected %v to be delivered, got %v", expected, operations)
+	}
+
+	// A collector that stays down fails the flush once ctx is done.
+	backend.err = fmt.Errorf("unavailable")
+	rec.RecordSpan(makeRawSpan("after", nil))
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := rec.ForceFlush(ctx); err == nil {
+		t.Error("expected ForceFlush to fail while the collector is down")
+	}
+	if n := rec.Stats().BufferedSpans; n != 1 {
+		t.Errorf("expected the span to stay buffered, got %d", n)
+	}
+}
+
+// failingAfterReportingService delivers its first ok reports, then fails.
+type failingAfterReportingService struct {
+	*mockReportingService
+	ok int
+}
+
+func (f *failingAfterReportingService) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	if f.requestCount() >= f.ok {
+		return nil, fmt.Errorf("unavailable")
+	}
+	return f.mockReportingService.Report(auth, request)
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxBufferedSpans: 100, MaxBufferedBytes: 64 * 1024})
+	payload := strings.Repeat("x", 20*1024)
+	for i := 0; i < 5; i++ {
+		rec.RecordSpan(makeRawSpan(strconv.Itoa(i), ot.Tags{"payload": payload}))
+	}
+	stats := rec.Stats()
+	if stats.BufferedSpans != 3 || stats.DroppedSpans != 2 {
+		t.Errorf("expected the byte limit to keep 3 of the 5 large spans, got %d buffered and %d dropped",
+			stats.BufferedSpans, stats.DroppedSpans)
+	}
+	if stats.BufferedBytes <= 60*1024 || stats.BufferedBytes > 64*1024 {
+		t.Errorf("expected about 60KiB buffered, got %d bytes", stats.BufferedBytes)
+	}
+	if !rec.shouldFlush() {
+		t.Error("expected a buffer near its byte limit to be flushed early")
+	}
+
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	if recs := backend.lastRequest().SpanRecords; len(recs) != 3 {
+		t.Errorf("expected the 3 buffered spans to be reported, got %d", len(recs))
+	}
+	if n := rec.Stats().BufferedBytes; n != 0 {
+		t.Errorf("expected the flushed buffer to be empty, got %d bytes", n)
+	}
+}
+
+func TestMaxSpansPerReport(t *testing.T) {
+	rec, backend := newTestRecorder(Options{MaxSpansPerReport: 4})
+	for i := 0; i < 10; i++ {
+		rec.RecordSpan(makeRawSpan(strconv.Itoa(i), nil))
+	}
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	backend.lock.Lock()
+	var sizes []int
+	for i, req := range backend.requests {
+		sizes = append(sizes, len(req.SpanRecords))
+		if (req.InternalMetrics != nil) != (i == 0) {
+			t.Errorf("expected only the first request to carry metrics, got %v in request %d", req.InternalMetrics, i)
+		}
+	}
+	backend.lock.Unlock()
+	if expected := []int{4, 4, 2}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("expected requests of %v spans, got %v", expected, sizes)
+	}
+	if n := rec.Stats().ReportsSent; n != 3 {
+		t.Errorf("expected 3 reports sent, got %d", n)
+	}
+
+	// Once a request fails, only the spans not yet delivered are kept.
+	rec, backend = newTestRecorder(Options{MaxSpansPerReport: 4})
+	rec.lock.Lock()
+	rec.backend = &failingAfterReportingService{mockReportingService: backend, ok: 1}
+	rec.lock.Unlock()
+	for i := 0; i < 10; i++ {
+		rec.RecordSpan(makeRawSpan(strconv.Itoa(i), nil))
+	}
+	if err := rec.Flush(); err == nil {
+		t.Fatal("expected the second request to fail")
+	}
+	if n := rec.Stats().BufferedSpans; n != 6 {
+		t.Errorf("expected the 6 undelivered spans to be kept, got %d", n)
+	}
+	rec.lock.Lock()
+	rec.backend = backend
+	rec.lock.Unlock()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	var operations []string
+	backend.lock.Lock()
+	for _, req := range backend.requests {
+		for _, span := range req.SpanRecords {
+			operations = append(operations, span.GetSpanName())
+		}
+	}
+	backend.lock.Unlock()
+	sort.Strings(operations)
+	if expected := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}; !reflect.DeepEqual(operations, expected) {
+		t.Errorf("expected every span to be delivered once, got %v", operations)
+	}
+}
+
+func TestContextClosesRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rec, backend := newTestRecorder(Options{Context: ctx})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	cancel()
+
+	closed := func() bool {
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		return rec.closed && rec.disabled
+	}
+	if !waitFor(time.Second, closed) {
+		t.Fatal("expected the Recorder to be closed once the context is done")
+	}
+	select {
+	case <-rec.loopDone:
+	default:
+		t.Error("expected the report loop to have stopped")
+	}
+	if n := backend.requestCount(); n != 1 {
+		t.Fatalf("expected a final report, got %d", n)
+	}
+	if req := backend.lastRequest(); len(req.SpanRecords) != 1 {
+		t.Errorf("expected the buffered span in the final report, got %v", req.SpanRecords)
+	}
+}
+
+func TestRecordQueue(t *testing.T) {
+	rec, backend := newTestRecorder(Options{RecordQueueSize: 4, MaxBufferedSpans: 1000})
+	defer rec.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 5; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				rec.RecordSpan(makeRawSpan("op", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Spans recorded before Flush are reported by it, whether still queued
+	// or not, save one the drain goroutine may have taken off the queue
+	// but not yet buffered.
+	var reported int
+	if !waitFor(time.Second, func() bool {
+		rec.Flush()
+		backend.lock.Lock()
+		defer backend.lock.Unlock()
+		reported = 0
+		for _, req := range backend.requests {
+			reported += len(req.SpanRecords)
+		}
+		return reported == 100
+	}) {
+		t.Errorf("expected 100 spans to be reported, got %d", reported)
+	}
+	if stats := rec.Stats(); stats.RecordedSpans != 100 || stats.DroppedSpans != 0 {
+		t.Errorf("expected every span to be recorded, got %+v", stats)
+	}
+}
@@ -0,0 +1,89 @@
+package thrift_rpc
+
+import (
+	"sync"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/lightstep/lightstep-tracer-go/thrift_0_9_2/lib/go/thrift"
+)
+
+// RecordingBackend is a ReportingService that keeps a copy of every
+// request it receives instead of sending it anywhere. Set it as
+// Options.Backend to test the spans an application reports without a
+// collector.
+type RecordingBackend struct {
+	lock     sync.Mutex
+	requests []*lightstep_thrift.ReportRequest
+	response *lightstep_thrift.ReportResponse
+	err      error
+}
+
+// NewRecordingBackend returns a RecordingBackend that accepts every report.
+func NewRecordingBackend() *RecordingBackend {
+	return &RecordingBackend{}
+}
+
+// Report records a copy of request, then returns the response set by
+// SetResponse, or an empty one.
+func (b *RecordingBackend) Report(auth *lightstep_thrift.Auth, request *lightstep_thrift.ReportRequest) (*lightstep_thrift.ReportResponse, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.requests = append(b.requests, copyReportRequest(request))
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.response != nil {
+		return b.response, nil
+	}
+	return &lightstep_thrift.ReportResponse{}, nil
+}
+
+// SetResponse sets what subsequent calls to Report return. A non-nil err
+// makes them fail, as if the collector were unreachable.
+func (b *RecordingBackend) SetResponse(resp *lightstep_thrift.ReportResponse, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.response = resp
+	b.err = err
+}
+
+// Requests returns the requests received so far, oldest first.
+func (b *RecordingBackend) Requests() []*lightstep_thrift.ReportRequest {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]*lightstep_thrift.ReportRequest(nil), b.requests...)
+}
+
+// Spans returns the spans of every request received so far, in the order
+// they were reported.
+func (b *RecordingBackend) Spans() []*lightstep_thrift.SpanRecord {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var spans []*lightstep_thrift.SpanRecord
+	for _, req := range b.requests {
+		spans = append(spans, req.SpanRecords...)
+	}
+	return spans
+}
+
+// Reset discards the requests received so far.
+func (b *RecordingBackend) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.requests = nil
+}
+
+// copyReportRequest deep copies req by round-tripping it through thrift,
+// so that the copy shares no records with the Recorder or its caller.
+func copyReportRequest(req *lightstep_thrift.ReportRequest) *lightstep_thrift.ReportRequest {
+	buf := thrift.NewTMemoryBuffer()
+	protocol := thrift.NewTBinaryProtocolTransport(buf)
+	if err := req.Write(protocol); err != nil {
+		panic(err)
+	}
+	copied := lightstep_thrift.NewReportRequest()
+	if err := copied.Read(protocol); err != nil {
+		panic(err)
+	}
+	return copied
+}
@@ -0,0 +1,42 @@
+package thrift_rpc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecordingBackend(t *testing.T) {
+	backend := NewRecordingBackend()
+	rec := NewRecorder(Options{AccessToken: "0987654321", Backend: backend})
+	defer rec.Close()
+
+	rec.RecordSpan(makeRawSpan("first", map[string]interface{}{"join:request": "r1"}))
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	spans := backend.Spans()
+	if len(spans) != 1 || spans[0].GetSpanName() != "first" {
+		t.Fatalf("expected the span to be reported to the backend, got %v", spans)
+	}
+	if ids := spans[0].JoinIds; len(ids) != 1 || ids[0].TraceKey != "join:request" || ids[0].Value != "r1" {
+		t.Errorf("unexpected join IDs %v", ids)
+	}
+
+	// A failing backend keeps the spans for the next report.
+	backend.SetResponse(nil, errors.New("unavailable"))
+	rec.RecordSpan(makeRawSpan("second", nil))
+	if err := rec.Flush(); err == nil {
+		t.Error("expected the backend's error")
+	}
+	backend.SetResponse(nil, nil)
+	backend.Reset()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	if spans := backend.Spans(); len(spans) != 1 || spans[0].GetSpanName() != "second" {
+		t.Errorf("expected the retried span, got %v", spans)
+	}
+	if n := len(backend.Requests()); n != 1 {
+		t.Errorf("expected one request since Reset, got %d", n)
+	}
+}
@@ -0,0 +1,59 @@
+package thrift_rpc
+
+import (
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// ReferenceTypeKey is the tag key under which the type of a span's parent
+// reference is recorded. basictracer keeps only the parent's span ID, so
+// without it a FollowsFrom parent is indistinguishable from a ChildOf one.
+// Spans with a ChildOf parent, or no parent, carry no such tag. Thrift span
+// records have no references, so the thrift Recorder reports the tag as an
+// attribute, alongside ParentSpanGUIDKey; the gRPC Recorder reports it only
+// as the relationship of the span's parent reference.
+const ReferenceTypeKey = "lightstep.reference_type"
+
+// FollowsFromReferenceType is the ReferenceTypeKey value recorded for
+// spans whose parent was given with opentracing.FollowsFrom.
+const FollowsFromReferenceType = "follows_from"
+
+// referenceTracer wraps a basictracer.Tracer so that spans started with a
+// FollowsFrom parent are tagged with ReferenceTypeKey, so that spans keep
+// their sampling priority (see priority.go), and so that span contexts are
+// propagated with LightStep's headers (see propagation.go).
+type referenceTracer struct {
+	basictracer.Tracer
+}
+
+// NewReferenceTracer wraps tracer, which must be a basictracer.Tracer, so
+// that the type of each span's parent reference is preserved in its tags,
+// and so that TextMap and HTTPHeaders carriers use TraceIDHeader and the
+// other LightStep propagation headers.
+func NewReferenceTracer(tracer ot.Tracer) ot.Tracer {
+	return &referenceTracer{tracer.(basictracer.Tracer)}
+}
+
+func (t *referenceTracer) StartSpan(operationName string, opts ...ot.StartSpanOption) ot.Span {
+	if parentReferenceType(opts) == ot.FollowsFromRef {
+		opts = append(opts, ot.Tag{Key: ReferenceTypeKey, Value: FollowsFromReferenceType})
+	}
+	return &prioritySpan{t.Tracer.StartSpan(operationName, opts...).(basictracer.Span)}
+}
+
+// parentReferenceType returns the type of the reference basictracer will
+// take as the span's parent: the first ChildOf or FollowsFrom reference.
+// It returns ChildOfRef if there is none.
+func parentReferenceType(opts []ot.StartSpanOption) ot.SpanReferenceType {
+	var sso ot.StartSpanOptions
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	for _, ref := range sso.References {
+		switch ref.Type {
+		case ot.ChildOfRef, ot.FollowsFromRef:
+			return ref.Type
+		}
+	}
+	return ot.ChildOfRef
+}
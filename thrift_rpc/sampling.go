@@ -0,0 +1,74 @@
+package thrift_rpc
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/opentracing/basictracer-go"
+)
+
+// operationSampler samples spans whose operation matches a glob pattern at
+// that pattern's rate; see Options.PerOperationSampleRates.
+type operationSampler struct {
+	pattern *regexp.Regexp
+	sample  func(traceID uint64) bool
+}
+
+// newOperationSamplers compiles rates, most specific (longest) pattern
+// first, so that the sampler for a given operation is deterministic.
+func newOperationSamplers(rates map[string]float64) []operationSampler {
+	patterns := make([]string, 0, len(rates))
+	for pattern := range rates {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	samplers := make([]operationSampler, len(patterns))
+	for i, pattern := range patterns {
+		samplers[i] = operationSampler{
+			pattern: globToRegexp(pattern),
+			sample:  operationRateSampler(rates[pattern]),
+		}
+	}
+	return samplers
+}
+
+// operationRateSampler is like TraceSampler, except that a rate of zero
+// drops every span.
+func operationRateSampler(rate float64) func(traceID uint64) bool {
+	if rate <= 0 {
+		return func(_ uint64) bool { return false }
+	}
+	return TraceSampler(rate)
+}
+
+// globToRegexp compiles a glob in which "*" matches any run of characters
+// (including "/" and ".") and "?" matches any single character.
+func globToRegexp(glob string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// shouldRecord reports whether raw survives sampling.
+// caller must hold r.lock
+func (r *Recorder) shouldRecord(raw *basictracer.RawSpan) bool {
+	if IsForceRecorded(raw) {
+		return true
+	}
+	if priority, ok := SamplingPriority(raw); ok {
+		return priority > 0
+	}
+	for _, s := range r.operationSamplers {
+		if s.pattern.MatchString(raw.Operation) {
+			return s.sample(raw.Context.TraceID)
+		}
+	}
+	return !r.dropUnsampled || raw.Context.Sampled
+}
@@ -0,0 +1,78 @@
+package thrift_rpc
+
+import (
+	"fmt"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/opentracing/basictracer-go"
+)
+
+const (
+	// spanOverheadBytes approximates the serialized size of a span's fixed
+	// fields: its GUIDs, timestamps, and the framing of its other fields.
+	spanOverheadBytes = 64
+
+	// logOverheadBytes does the same for each of its logs.
+	logOverheadBytes = 16
+)
+
+// spanSize approximates the size of raw once serialized, for
+// Options.MaxBufferedBytes. It is zero if the buffer has no byte limit, so
+// that spans are only sized when needed.
+func (b *spansBuffer) spanSize(raw *basictracer.RawSpan) int {
+	if b.maxBytes == 0 {
+		return 0
+	}
+	size := spanOverheadBytes + len(raw.Operation)
+	for key, value := range raw.Tags {
+		size += len(key) + valueSize(value)
+	}
+	for key, value := range raw.Context.Baggage {
+		size += len(BaggageKeyPrefix) + len(key) + len(value)
+	}
+	for _, log := range raw.Logs {
+		size += logOverheadBytes
+		for _, field := range log.Fields {
+			size += len(field.Key()) + valueSize(field.Value())
+		}
+	}
+	return size
+}
+
+// recordSize is spanSize for a span already converted to thrift.
+func (b *spansBuffer) recordSize(record *lightstep_thrift.SpanRecord) int {
+	if b.maxBytes == 0 {
+		return 0
+	}
+	size := spanOverheadBytes + len(record.GetSpanName())
+	for _, joinID := range record.JoinIds {
+		size += len(joinID.TraceKey) + len(joinID.Value)
+	}
+	for _, attr := range record.Attributes {
+		size += len(attr.Key) + len(attr.Value)
+	}
+	for _, log := range record.LogRecords {
+		size += logOverheadBytes + len(log.GetStableName()) + len(log.GetMessage()) + len(log.GetPayloadJson())
+		for _, field := range log.Fields {
+			size += len(field.Key) + len(field.Value)
+		}
+		for _, frame := range log.StackFrames {
+			size += len(frame)
+		}
+	}
+	return size
+}
+
+// valueSize approximates the size of a tag or log field value once
+// formatted.
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return 8
+	}
+	return len(fmt.Sprint(value))
+}
@@ -1,25 +1,97 @@
 package thrift_rpc
 
-import "github.com/opentracing/basictracer-go"
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lightstep/lightstep-tracer-go/lightstep_thrift"
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
 
 const defaultMaxSpans = 1000
 
+// OverflowPolicy selects which spans are discarded when a span is recorded
+// into a full buffer.
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest discards the spans being recorded, keeping those
+	// already buffered. It is the default.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+
+	// OverflowDropOldest evicts the oldest buffered spans to make room,
+	// so that a report covers the most recent activity.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+func (p OverflowPolicy) validate() error {
+	switch p {
+	case "", OverflowDropNewest, OverflowDropOldest:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q", string(p))
+}
+
 type spansBuffer struct {
 	rawSpans      []basictracer.RawSpan
 	maxBufferSize int
+
+	// records are spans already converted to thrift, reported as is. They
+	// count towards maxBufferSize along with rawSpans.
+	records []*lightstep_thrift.SpanRecord
+
+	// oldestAdded is when the oldest span in the buffer was added, or zero
+	// if the buffer is empty.
+	oldestAdded time.Time
+	clock       clock
+
+	// When coalesce is set, a span identical to the most recently buffered
+	// one (same operation and same values for coalesceKeyTags) is folded
+	// into it rather than buffered separately.
+	coalesce        bool
+	coalesceKeyTags []string
+
+	// dropOldest is set for OverflowDropOldest.
+	dropOldest bool
+
+	// maxBytes, if positive, bounds the approximate serialized size of the
+	// buffered spans and records (see spanSize) alongside maxBufferSize;
+	// bytes is their size now. Neither is tracked otherwise.
+	maxBytes int
+	bytes    int
 }
 
 func (b *spansBuffer) setDefaults() {
 	b.maxBufferSize = defaultMaxSpans
 	b.rawSpans = make([]basictracer.RawSpan, 0, b.maxBufferSize)
+	b.clock = realClock{}
+}
+
+func (b *spansBuffer) setClock(c clock) {
+	b.clock = c
 }
 
 func (b *spansBuffer) setMaxBufferSize(size int) {
 	b.maxBufferSize = size
 }
 
+func (b *spansBuffer) setMaxBytes(size int) {
+	b.maxBytes = size
+}
+
+func (b *spansBuffer) setOverflowPolicy(policy OverflowPolicy) {
+	b.dropOldest = policy == OverflowDropOldest
+}
+
+func (b *spansBuffer) setCoalescing(keyTags []string) {
+	b.coalesce = true
+	b.coalesceKeyTags = keyTags
+}
+
 func (b *spansBuffer) len() int {
-	return len(b.rawSpans)
+	return len(b.rawSpans) + len(b.records)
 }
 
 func (b *spansBuffer) cap() int {
@@ -33,6 +105,20 @@ func (b *spansBuffer) reset() {
 	} else {
 		b.rawSpans = make([]basictracer.RawSpan, 0, b.maxBufferSize)
 	}
+	b.records = nil
+	b.bytes = 0
+	b.oldestAdded = time.Time{}
+}
+
+// fits reports whether n more spans of size bytes in all fit in the buffer.
+func (b *spansBuffer) fits(n, size int) bool {
+	return b.len()+n <= b.maxBufferSize && (b.maxBytes == 0 || b.bytes+size <= b.maxBytes)
+}
+
+// canHold reports whether a span of size bytes fits in the buffer once
+// emptied.
+func (b *spansBuffer) canHold(size int) bool {
+	return b.maxBufferSize > 0 && (b.maxBytes == 0 || size <= b.maxBytes)
 }
 
 func (b *spansBuffer) current() []basictracer.RawSpan {
@@ -41,17 +127,307 @@ func (b *spansBuffer) current() []basictracer.RawSpan {
 	return dst
 }
 
-// addSpans returns the number of spans dropped (0 if all were added to the
-// buffer).
-func (b *spansBuffer) addSpans(spans []basictracer.RawSpan) (droppedSpans int) {
-	space := b.maxBufferSize - len(b.rawSpans)
-	count := space
-	if len(spans) < count {
-		count = len(spans)
+func (b *spansBuffer) currentRecords() []*lightstep_thrift.SpanRecord {
+	dst := make([]*lightstep_thrift.SpanRecord, len(b.records))
+	copy(dst, b.records)
+	return dst
+}
+
+// addRecords is like addSpans for pre-converted spans, which are never
+// coalesced.
+func (b *spansBuffer) addRecords(records []*lightstep_thrift.SpanRecord) (accepted, dropped int) {
+	if b.maxBytes > 0 {
+		for _, record := range records {
+			size := b.recordSize(record)
+			if !b.fits(1, size) {
+				if !b.dropOldest || !b.canHold(size) {
+					dropped++
+					continue
+				}
+				dropped += b.makeRoomFor(1, size)
+			}
+			b.records = append(b.records, record)
+			b.bytes += size
+			accepted++
+		}
+		b.noteAdded(accepted)
+		return
+	}
+	if b.dropOldest {
+		dropped = b.makeRoom(len(records))
+		if len(records) > b.maxBufferSize {
+			dropped += len(records) - b.maxBufferSize
+			records = records[len(records)-b.maxBufferSize:]
+		}
+		b.records = append(b.records, records...)
+		b.noteAdded(len(records))
+		return len(records), dropped
+	}
+	accepted = b.maxBufferSize - b.len()
+	if len(records) < accepted {
+		accepted = len(records)
+	}
+	if accepted < 0 {
+		accepted = 0
+	}
+	b.records = append(b.records, records[:accepted]...)
+	dropped = len(records) - accepted
+	b.noteAdded(accepted)
+	return
+}
+
+func (b *spansBuffer) noteAdded(accepted int) {
+	if accepted > 0 && b.oldestAdded.IsZero() {
+		b.oldestAdded = b.clock.Now()
+	}
+}
+
+// addSpans returns the number of spans accepted into the buffer and the
+// number dropped because it was full. Under OverflowDropNewest the dropped
+// spans are the last of spans, and the two counts sum to len(spans); under
+// OverflowDropOldest they are the oldest buffered spans evicted to make
+// room (or the first of spans, if there are more than fit at all). Spans
+// folded into an existing span by coalescing count as accepted. Spans that
+// would take the buffer over maxBytes are dropped, or evict the oldest,
+// in the same way.
+func (b *spansBuffer) addSpans(spans []basictracer.RawSpan) (accepted, dropped int) {
+	if b.coalesce || b.maxBytes > 0 {
+		defer func() { b.noteAdded(accepted) }()
+		return b.addSpansEach(spans)
+	}
+	if b.dropOldest {
+		if len(spans) > b.maxBufferSize {
+			dropped = len(spans) - b.maxBufferSize
+			spans = spans[dropped:]
+		}
+		dropped += b.makeRoom(len(spans))
+		b.rawSpans = append(b.rawSpans, spans...)
+		b.noteAdded(len(spans))
+		return len(spans), dropped
+	}
+	space := b.maxBufferSize - b.len()
+	accepted = space
+	if len(spans) < accepted {
+		accepted = len(spans)
+	}
+	if accepted < 0 {
+		accepted = 0
+	}
+	if accepted > 0 {
+		b.rawSpans = append(b.rawSpans, spans[:accepted]...)
+	}
+	dropped = len(spans) - accepted
+	b.noteAdded(accepted)
+	return
+}
+
+// addSpan is addSpans for a single span, as recorded by RecordSpan,
+// without building a slice around it.
+func (b *spansBuffer) addSpan(span basictracer.RawSpan) (accepted, dropped int) {
+	if b.coalesce || b.maxBytes > 0 {
+		accepted, dropped = b.addSpanChecked(&span)
+		b.noteAdded(accepted)
+		return
+	}
+	if b.len() >= b.maxBufferSize {
+		if !b.dropOldest || b.maxBufferSize == 0 {
+			return 0, 1
+		}
+		dropped = b.makeRoom(1)
 	}
-	if count > 0 {
-		b.rawSpans = append(b.rawSpans, spans[:count]...)
+	b.rawSpans = append(b.rawSpans, span)
+	b.noteAdded(1)
+	return 1, dropped
+}
+
+// addSpansEach is addSpans one span at a time, for when spans may be
+// coalesced or must be sized against maxBytes.
+func (b *spansBuffer) addSpansEach(spans []basictracer.RawSpan) (accepted, dropped int) {
+	for i := range spans {
+		a, d := b.addSpanChecked(&spans[i])
+		accepted += a
+		dropped += d
 	}
-	droppedSpans = len(spans) - count
 	return
 }
+
+// addSpanChecked adds span, coalescing it into the last buffered span or
+// sizing it against maxBytes.
+func (b *spansBuffer) addSpanChecked(span *basictracer.RawSpan) (accepted, dropped int) {
+	if n := len(b.rawSpans); b.coalesce && n > 0 && b.isIdentical(&b.rawSpans[n-1], span) {
+		last := &b.rawSpans[n-1]
+		b.bytes -= b.spanSize(last)
+		coalesceInto(last, span)
+		b.bytes += b.spanSize(last)
+		return 1, 0
+	}
+	size := b.spanSize(span)
+	if !b.fits(1, size) {
+		if !b.dropOldest || !b.canHold(size) {
+			return 0, 1
+		}
+		dropped = b.makeRoomFor(1, size)
+	}
+	b.rawSpans = append(b.rawSpans, *span)
+	b.bytes += size
+	return 1, dropped
+}
+
+// makeRoom evicts the oldest buffered spans, raw spans first, until n more
+// fit or the buffer is empty, and returns the number evicted.
+func (b *spansBuffer) makeRoom(n int) int {
+	return b.makeRoomFor(n, 0)
+}
+
+// makeRoomFor is like makeRoom, but also evicts spans until size more
+// bytes fit under maxBytes.
+func (b *spansBuffer) makeRoomFor(n, size int) int {
+	excess := b.len() + n - b.maxBufferSize
+	fromSpans, fromRecords := 0, 0
+	for evicted := 0; evicted < b.len(); evicted++ {
+		if evicted >= excess && (b.maxBytes == 0 || b.bytes+size <= b.maxBytes) {
+			break
+		}
+		if fromSpans < len(b.rawSpans) {
+			b.bytes -= b.spanSize(&b.rawSpans[fromSpans])
+			fromSpans++
+		} else {
+			b.bytes -= b.recordSize(b.records[fromRecords])
+			fromRecords++
+		}
+	}
+	// Reslicing rather than copying keeps eviction cheap; append
+	// reallocates once the slice reaches the end of its array.
+	for i := 0; i < fromSpans; i++ {
+		b.rawSpans[i] = basictracer.RawSpan{}
+	}
+	b.rawSpans = b.rawSpans[fromSpans:]
+	b.records = b.records[fromRecords:]
+	return fromSpans + fromRecords
+}
+
+// resize changes the buffer's capacity to size, returning the number of
+// spans discarded when more than size are buffered: the oldest under
+// OverflowDropOldest, otherwise the newest, raw spans first in both cases.
+func (b *spansBuffer) resize(size int) (dropped int) {
+	b.maxBufferSize = size
+	if b.dropOldest {
+		return b.makeRoom(0)
+	}
+	excess := b.len() - size
+	if excess <= 0 {
+		return 0
+	}
+	fromSpans := excess
+	if fromSpans > len(b.rawSpans) {
+		fromSpans = len(b.rawSpans)
+	}
+	keep := len(b.rawSpans) - fromSpans
+	for i := keep; i < len(b.rawSpans); i++ {
+		b.bytes -= b.spanSize(&b.rawSpans[i])
+		b.rawSpans[i] = basictracer.RawSpan{}
+	}
+	b.rawSpans = b.rawSpans[:keep]
+	keepRecords := len(b.records) - (excess - fromSpans)
+	for _, record := range b.records[keepRecords:] {
+		b.bytes -= b.recordSize(record)
+	}
+	b.records = b.records[:keepRecords]
+	return excess
+}
+
+// restore returns the spans and records of a failed report to the buffer,
+// returning the number that no longer fit. Under OverflowDropOldest the
+// restored spans, being older than any buffered since, are the ones
+// dropped, and those kept are placed first.
+func (b *spansBuffer) restore(spans []basictracer.RawSpan, records []*lightstep_thrift.SpanRecord) (dropped int) {
+	if !b.dropOldest {
+		_, dropped = b.addSpans(spans)
+		_, droppedRecords := b.addRecords(records)
+		return dropped + droppedRecords
+	}
+	space := b.maxBufferSize - b.len()
+	if space < 0 {
+		space = 0
+	}
+	// As in makeRoom, raw spans are discarded before records.
+	keepRecords := len(records)
+	if keepRecords > space {
+		keepRecords = space
+	}
+	keepSpans := len(spans)
+	if keepSpans > space-keepRecords {
+		keepSpans = space - keepRecords
+	}
+	dropped = len(spans) - keepSpans + len(records) - keepRecords
+
+	rawSpans := make([]basictracer.RawSpan, 0, b.maxBufferSize)
+	rawSpans = append(rawSpans, spans[len(spans)-keepSpans:]...)
+	b.rawSpans = append(rawSpans, b.rawSpans...)
+	if keepRecords > 0 {
+		b.records = append(append([]*lightstep_thrift.SpanRecord(nil), records[len(records)-keepRecords:]...), b.records...)
+	}
+	b.noteAdded(keepSpans + keepRecords)
+	if b.maxBytes > 0 {
+		// As above, the restored spans, being the oldest, are evicted first.
+		for _, span := range spans[len(spans)-keepSpans:] {
+			b.bytes += b.spanSize(&span)
+		}
+		for _, record := range records[len(records)-keepRecords:] {
+			b.bytes += b.recordSize(record)
+		}
+		dropped += b.makeRoom(0)
+	}
+	return dropped
+}
+
+// isIdentical reports whether two spans have the same operation and the same
+// values for every coalescing key tag.
+func (b *spansBuffer) isIdentical(x, y *basictracer.RawSpan) bool {
+	if x.Operation != y.Operation {
+		return false
+	}
+	for _, key := range b.coalesceKeyTags {
+		xv, xok := x.Tags[key]
+		yv, yok := y.Tags[key]
+		if xok != yok || fmt.Sprint(xv) != fmt.Sprint(yv) {
+			return false
+		}
+	}
+	return true
+}
+
+// coalesceInto folds `from` into the representative span `into`, recording
+// the combined number of spans under CoalescedCountKey.
+func coalesceInto(into, from *basictracer.RawSpan) {
+	count := coalescedCount(into) + coalescedCount(from)
+	// Copy the tags rather than modifying the map owned by the span.
+	tags := make(ot.Tags, len(into.Tags)+1)
+	for k, v := range into.Tags {
+		tags[k] = v
+	}
+	tags[CoalescedCountKey] = count
+	into.Tags = tags
+}
+
+func coalescedCount(span *basictracer.RawSpan) int64 {
+	if count, ok := span.Tags[CoalescedCountKey].(int64); ok {
+		return count
+	}
+	return 1
+}
+
+// groupByTrace reorders spans in place so that spans sharing a trace ID are
+// adjacent. Traces keep the order of their first span, and spans within a
+// trace keep their relative order.
+func groupByTrace(spans []basictracer.RawSpan) {
+	firstSeen := make(map[uint64]int)
+	for i, span := range spans {
+		if _, ok := firstSeen[span.Context.TraceID]; !ok {
+			firstSeen[span.Context.TraceID] = i
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return firstSeen[spans[i].Context.TraceID] < firstSeen[spans[j].Context.TraceID]
+	})
+}
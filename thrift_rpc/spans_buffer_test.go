@@ -0,0 +1,251 @@
+package thrift_rpc
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/basictracer-go"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+func TestSpansBufferCoalescing(t *testing.T) {
+	var b spansBuffer
+	b.setDefaults()
+	b.setCoalescing([]string{"target"})
+
+	poll := makeRawSpan("poll", ot.Tags{"target": "db", "attempt": 1})
+	for i := 0; i < 5; i++ {
+		b.addSpans([]basictracer.RawSpan{poll})
+	}
+	b.addSpans([]basictracer.RawSpan{makeRawSpan("poll", ot.Tags{"target": "cache"})})
+	b.addSpans([]basictracer.RawSpan{poll, poll})
+
+	spans := b.current()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 coalesced spans, got %d", len(spans))
+	}
+	for i, expected := range []int64{5, 1, 2} {
+		if count := coalescedCount(&spans[i]); count != expected {
+			t.Errorf("span %d: expected count %d, got %d", i, expected, count)
+		}
+	}
+	if _, ok := poll.Tags[CoalescedCountKey]; ok {
+		t.Errorf("coalescing must not modify the recorded span's tags")
+	}
+
+	// Restoring coalesced spans keeps their counts.
+	b.reset()
+	b.addSpans(spans[:1])
+	b.addSpans(spans[2:])
+	if spans := b.current(); len(spans) != 1 || coalescedCount(&spans[0]) != 7 {
+		t.Errorf("expected a single span with count 7, got %v", spans)
+	}
+}
+
+func TestSpansBufferCoalescingOperation(t *testing.T) {
+	var b spansBuffer
+	b.setDefaults()
+	b.setCoalescing(nil)
+
+	b.addSpans([]basictracer.RawSpan{
+		makeRawSpan("a", nil),
+		makeRawSpan("b", nil),
+		makeRawSpan("a", nil),
+	})
+	if b.len() != 3 {
+		t.Errorf("spans with different operations must not coalesce, got %d spans", b.len())
+	}
+}
+
+func TestSpansBufferPartialAcceptance(t *testing.T) {
+	var b spansBuffer
+	b.setDefaults()
+	b.setMaxBufferSize(4)
+	b.reset()
+
+	spans := []basictracer.RawSpan{
+		makeRawSpan("a", nil), makeRawSpan("b", nil), makeRawSpan("c", nil),
+	}
+	if accepted, dropped := b.addSpans(spans); accepted != 3 || dropped != 0 {
+		t.Errorf("expected 3 accepted and 0 dropped, got %d and %d", accepted, dropped)
+	}
+	// Only one slot is left.
+	if accepted, dropped := b.addSpans(spans); accepted != 1 || dropped != 2 {
+		t.Errorf("expected 1 accepted and 2 dropped, got %d and %d", accepted, dropped)
+	}
+	if accepted, dropped := b.addSpans(spans[:1]); accepted != 0 || dropped != 1 {
+		t.Errorf("expected 0 accepted and 1 dropped, got %d and %d", accepted, dropped)
+	}
+	if b.len() != 4 {
+		t.Errorf("expected a full buffer of 4 spans, got %d", b.len())
+	}
+}
+
+func TestSpansBufferCoalescingPartialAcceptance(t *testing.T) {
+	var b spansBuffer
+	b.setDefaults()
+	b.setMaxBufferSize(1)
+	b.setCoalescing(nil)
+	b.reset()
+
+	spans := []basictracer.RawSpan{
+		makeRawSpan("poll", nil), makeRawSpan("poll", nil), makeRawSpan("other", nil),
+	}
+	// The second span coalesces into the first; the third finds no room.
+	if accepted, dropped := b.addSpans(spans); accepted != 2 || dropped != 1 {
+		t.Errorf("expected 2 accepted and 1 dropped, got %d and %d", accepted, dropped)
+	}
+}
+
+func operations(spans []basictracer.RawSpan) []string {
+	ops := make([]string, len(spans))
+	for i, span := range spans {
+		ops[i] = span.Operation
+	}
+	return ops
+}
+
+func TestSpansBufferOverflowPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		expected []string
+	}{
+		{"", []string{"0", "1", "2"}},
+		{OverflowDropNewest, []string{"0", "1", "2"}},
+		{OverflowDropOldest, []string{"3", "4", "5"}},
+	} {
+		var b spansBuffer
+		b.setDefaults()
+		b.setMaxBufferSize(3)
+		b.setOverflowPolicy(test.policy)
+		b.reset()
+
+		var dropped int
+		for i := 0; i < 4; i++ {
+			_, d := b.addSpans([]basictracer.RawSpan{makeRawSpan(strconv.Itoa(i), nil)})
+			dropped += d
+		}
+		_, d := b.addSpans([]basictracer.RawSpan{makeRawSpan("4", nil), makeRawSpan("5", nil)})
+		dropped += d
+		if ops := operations(b.current()); !reflect.DeepEqual(ops, test.expected) {
+			t.Errorf("%q: expected spans %v to survive, got %v", test.policy, test.expected, ops)
+		}
+		if dropped != 3 {
+			t.Errorf("%q: expected 3 dropped spans, got %d", test.policy, dropped)
+		}
+	}
+
+	// A batch larger than the buffer keeps its newest spans.
+	var b spansBuffer
+	b.setDefaults()
+	b.setMaxBufferSize(2)
+	b.setOverflowPolicy(OverflowDropOldest)
+	b.reset()
+	b.addSpans([]basictracer.RawSpan{makeRawSpan("old", nil)})
+	spans := []basictracer.RawSpan{makeRawSpan("a", nil), makeRawSpan("b", nil), makeRawSpan("c", nil)}
+	if accepted, dropped := b.addSpans(spans); accepted != 2 || dropped != 2 {
+		t.Errorf("expected 2 accepted and 2 dropped, got %d and %d", accepted, dropped)
+	}
+	if ops := operations(b.current()); !reflect.DeepEqual(ops, []string{"b", "c"}) {
+		t.Errorf("expected the newest spans to survive, got %v", ops)
+	}
+}
+
+func TestSpansBufferRestoreDropOldest(t *testing.T) {
+	var b spansBuffer
+	b.setDefaults()
+	b.setMaxBufferSize(3)
+	b.setOverflowPolicy(OverflowDropOldest)
+	b.reset()
+
+	// Spans recorded during a failed report are newer than the report's.
+	b.addSpans([]basictracer.RawSpan{makeRawSpan("new1", nil), makeRawSpan("new2", nil)})
+	failed := []basictracer.RawSpan{makeRawSpan("old1", nil), makeRawSpan("old2", nil)}
+	if dropped := b.restore(failed, nil); dropped != 1 {
+		t.Errorf("expected 1 restored span dropped, got %d", dropped)
+	}
+	expected := []string{"old2", "new1", "new2"}
+	if ops := operations(b.current()); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+}
+
+func TestSpansBufferMaxBytes(t *testing.T) {
+	large := func(operation string) basictracer.RawSpan {
+		return makeRawSpan(operation, ot.Tags{"payload": strings.Repeat("x", 400)})
+	}
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		expected []string
+	}{
+		{OverflowDropNewest, []string{"0", "1"}},
+		{OverflowDropOldest, []string{"2", "3"}},
+	} {
+		var b spansBuffer
+		b.setDefaults()
+		b.setMaxBytes(1050)
+		b.setOverflowPolicy(test.policy)
+		b.reset()
+
+		var dropped int
+		for i := 0; i < 4; i++ {
+			_, d := b.addSpans([]basictracer.RawSpan{large(strconv.Itoa(i))})
+			dropped += d
+		}
+		if ops := operations(b.current()); !reflect.DeepEqual(ops, test.expected) {
+			t.Errorf("%q: expected spans %v to survive, got %v", test.policy, test.expected, ops)
+		}
+		if dropped != 2 {
+			t.Errorf("%q: expected 2 dropped spans, got %d", test.policy, dropped)
+		}
+		if b.bytes > 1050 || b.bytes != b.spanSize(&b.rawSpans[0])+b.spanSize(&b.rawSpans[1]) {
+			t.Errorf("%q: expected the size of the two buffered spans, got %d bytes", test.policy, b.bytes)
+		}
+
+		// Small spans still fit alongside the large ones.
+		if accepted, _ := b.addSpans([]basictracer.RawSpan{makeRawSpan("small", nil)}); accepted != 1 {
+			t.Errorf("%q: expected a small span to fit", test.policy)
+		}
+		// A span larger than the whole limit never fits, and evicts nothing.
+		huge := makeRawSpan("huge", ot.Tags{"payload": strings.Repeat("x", 2000)})
+		if accepted, dropped := b.addSpans([]basictracer.RawSpan{huge}); accepted != 0 || dropped != 1 || b.len() != 3 {
+			t.Errorf("%q: expected the oversized span alone to be dropped, got %d accepted, %d dropped, %d buffered",
+				test.policy, accepted, dropped, b.len())
+		}
+
+		failed := append(b.current(), large("failed"))
+		b.reset()
+		if b.bytes != 0 {
+			t.Errorf("%q: expected reset to clear the size, got %d bytes", test.policy, b.bytes)
+		}
+		if dropped := b.restore(failed, nil); dropped != 1 || b.bytes > 1050 {
+			t.Errorf("%q: expected one restored span not to fit, got %d dropped, %d bytes", test.policy, dropped, b.bytes)
+		}
+	}
+}
+
+func TestSpansBufferAddSpan(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest} {
+		var one, many spansBuffer
+		for _, b := range []*spansBuffer{&one, &many} {
+			b.setDefaults()
+			b.setMaxBufferSize(3)
+			b.setOverflowPolicy(policy)
+			b.reset()
+		}
+		var oneDropped, manyDropped int
+		for i := 0; i < 5; i++ {
+			raw := makeRawSpan(strconv.Itoa(i), nil)
+			_, d := one.addSpan(raw)
+			oneDropped += d
+			_, d = many.addSpans([]basictracer.RawSpan{raw})
+			manyDropped += d
+		}
+		if ops := operations(one.current()); !reflect.DeepEqual(ops, operations(many.current())) || oneDropped != manyDropped {
+			t.Errorf("%q: expected addSpan to match addSpans, got %v and %d dropped rather than %v and %d",
+				policy, ops, oneDropped, operations(many.current()), manyDropped)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package thrift_rpc
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter bounds how long a collector throttle directive may pause
+// reporting.
+const maxRetryAfter = 10 * time.Minute
+
+// throttleTransport is an http.RoundTripper that watches report responses
+// for throttle directives (HTTP 429 or 503 with a Retry-After header) and
+// pauses the Recorder's report loop accordingly. It also applies the context
+// passed to FlushWithContext to the report request.
+type throttleTransport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.recorder.lock.Lock()
+	ctx := t.recorder.reportCtx
+	t.recorder.lock.Unlock()
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.recorder.clock.Now()); ok {
+			t.recorder.backoff(delay)
+		}
+	}
+	return resp, err
+}
+
+// parseRetryAfter parses a Retry-After header value, given either in
+// seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	if delay <= 0 {
+		return 0, false
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// backoff pauses the report loop for the given duration.
+func (r *Recorder) backoff(delay time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	until := r.clock.Now().Add(delay)
+	if until.After(r.backoffUntil) {
+		r.backoffUntil = until
+	}
+	r.maybeLogInfof("collector requested backoff for %v", delay)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// transport, so that http.Client.CloseIdleConnections reaches it.
+func (t *throttleTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// closeIdleConnections closes base's idle connections, if it keeps any.
+func closeIdleConnections(base http.RoundTripper) {
+	if c, ok := base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
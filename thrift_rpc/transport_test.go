@@ -0,0 +1,69 @@
+package thrift_rpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2016, 9, 9, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"junk", 0, false},
+		{"Fri, 09 Sep 2016 12:00:30 GMT", 30 * time.Second, true},
+		{"Fri, 09 Sep 2016 11:00:00 GMT", 0, false},
+		{"86400", maxRetryAfter, true},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value, now)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; expected %v, %v",
+				test.value, delay, ok, test.delay, test.ok)
+		}
+	}
+}
+
+func TestRetryAfterPausesReports(t *testing.T) {
+	var reports int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&reports, 1)
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	collector := &testCollector{Server: server}
+	rec := NewRecorder(Options{
+		AccessToken: "0987654321",
+		Collector:   collector.endpoint(),
+	})
+	rec.RecordSpan(makeRawSpan("op", nil))
+	rec.Flush()
+
+	rec.lock.Lock()
+	backoff := rec.backoffUntil.Sub(time.Now())
+	// Without the backoff, the report loop would flush on its next tick.
+	rec.lastReportAttempt = time.Time{}
+	rec.lock.Unlock()
+	if backoff <= time.Second || backoff > 2*time.Second {
+		t.Fatalf("expected a backoff of about 2s, got %v", backoff)
+	}
+
+	time.Sleep(3 * minReportingPeriod)
+	if n := atomic.LoadInt32(&reports); n != 1 {
+		t.Errorf("expected reports to pause during the backoff, got %d reports", n)
+	}
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt32(&reports) > 1 }) {
+		t.Errorf("reports did not resume after the backoff")
+	}
+}
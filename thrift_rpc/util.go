@@ -1,9 +1,13 @@
 package thrift_rpc
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"reflect"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -31,7 +35,13 @@ var logOneError sync.Once
 // maybeLogError logs the first error it receives using the standard log
 // package and may also log subsequent errors based on verboseFlag.
 func (r *Recorder) maybeLogError(err error) {
-	if r.verbose {
+	logError(r.verbose, err)
+}
+
+// logError is maybeLogError for callers without a Recorder, such as
+// constructors that failed to create one.
+func logError(verbose bool, err error) {
+	if verbose {
 		log.Printf("LightStep error: %v\n", err)
 	} else {
 		// Even if the flag is not set, always log at least one error.
@@ -48,3 +58,65 @@ func (r *Recorder) maybeLogInfof(format string, args ...interface{}) {
 		log.Printf("LightStep info: %s\n", s)
 	}
 }
+
+// formatTagValue converts a span tag value to the string reported for it.
+// Thrift attributes carry only strings, so floats are formatted in plain
+// decimal rather than the scientific notation fmt.Sprint uses for small
+// and large values; everything else is formatted with fmt.Sprint.
+func formatTagValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return fmt.Sprint(v)
+}
+
+// formatAttributeValue converts a component attribute value to the string
+// reported for it. Scalars and Stringers are formatted with fmt.Sprint,
+// while composite values are JSON encoded, since fmt.Sprint renders them
+// as Go syntax or bare pointers. Values that cannot be meaningfully
+// encoded, such as funcs and channels, are rejected with an error.
+func formatAttributeValue(v interface{}) (string, error) {
+	switch v.(type) {
+	case nil, string, bool, fmt.Stringer, error,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, uintptr,
+		float32, float64, complex64, complex128:
+		return fmt.Sprint(v), nil
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// TraceSampler returns a basictracer ShouldSample function keeping the
+// given fraction of traces. The decision depends only on the trace ID, so
+// every span of a trace, in this process or any other using the same rate,
+// gets the same decision. A rate of zero or at least one keeps every trace.
+func TraceSampler(rate float64) func(traceID uint64) bool {
+	if rate <= 0 || rate >= 1 {
+		return func(_ uint64) bool { return true }
+	}
+	threshold := uint64(rate * math.MaxUint64)
+	return func(traceID uint64) bool {
+		// Trace IDs generated in-process only use 63 bits, so mix them
+		// (using the splitmix64 finalizer) before comparing.
+		h := traceID
+		h ^= h >> 30
+		h *= 0xbf58476d1ce4e5b9
+		h ^= h >> 27
+		h *= 0x94d049bb133111eb
+		h ^= h >> 31
+		return h < threshold
+	}
+}
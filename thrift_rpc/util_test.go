@@ -0,0 +1,108 @@
+package thrift_rpc
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+type endpointConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+func TestFormatAttributeValue(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{"checkout", "checkout"},
+		{42, "42"},
+		{true, "true"},
+		{endpointConfig{"db", 5432}, `{"host":"db","port":5432}`},
+		{&endpointConfig{"db", 5432}, `{"host":"db","port":5432}`},
+		{[]string{"a", "b"}, `["a","b"]`},
+	} {
+		value, err := formatAttributeValue(test.value)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.value, err)
+		} else if value != test.expected {
+			t.Errorf("%#v: expected %q, got %q", test.value, test.expected, value)
+		}
+	}
+
+	for _, value := range []interface{}{func() {}, make(chan int)} {
+		if _, err := formatAttributeValue(value); err == nil {
+			t.Errorf("%T: expected an error", value)
+		}
+	}
+}
+
+func TestFormatTagValue(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{"200", "200"},
+		{200, "200"},
+		{int64(-3), "-3"},
+		{true, "true"},
+		{0.0000001, "0.0000001"},
+		{float32(0.5), "0.5"},
+		{1e21, "1000000000000000000000"},
+		{nil, "<nil>"},
+	} {
+		if value := formatTagValue(test.value); value != test.expected {
+			t.Errorf("%#v: expected %q, got %q", test.value, test.expected, value)
+		}
+	}
+}
+
+func TestNonScalarComponentAttributes(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	rec, _ := newTestRecorder(Options{
+		Verbose: true,
+		Tags: map[string]interface{}{
+			"endpoint": endpointConfig{"db", 5432},
+			"callback": func() {},
+		},
+	})
+
+	if value := rec.attributes["endpoint"]; value != `{"host":"db","port":5432}` {
+		t.Errorf("unexpected struct attribute %q", value)
+	}
+	if value, found := rec.attributes["callback"]; found {
+		t.Errorf("expected func attribute to be skipped, got %q", value)
+	}
+	if !strings.Contains(logged.String(), `"callback"`) {
+		t.Errorf("expected a warning about the func attribute, got %q", logged.String())
+	}
+}
+
+func TestTraceSampler(t *testing.T) {
+	sample := TraceSampler(0.25)
+	kept := 0
+	for traceID := uint64(0); traceID < 10000; traceID++ {
+		decision := sample(traceID)
+		if decision != sample(traceID) {
+			t.Fatalf("trace %x: inconsistent sampling decision", traceID)
+		}
+		if decision {
+			kept++
+		}
+	}
+	if kept < 2000 || kept > 3000 {
+		t.Errorf("expected about 2500 of 10000 traces to be kept, got %d", kept)
+	}
+
+	for _, rate := range []float64{0, 1} {
+		if !TraceSampler(rate)(12345) {
+			t.Errorf("rate %v: expected every trace to be kept", rate)
+		}
+	}
+}
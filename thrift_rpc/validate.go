@@ -0,0 +1,118 @@
+package thrift_rpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// OptionsErrors lists the problems Validate found with an Options.
+type OptionsErrors []error
+
+func (e OptionsErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid LightStep Recorder options: " + strings.Join(msgs, "; ")
+}
+
+// Validate reports the problems with o that would keep a Recorder from
+// being constructed, or make it behave other than intended. A single
+// problem is returned as is; several are returned together as
+// OptionsErrors. NewRecorderE returns the same error.
+//
+// Fields left zero take their defaults and are always valid. A
+// ReportingPeriod below the minimum is not an error: it is raised to the
+// minimum, as NewRecorderE logs.
+func (o Options) Validate() error {
+	var errs OptionsErrors
+	if len(o.AccessToken) == 0 {
+		errs = append(errs, errEmptyAccessToken)
+	}
+	errs = append(errs, o.Collector.validate("Collector")...)
+	errs = append(errs, o.LightStepAPI.validate("LightStepAPI")...)
+	if o.CollectorPath != "" && !strings.HasPrefix(o.CollectorPath, "/") {
+		errs = append(errs, fmt.Errorf("CollectorPath %q is not a path beginning with \"/\"; set the host and port in Collector",
+			o.CollectorPath))
+	}
+
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"MaxBufferedSpans", int64(o.MaxBufferedSpans)},
+		{"MaxBufferedBytes", int64(o.MaxBufferedBytes)},
+		{"MaxLogMessageLen", int64(o.MaxLogMessageLen)},
+		{"MaxLogsPerSpan", int64(o.MaxLogsPerSpan)},
+		{"ReportPayloadQuotaBytes", int64(o.ReportPayloadQuotaBytes)},
+		{"SynchronousBatchSize", int64(o.SynchronousBatchSize)},
+		{"MaxSpansPerReport", int64(o.MaxSpansPerReport)},
+		{"RecordQueueSize", int64(o.RecordQueueSize)},
+		{"ReconnectAfterFailures", int64(o.ReconnectAfterFailures)},
+		{"ReportingPeriod", int64(o.ReportingPeriod)},
+		{"ReportTimeout", int64(o.ReportTimeout)},
+		{"StreamInterval", int64(o.StreamInterval)},
+		{"MaxSpanDelay", int64(o.MaxSpanDelay)},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", field.name))
+		}
+	}
+	if o.MaxSpansPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("MaxSpansPerSecond must not be negative"))
+	}
+	if o.TraceSamplingRate < 0 || o.TraceSamplingRate > 1 {
+		errs = append(errs, fmt.Errorf("TraceSamplingRate %v is not in [0, 1]", o.TraceSamplingRate))
+	}
+	for pattern, rate := range o.PerOperationSampleRates {
+		if rate < 0 || rate > 1 {
+			errs = append(errs, fmt.Errorf("PerOperationSampleRates[%q] %v is not in [0, 1]", pattern, rate))
+		}
+	}
+	if o.FlushThresholdRatio < 0 || o.FlushThresholdRatio > 1 {
+		errs = append(errs, fmt.Errorf("FlushThresholdRatio %v is not in (0, 1]", o.FlushThresholdRatio))
+	}
+
+	for _, err := range []error{
+		o.ThriftProtocol.validate(),
+		o.OverflowPolicy.validate(),
+		o.CounterMode.validate(),
+		o.Compression.validate(),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// validate returns the problems with e, the Options field called name.
+func (e Endpoint) validate(name string) []error {
+	var errs []error
+	if e.Host != "" && !validHost(e.Host) {
+		errs = append(errs, fmt.Errorf("%s.Host %q is not a host name or IP address; set the port in %s.Port",
+			name, e.Host, name))
+	}
+	if e.Port < 0 || e.Port > 65535 {
+		errs = append(errs, fmt.Errorf("%s.Port %d is not in [0, 65535]", name, e.Port))
+	}
+	return errs
+}
+
+// validHost reports whether host can be used as is in a URL: a name or
+// IPv4 address without a scheme, port, or path, or a bracketed IPv6
+// address.
+func validHost(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return net.ParseIP(host[1:len(host)-1]) != nil
+	}
+	return !strings.ContainsAny(host, ":/?#@[] \t\r\n")
+}
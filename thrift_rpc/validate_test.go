@@ -0,0 +1,84 @@
+package thrift_rpc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Options{AccessToken: "0987654321"}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected the zero Options with an access token to be valid, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(o *Options)
+		expect string // a fragment of the error
+	}{
+		{"access token", func(o *Options) { o.AccessToken = "" }, "AccessToken"},
+		{"collector scheme", func(o *Options) { o.Collector.Host = "https://collector.example.com" }, "Collector.Host"},
+		{"collector port in host", func(o *Options) { o.Collector.Host = "collector.example.com:443" }, "Collector.Host"},
+		{"collector path in host", func(o *Options) { o.Collector.Host = "collector.example.com/api" }, "Collector.Host"},
+		{"collector IPv6", func(o *Options) { o.Collector.Host = "[::1" }, "Collector.Host"},
+		{"collector port", func(o *Options) { o.Collector.Port = 70000 }, "Collector.Port"},
+		{"negative collector port", func(o *Options) { o.Collector.Port = -1 }, "Collector.Port"},
+		{"API port", func(o *Options) { o.LightStepAPI.Port = 65536 }, "LightStepAPI.Port"},
+		{"collector path", func(o *Options) { o.CollectorPath = "api/v0/reports" }, "CollectorPath"},
+		{"buffer size", func(o *Options) { o.MaxBufferedSpans = -1 }, "MaxBufferedSpans"},
+		{"log message length", func(o *Options) { o.MaxLogMessageLen = -1 }, "MaxLogMessageLen"},
+		{"logs per span", func(o *Options) { o.MaxLogsPerSpan = -1 }, "MaxLogsPerSpan"},
+		{"payload quota", func(o *Options) { o.ReportPayloadQuotaBytes = -1 }, "ReportPayloadQuotaBytes"},
+		{"batch size", func(o *Options) { o.SynchronousBatchSize = -1 }, "SynchronousBatchSize"},
+		{"spans per report", func(o *Options) { o.MaxSpansPerReport = -1 }, "MaxSpansPerReport"},
+		{"reporting period", func(o *Options) { o.ReportingPeriod = -time.Second }, "ReportingPeriod"},
+		{"report timeout", func(o *Options) { o.ReportTimeout = -time.Second }, "ReportTimeout"},
+		{"stream interval", func(o *Options) { o.StreamInterval = -time.Second }, "StreamInterval"},
+		{"span delay", func(o *Options) { o.MaxSpanDelay = -time.Second }, "MaxSpanDelay"},
+		{"span rate", func(o *Options) { o.MaxSpansPerSecond = -1 }, "MaxSpansPerSecond"},
+		{"sampling rate", func(o *Options) { o.TraceSamplingRate = 1.5 }, "TraceSamplingRate"},
+		{"operation sampling rate", func(o *Options) { o.PerOperationSampleRates = map[string]float64{"op": -1} }, `PerOperationSampleRates["op"]`},
+		{"flush threshold", func(o *Options) { o.FlushThresholdRatio = 1.5 }, "FlushThresholdRatio"},
+		{"thrift protocol", func(o *Options) { o.ThriftProtocol = "xml" }, "xml"},
+		{"overflow policy", func(o *Options) { o.OverflowPolicy = "drop_random" }, "drop_random"},
+		{"counter mode", func(o *Options) { o.CounterMode = "gauge" }, "gauge"},
+		{"compression", func(o *Options) { o.Compression = "brotli" }, "brotli"},
+	} {
+		opts := valid
+		test.modify(&opts)
+		err := opts.Validate()
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("%s: expected an error mentioning %s, got %v", test.name, test.expect, err)
+		}
+		if _, err := NewRecorderE(opts); err == nil {
+			t.Errorf("%s: expected NewRecorderE to fail", test.name)
+		}
+	}
+}
+
+func TestValidateValidHosts(t *testing.T) {
+	for _, host := range []string{"collector.example.com", "10.0.0.1", "[::1]", "localhost"} {
+		opts := Options{AccessToken: "0987654321", Collector: Endpoint{Host: host, Port: 443}}
+		if err := opts.Validate(); err != nil {
+			t.Errorf("expected %q to be valid, got %v", host, err)
+		}
+	}
+}
+
+func TestValidateCombinesErrors(t *testing.T) {
+	err := Options{MaxBufferedSpans: -1, Collector: Endpoint{Port: -1}}.Validate()
+	errs, ok := err.(OptionsErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 OptionsErrors, got %#v", err)
+	}
+	for _, field := range []string{"AccessToken", "MaxBufferedSpans", "Collector.Port"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected the error to mention %s, got %v", field, err)
+		}
+	}
+}